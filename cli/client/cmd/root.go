@@ -1,16 +1,17 @@
 package cmd
 
 import (
-	"encoding/gob"
+	"context"
 	"errors"
 	"fmt"
+	"github.com/colindr/gosync"
 	"github.com/colindr/gosync/transfer"
-	"github.com/google/uuid"
-	"net"
-	"path/filepath"
-	"strconv"
+	"io/ioutil"
+	"log/slog"
 	"strings"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 )
@@ -18,8 +19,69 @@ import (
 var host string
 var port int
 var configFile string
+var windowPackets int
+var windowBytes int
+var signatureWorkers int
+var deltaWorkers int
+var patchWorkers int
+var fecGroupSize int
+var packetSize int
+var probePacketSize bool
+var transportName string
+var udpPorts string
+var useTLS bool
+var caCert string
+var clientCert string
+var clientKey string
+var user string
+var passwordFile string
+var verbose bool
+var quiet bool
+var continueOnError bool
+
+// EXIT_PARTIAL is the exit code when some files were skipped, like
+// rsync's partial transfer
+const EXIT_PARTIAL = 23
 
 func init() {
+	rootCmd.Flags().IntVar(&windowPackets, "window-packets", 0,
+		"max number of unacknowledged packets kept in memory (0 for default)")
+	rootCmd.Flags().IntVar(&windowBytes, "window-bytes", 0,
+		"max bytes of unacknowledged packets kept in memory (0 for default)")
+	rootCmd.Flags().IntVar(&signatureWorkers, "signature-workers", 0,
+		"files to make signatures of at once when receiving (0 for one per CPU)")
+	rootCmd.Flags().IntVar(&deltaWorkers, "delta-workers", 0,
+		"files to make deltas of at once when sending (0 for one per CPU)")
+	rootCmd.Flags().IntVar(&patchWorkers, "patch-workers", 0,
+		"files to patch at once when receiving (0 for one per CPU)")
+	rootCmd.Flags().IntVar(&fecGroupSize, "fec", 0,
+		"send a parity packet for every N data packets to recover lost packets (0 disables)")
+	rootCmd.Flags().IntVar(&packetSize, "packet-size", transfer.DEFAULT_PACKET_SIZE,
+		"largest packet content length, raise it on networks with a large MTU")
+	rootCmd.Flags().BoolVar(&probePacketSize, "probe-packet-size", false,
+		"start with small packets and probe for the largest size up to --packet-size")
+	rootCmd.Flags().StringVar(&transportName, "transport", "udp",
+		"how file data travels: udp, tcp (over the control connection) or auto")
+	rootCmd.Flags().StringVar(&udpPorts, "udp-ports", "",
+		"udp port or port range to receive on, like 30000-30100 (default any free port)")
+	rootCmd.Flags().BoolVar(&useTLS, "tls", false,
+		"connect to the daemon with TLS, implied by --cacert and --cert")
+	rootCmd.Flags().StringVar(&caCert, "cacert", "",
+		"CA certificate to verify the daemon with (default system roots)")
+	rootCmd.Flags().StringVar(&clientCert, "cert", "",
+		"client certificate for daemons that require one")
+	rootCmd.Flags().StringVar(&clientKey, "key", "",
+		"private key of the client certificate")
+	rootCmd.Flags().StringVar(&user, "user", "",
+		"user to authenticate to the daemon as (default login name)")
+	rootCmd.Flags().StringVar(&passwordFile, "password-file", "",
+		"file holding the user's secret (default $GOSYNC_PASSWORD)")
+	rootCmd.Flags().BoolVarP(&verbose, "verbose", "v", false,
+		"log debugging details, like every packet sent")
+	rootCmd.Flags().BoolVarP(&quiet, "quiet", "q", false,
+		"only log errors")
+	rootCmd.Flags().BoolVar(&continueOnError, "continue-on-error", false,
+		"skip files that fail and sync the rest, exiting with 23 if any were skipped")
 }
 
 var rootCmd = &cobra.Command{
@@ -34,23 +96,55 @@ var rootCmd = &cobra.Command{
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		// Perform a sync
-		source := args[0]
-		dest := args[1]
-		req, err := NewRequestFromSourceAndDestination(source, dest)
-
+		logger, err := transfer.NewLogger(os.Stderr, logLevel(), transfer.LOG_FORMAT_TEXT)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
+		slog.SetDefault(logger)
 
-		if err := InitiateSync(req); err != nil {
+		options, err := syncOptions()
+		if err != nil {
 			fmt.Println(err)
 			return
 		}
+
+		// ^C aborts the transfer, letting the daemon know
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		// Perform a sync
+		source := args[0]
+		dest := args[1]
+		if _, err := gosync.Sync(ctx, source, dest, options...); err != nil {
+			var partial *transfer.PartialTransferError
+			if errors.As(err, &partial) {
+				for _, fileErr := range partial.FileErrors {
+					fmt.Fprintln(os.Stderr, fileErr)
+				}
+				fmt.Println(err)
+				os.Exit(EXIT_PARTIAL)
+			}
+			if errors.Is(err, gosync.ErrAuthRequired) {
+				err = errors.New(
+					"daemon requires authentication, use --password-file or set GOSYNC_PASSWORD")
+			}
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	},
 }
 
+// logLevel is info unless -v or -q say otherwise
+func logLevel() slog.Level {
+	if quiet {
+		return slog.LevelError
+	} else if verbose {
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -58,165 +152,61 @@ func Execute() {
 	}
 }
 
-
-func NewRequestFromSourceAndDestination(source string, dest string) (*transfer.Request, error) {
-	source_parts := strings.Split(source, ":")
-	dest_parts := strings.Split(dest, ":")
-
-	if len(source_parts) > 3 {
-		return nil, errors.New(fmt.Sprintf("unknown sync source format: %v", source))
+// syncOptions turns the flags into options for gosync.Sync
+func syncOptions() ([]gosync.Option, error) {
+	transport, err := transfer.ParseTransport(transportName)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(dest_parts) > 3 {
-		return nil, errors.New(fmt.Sprintf("unknown sync source format: %v", source))
+	ports, err := transfer.ParsePortRange(udpPorts)
+	if err != nil {
+		return nil, err
 	}
 
-	if (len(source_parts) > 1) && (len(dest_parts) > 1) {
-		return nil, errors.New(fmt.Sprintf("only one of source or destination can specify a host"))
+	options := []gosync.Option{
+		gosync.WithTransport(transport),
+		gosync.WithFEC(fecGroupSize),
+		gosync.WithPacketSize(packetSize, probePacketSize),
+		gosync.WithUDPPorts(ports),
+		gosync.WithWindow(windowPackets, windowBytes),
+		gosync.WithWorkers(signatureWorkers, deltaWorkers, patchWorkers),
 	}
 
-	var transferType transfer.Direction
-	var path string
-	var destination string
-	var port int
-	var host string
-	var err error
+	if continueOnError {
+		options = append(options, gosync.WithContinueOnError())
+	}
 
-	if (len(source_parts) == 1) && (len(dest_parts) == 1) {
-		transferType = transfer.Local
-		path, err = filepath.Abs(source)
-		if err != nil {
-			return nil, err
-		}
-		destination, err = filepath.Abs(dest)
-		if err != nil {
-			return nil, err
-		}
-		host = ""
-		port = 0
-	} else if len(source_parts) == 1 {
-		transferType = transfer.Outgoing
-		path, err = filepath.Abs(source)
-		if err != nil {
-			return nil, err
-		}
-		host = dest_parts[0]
-		if len (dest_parts) == 2{
-			if p, err := strconv.Atoi(dest_parts[1]); err != nil {
-				return nil, errors.New(fmt.Sprintf("unparsable port number: %v", dest_parts[1] ))
-			} else{
-				port = p
-			}
-			destination = dest_parts[2]
-		} else {
-			port = 4200 // TODO: default tcp port
-			destination = dest_parts[1]
-		}
-	} else {
-		transferType = transfer.Incoming
-		path, err = filepath.Abs(dest)
+	if useTLS || caCert != "" || clientCert != "" {
+		// the daemon's host is filled in as the server name
+		tlsConfig, err := transfer.ClientTLSConfig(caCert, clientCert, clientKey, "")
 		if err != nil {
 			return nil, err
 		}
-		host = source_parts[0]
-		if len (source_parts) == 2{
-			if p, err := strconv.Atoi(source_parts[1]); err != nil {
-				return nil, errors.New(fmt.Sprintf("unparsable port number: %v", dest_parts[1] ))
-			} else{
-				port = p
-			}
-			destination = source_parts[2]
-		} else {
-			port = 4200 // TODO: default tcp port
-			destination = source_parts[1]
-		}
-	}
-
-	return &transfer.Request{
-		RequestID: uuid.New(),
-
-		Host: host,
-		Port: port,
-
-		Direction: transferType,
-
-		Path: path,
-		Destination: destination,
-
-		// TODO: options
-		FollowLinks: false,
-		BlockSize: 4096,
-
-	}, nil
-
-}
-
-func InitiateSync(req *transfer.Request) error {
-
-	opts := &transfer.Options{
-		Path: req.Path,
-		Destination: req.Destination,
-
-		FollowLinks: req.FollowLinks,
-		BlockSize: req.BlockSize,
-	}
-
-	if req.Direction == transfer.Local {
-		_, err :=  transfer.SyncLocal(opts)
-		return err
+		options = append(options, gosync.WithTLS(tlsConfig))
 	}
 
-	var err error
-	req.RequesterHost, err = os.Hostname() // TODO: configurable hostname
-
-	if err !=nil{
-		return err
-	}
-
-	req.RequesterUDPPort = 30000 // TODO: pick a port
-
-	addr := fmt.Sprintf("%s:%v", req.Host, req.Port)
-	fmt.Println("Connecting to", addr)
-	conn, err := net.Dial("tcp", addr)
+	secret, err := readSecret()
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	encoder := gob.NewEncoder(conn)
-
-	if err := encoder.Encode(req); err != nil {
-		return errors.New(fmt.Sprintln("Error encoding transfer request:", err))
+	if secret != "" {
+		options = append(options, gosync.WithAuth(user, secret))
 	}
 
-	decoder := gob.NewDecoder(conn)
-
-	resp := &transfer.RequestResponse{}
-	if err := decoder.Decode(resp); err != nil {
-		return errors.New(fmt.Sprintln("Error encoding transfer request:", err))
-	}
+	return options, nil
+}
 
-	if !resp.Accepted {
-		return errors.New(fmt.Sprintln("Transfer request rejected:", resp.Reason))
+// readSecret returns the secret from --password-file or $GOSYNC_PASSWORD,
+// it's only used if the daemon requires authentication
+func readSecret() (string, error) {
+	if passwordFile == "" {
+		return os.Getenv("GOSYNC_PASSWORD"), nil
 	}
 
-	if req.Direction == transfer.Outgoing {
-		opts.SourceHost = req.RequesterHost
-		opts.SourceUDPPort = req.RequesterUDPPort
-
-		opts.DestinationHost = req.Host
-		opts.DestinationUDPPort = resp.UDPPort
-
-		_, err := transfer.SyncOutgoing(conn, opts)
-		return err
-	} else {
-		opts.SourceHost = req.Host
-		opts.SourceUDPPort = resp.UDPPort
-
-		opts.DestinationHost = req.RequesterHost
-		opts.DestinationUDPPort = req.RequesterUDPPort
-		_, err := transfer.SyncIncoming(conn, opts)
-		return err
+	content, err := ioutil.ReadFile(passwordFile)
+	if err != nil {
+		return "", err
 	}
-
-
-}
\ No newline at end of file
+	return strings.SplitN(string(content), "\n", 2)[0], nil
+}
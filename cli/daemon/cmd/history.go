@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/colindr/gosync/transfer"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var historyFile string
+var historySince string
+var historyUntil string
+var historyQuery transfer.AuditQuery
+var historyJSON bool
+
+func init() {
+	historyCmd.Flags().StringVar(&historyFile, "file", "",
+		"history file to read (default the config's history_file)")
+	historyCmd.Flags().StringVar(&historySince, "since", "",
+		"only requests since a time, like 2006-01-02T15:04:05Z, or a duration ago, like 24h")
+	historyCmd.Flags().StringVar(&historyUntil, "until", "",
+		"only requests before a time or a duration ago, like --since")
+	historyCmd.Flags().StringVar(&historyQuery.User, "user", "", "only requests by this user")
+	historyCmd.Flags().StringVar(&historyQuery.Module, "module", "", "only requests for this module")
+	historyCmd.Flags().StringVar(&historyQuery.Host, "host", "",
+		"only requests from this address or requester hostname")
+	historyCmd.Flags().StringVar(&historyQuery.State, "state", "",
+		"only requests that ended done, partial, failed, cancelled or rejected")
+	historyCmd.Flags().IntVar(&historyQuery.Limit, "limit", 0, "only the newest N requests (0 for all)")
+	historyCmd.Flags().BoolVar(&historyJSON, "json", false, "print the entries as JSON lines")
+
+	rootCmd.AddCommand(historyCmd)
+}
+
+// historyCmd prints the transfer requests recorded in the history file
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "show the transfer requests gosyncd answered",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := printHistory(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
+
+func printHistory() error {
+	path := historyFile
+	if path == "" {
+		path = viper.GetString("history_file")
+	}
+	if path == "" {
+		return errors.New("no history file, set history_file in the config or use --file")
+	}
+
+	var err error
+	if historyQuery.Since, err = parseHistoryTime(historySince); err != nil {
+		return err
+	}
+	if historyQuery.Until, err = parseHistoryTime(historyUntil); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries, err := transfer.ReadAuditLog(f, historyQuery)
+	if err != nil {
+		return err
+	}
+
+	if historyJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED\tSTATE\tDIRECTION\tUSER\tPEER\tMODULE\tPATH\tBYTES\tERROR")
+	for _, entry := range entries {
+		var bytes int64
+		if entry.Stats != nil {
+			bytes = entry.Stats.BytesSent
+		}
+		path := entry.Path
+		if path == "" {
+			// rejected requests may not have got as far as a local path
+			path = entry.Source
+			if entry.Direction == transfer.Outgoing.String() {
+				path = entry.Destination
+			}
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			entry.Started.Local().Format(time.RFC3339), entry.State, entry.Direction,
+			entry.User, entry.Peer, entry.Module, path, bytes, entry.Error)
+	}
+	return w.Flush()
+}
+
+// parseHistoryTime parses a time or a duration before now, "" is the
+// zero time
+func parseHistoryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if ago, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-ago), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, errors.New(fmt.Sprintf("invalid time %q, use RFC 3339 or a duration", s))
+	}
+	return t, nil
+}
@@ -3,9 +3,11 @@ package cmd
 import (
 	"bytes"
 	"fmt"
+	"github.com/colindr/gosync/transfer"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"os"
+	"time"
 )
 
 var host string
@@ -18,12 +20,91 @@ func init() {
 	rootCmd.PersistentFlags().IntVar(&port, "port", 0, "port the daemon should listen on")
 	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "config file")
 
-	// TODO: add http port for http REST API
 	viper.BindPFlag("port", rootCmd.PersistentFlags().Lookup("port"))
 	viper.SetDefault("port", 4200)
 
 	viper.BindPFlag("host", rootCmd.PersistentFlags().Lookup("host"))
 	viper.SetDefault("host", "0.0.0.0")
+
+	// address of the HTTP API and Prometheus /metrics, like
+	// "127.0.0.1:4280", empty disables it.
+	// The API has no authentication so keep it on a trusted address.
+	viper.SetDefault("http_addr", "")
+
+	// log records at log_level ("debug", "info", "warn" or "error") and
+	// above go to log_file, or stderr, as log_format "text" or "json".
+	// Reloads only change the level.
+	viper.SetDefault("log_level", "info")
+	viper.SetDefault("log_file", "")
+	viper.SetDefault("log_format", transfer.LOG_FORMAT_TEXT)
+
+	// how many finished transfers the API remembers
+	viper.SetDefault("history_size", transfer.DEFAULT_HISTORY_SIZE)
+
+	// file every answered request is appended to as a JSON line, for
+	// "gosyncd history", empty keeps no record
+	viper.SetDefault("history_file", "")
+
+	// TLS for the TCP connection, enabled when tls_cert is set.  With
+	// tls_client_ca client certificates are verified, and required if
+	// tls_require_client_cert is set.
+	viper.SetDefault("tls_cert", "")
+	viper.SetDefault("tls_key", "")
+	viper.SetDefault("tls_client_ca", "")
+	viper.SetDefault("tls_require_client_cert", false)
+
+	// file of user:secret lines, when set every request must
+	// authenticate as one of the users
+	viper.SetDefault("secrets_file", "")
+
+	// CIDRs or addresses that may or may not connect, an address in
+	// hosts_allow is let in even if it's in hosts_deny.  Modules can
+	// have their own lists.
+	viper.SetDefault("hosts_allow", []string{})
+	viper.SetDefault("hosts_deny", []string{})
+
+	// modules map names to directories, see moduleConfig.  Without
+	// modules requests can name any absolute path.
+	viper.SetDefault("modules", map[string]interface{}{})
+
+	// caps on the transfers running at once, overall and per client
+	// address, 0 for no limit.  Requests over max_connections wait in a
+	// queue of up to max_queued, the rest are told to come back after
+	// retry_after.  Modules can have their own max_connections.
+	viper.SetDefault("max_connections", 0)
+	viper.SetDefault("max_connections_per_host", 0)
+	viper.SetDefault("max_queued", 0)
+	viper.SetDefault("retry_after", transfer.DEFAULT_RETRY_AFTER)
+
+	// connections get handshake_timeout to send and authenticate their
+	// request, and at most max_handshakes can be doing that at once
+	viper.SetDefault("handshake_timeout", transfer.DEFAULT_HANDSHAKE_TIMEOUT)
+	viper.SetDefault("max_handshakes", transfer.DEFAULT_MAX_HANDSHAKES)
+
+	// how long SIGTERM waits for running transfers before aborting them
+	viper.SetDefault("shutdown_timeout", 5*time.Minute)
+
+	// range of udp ports transfers may bind, like "30000-30100", empty
+	// for any ephemeral port
+	viper.SetDefault("udp_ports", "")
+
+	// send window limits, 0 uses the transfer package defaults
+	viper.SetDefault("window_packets", 0)
+	viper.SetDefault("window_bytes", 0)
+
+	// files each pipeline stage works on at once, 0 for one per CPU
+	viper.SetDefault("signature_workers", 0)
+	viper.SetDefault("delta_workers", 0)
+	viper.SetDefault("patch_workers", 0)
+
+	// files each of those stages keeps open, 0 to fit RLIMIT_NOFILE
+	viper.SetDefault("max_open_files", 0)
+
+	// smallest forward error correction group clients may ask for
+	viper.SetDefault("min_fec_group_size", 0)
+
+	// largest packet content length clients may ask for, 0 for no limit
+	viper.SetDefault("max_packet_size", 0)
 }
 
 func initConfig() {
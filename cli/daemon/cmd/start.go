@@ -1,15 +1,363 @@
 package cmd
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/colindr/gosync/transfer"
 	"github.com/spf13/viper"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
 )
 
+// daemonLog is the daemon's logging, set up once by StartDaemon.  A
+// reload can change the level but not where or how it logs.
+var daemonLog struct {
+	level  slog.LevelVar
+	logger *slog.Logger
+	output io.Writer
+	file   string
+	format string
+}
+
+// auditLog is opened once by StartDaemon, nil without a history_file
+var auditLog *transfer.AuditLog
+
 func StartDaemon() {
+	if err := setupLogging(); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if historyFile := viper.GetString("history_file"); historyFile != "" {
+		var err error
+		if auditLog, err = transfer.OpenAuditLog(historyFile); err != nil {
+			slog.Error("error opening history file", "error", err)
+			return
+		}
+		defer auditLog.Close()
+	}
+
+	config, err := loadDaemonConfig()
+	if err != nil {
+		slog.Error("error loading config", "error", err)
+		return
+	}
+
+	server := transfer.NewServer(config)
+	stopped := make(chan bool)
+	go handleSignals(server, stopped)
+
+	// the API stays up while transfers drain, so they can be watched
+	if httpAddr := viper.GetString("http_addr"); httpAddr != "" {
+		go serveAPI(server, httpAddr)
+	}
+
+	slog.Info("listening", "addr", config.Addr)
+	if err := server.ListenAndServe(); err != transfer.ErrServerClosed {
+		slog.Error("error listening", "error", err)
+		return
+	}
+
+	// wait for the running transfers to drain
+	<-stopped
+}
+
+func serveAPI(server *transfer.Server, addr string) {
+	slog.Info("http api listening", "addr", addr)
+	if err := http.ListenAndServe(addr, server.APIHandler()); err != nil {
+		slog.Error("error serving http api", "error", err)
+	}
+}
+
+// setupLogging opens log_file, or uses stderr, and makes the logger all
+// of the daemon's records go to
+func setupLogging() error {
+	level, err := transfer.ParseLogLevel(viper.GetString("log_level"))
+	if err != nil {
+		return err
+	}
+	daemonLog.level.Set(level)
+
+	daemonLog.file = viper.GetString("log_file")
+	daemonLog.format = viper.GetString("log_format")
+	daemonLog.output = os.Stderr
+	if daemonLog.file != "" {
+		f, err := os.OpenFile(daemonLog.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error opening log file: %v", err))
+		}
+		daemonLog.output = f
+	}
+
+	daemonLog.logger, err = transfer.NewLogger(daemonLog.output, &daemonLog.level, daemonLog.format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(daemonLog.logger)
+	return nil
+}
+
+// handleSignals reloads the config on SIGHUP, and shuts the server down
+// on SIGTERM or SIGINT, closing stopped once it has
+func handleSignals(server *transfer.Server, stopped chan bool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			reloadConfig(server)
+			continue
+		}
+
+		timeout := viper.GetDuration("shutdown_timeout")
+		slog.Info("shutting down", "signal", sig.String(), "timeout", timeout,
+			"transfers", server.Running())
+		signal.Stop(signals)
+
+		if err := server.Shutdown(timeout); err != nil {
+			slog.Warn("error shutting down", "error", err)
+		}
+		close(stopped)
+		return
+	}
+}
+
+// reloadConfig rereads the config file, a bad config is reported and the
+// old one kept.  The listening and http addresses, where and how we log
+// and the history file stay as they were.
+func reloadConfig(server *transfer.Server) {
+	slog.Info("reloading config")
+
+	if err := viper.ReadInConfig(); err != nil {
+		slog.Error("error reading config, keeping the old one", "error", err)
+		return
+	}
+
+	level, err := transfer.ParseLogLevel(viper.GetString("log_level"))
+	if err != nil {
+		slog.Error("error loading config, keeping the old one", "error", err)
+		return
+	}
+
+	config, err := loadDaemonConfig()
+	if err != nil {
+		slog.Error("error loading config, keeping the old one", "error", err)
+		return
+	}
+	if config.Addr != server.Config().Addr {
+		slog.Warn("can't change the listening address without a restart", "addr", config.Addr)
+	}
+	if viper.GetString("log_file") != daemonLog.file || viper.GetString("log_format") != daemonLog.format {
+		slog.Warn("can't change log_file or log_format without a restart")
+	}
+	historyFile := ""
+	if auditLog != nil {
+		historyFile = auditLog.Path()
+	}
+	if viper.GetString("history_file") != historyFile {
+		slog.Warn("can't change history_file without a restart")
+	}
+
+	daemonLog.level.Set(level)
+	server.Reload(config)
+}
+
+// loadDaemonConfig builds the daemon's config from viper
+func loadDaemonConfig() (*transfer.DaemonConfig, error) {
 	addr := fmt.Sprintf("%v:%v", viper.Get("host"), viper.Get("port"))
 
-	fmt.Println("Listening at", addr)
+	udpPorts, err := transfer.ParsePortRange(viper.GetString("udp_ports"))
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsConfig *tls.Config
+	if viper.GetString("tls_cert") != "" {
+		tlsConfig, err = transfer.ServerTLSConfig(
+			viper.GetString("tls_cert"),
+			viper.GetString("tls_key"),
+			viper.GetString("tls_client_ca"),
+			viper.GetBool("tls_require_client_cert"))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error loading TLS config: %v", err))
+		}
+	}
+
+	var secrets transfer.Secrets
+	if viper.GetString("secrets_file") != "" {
+		secrets, err = transfer.LoadSecrets(viper.GetString("secrets_file"))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error loading secrets: %v", err))
+		}
+	}
+
+	modules, err := loadModules()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error loading modules: %v", err))
+	}
+
+	hostAccess, err := transfer.ParseHostAccess(
+		viper.GetStringSlice("hosts_allow"), viper.GetStringSlice("hosts_deny"))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error loading host access lists: %v", err))
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error finding gosyncd executable: %v", err))
+	}
+
+	return &transfer.DaemonConfig{
+		Addr: addr,
+
+		TLSConfig: tlsConfig,
+
+		UDPPorts: udpPorts,
+
+		WindowPackets: viper.GetInt("window_packets"),
+		WindowBytes:   viper.GetInt("window_bytes"),
+
+		SignatureWorkers: viper.GetInt("signature_workers"),
+		DeltaWorkers:     viper.GetInt("delta_workers"),
+		PatchWorkers:     viper.GetInt("patch_workers"),
+		MaxOpenFiles:     viper.GetInt("max_open_files"),
+
+		MinFECGroupSize: viper.GetInt("min_fec_group_size"),
+		MaxPacketSize:   viper.GetInt("max_packet_size"),
+
+		Secrets: secrets,
+		Modules: modules,
+
+		HostAccess: hostAccess,
+
+		WorkerCommand: []string{executable, "worker"},
+
+		HistorySize: viper.GetInt("history_size"),
+		AuditLog:    auditLog,
+
+		Logger:    daemonLog.logger,
+		LogLevel:  &daemonLog.level,
+		LogFormat: daemonLog.format,
+		LogOutput: daemonLog.output,
+
+		Limiter: transfer.NewLimiter(transfer.ConnectionLimits{
+			MaxConnections: viper.GetInt("max_connections"),
+			MaxPerHost:     viper.GetInt("max_connections_per_host"),
+			MaxQueued:      viper.GetInt("max_queued"),
+			RetryAfter:     viper.GetDuration("retry_after"),
+		}),
+		HandshakeTimeout: viper.GetDuration("handshake_timeout"),
+		MaxHandshakes:    viper.GetInt("max_handshakes"),
+	}, nil
+}
+
+// moduleConfig is a module as written in the config file:
+//
+//	modules:
+//	  backups:
+//	    path: /srv/backups
+//	    read_only: true
+//	    allowed_users: [alice, bob]
+//	    hosts_allow: [10.0.0.0/8]
+//	    chroot: true
+//	    uid: nobody
+//	    gid: nogroup
+//	    max_connections: 4
+type moduleConfig struct {
+	Path         string   `mapstructure:"path"`
+	ReadOnly     bool     `mapstructure:"read_only"`
+	AllowedUsers []string `mapstructure:"allowed_users"`
+	HostsAllow   []string `mapstructure:"hosts_allow"`
+	HostsDeny    []string `mapstructure:"hosts_deny"`
+	Chroot       bool     `mapstructure:"chroot"`
+	UID          string   `mapstructure:"uid"`
+	GID          string   `mapstructure:"gid"`
+
+	MaxConnections int `mapstructure:"max_connections"`
+}
+
+func loadModules() (map[string]*transfer.Module, error) {
+	configs := make(map[string]moduleConfig)
+	if err := viper.UnmarshalKey("modules", &configs); err != nil {
+		return nil, err
+	}
+
+	modules := make(map[string]*transfer.Module)
+	for name, config := range configs {
+		if !filepath.IsAbs(config.Path) {
+			return nil, errors.New(fmt.Sprintf("module %v needs an absolute path: %q", name, config.Path))
+		}
+
+		hostAccess, err := transfer.ParseHostAccess(config.HostsAllow, config.HostsDeny)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("module %v: %v", name, err))
+		}
+
+		modules[name] = &transfer.Module{
+			Name: name,
+			Path: filepath.Clean(config.Path),
+
+			ReadOnly:     config.ReadOnly,
+			AllowedUsers: config.AllowedUsers,
+			HostAccess:   hostAccess,
+
+			Chroot: config.Chroot,
+
+			MaxConnections: config.MaxConnections,
+		}
+
+		if config.UID != "" || config.GID != "" {
+			creds, err := lookupCredentials(config.UID, config.GID)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("module %v: %v", name, err))
+			}
+			modules[name].RunAs = creds
+		}
+
+		// root can get out of a chroot, so the worker has to drop it
+		if config.Chroot && (modules[name].RunAs == nil || modules[name].RunAs.UID == 0) {
+			return nil, errors.New(fmt.Sprintf("module %v: chroot needs a uid other than root", name))
+		}
+	}
+
+	return modules, nil
+}
+
+// lookupCredentials resolves a user and group given by name or number.
+// Without a group the user's primary group is used.
+func lookupCredentials(uid string, gid string) (*transfer.Credentials, error) {
+	if uid == "" {
+		return nil, errors.New("gid needs a uid")
+	}
+
+	u, err := user.Lookup(uid)
+	if err != nil {
+		if u, err = user.LookupId(uid); err != nil {
+			return nil, err
+		}
+	}
+
+	if gid == "" {
+		gid = u.Gid
+	} else if g, err := user.LookupGroup(gid); err == nil {
+		gid = g.Gid
+	}
+
+	creds := &transfer.Credentials{}
+	if creds.UID, err = strconv.Atoi(u.Uid); err != nil {
+		return nil, err
+	}
+	if creds.GID, err = strconv.Atoi(gid); err != nil {
+		return nil, errors.New(fmt.Sprintf("unknown group: %v", gid))
+	}
 
-	transfer.Daemon(addr)
+	return creds, nil
 }
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/colindr/gosync/transfer"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func init() {
+	rootCmd.AddCommand(workerCmd)
+}
+
+// workerCmd runs one transfer for a module that chroots or runs as
+// another user, the daemon starts it
+var workerCmd = &cobra.Command{
+	Use:    "worker",
+	Short:  "run a transfer handed over by gosyncd",
+	Hidden: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := transfer.RunWorker(os.Stdin); err != nil {
+			fmt.Fprintln(os.Stderr, "Worker error:", err)
+			os.Exit(1)
+		}
+	},
+}
@@ -0,0 +1,486 @@
+// Package gosync syncs files between local directories or with a gosyncd
+// daemon, for programs that would otherwise run the gosync client.
+//
+//	result, err := gosync.Sync(ctx, "/data/", "backup.example.com::backups/data",
+//		gosync.WithAuth("alice", secret))
+//
+// The transfer package underneath has the details, like the Options
+// these calls fill in.
+package gosync
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdh"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/colindr/gosync/transfer"
+	"github.com/google/uuid"
+	"net"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrAuthRequired is returned when the daemon requires authentication
+// and WithAuth wasn't given
+var ErrAuthRequired = errors.New("daemon requires authentication")
+
+// Result is what a sync did.  It's returned along with the error when a
+// sync fails once it started, a partial sync's error is a
+// *transfer.PartialTransferError.
+type Result struct {
+	RequestID uuid.UUID
+	Stats     *transfer.TransferStats
+	// FileErrors are the files that were skipped, see WithContinueOnError
+	FileErrors []transfer.FileError
+}
+
+// Sync syncs src to dst.  Either may be on a daemon, written like the
+// gosync client's arguments, see ParseLocation.
+func Sync(ctx context.Context, src string, dst string, options ...Option) (*Result, error) {
+	remoteSrc, err := ParseLocation(src)
+	if err != nil {
+		return nil, err
+	}
+	remoteDst, err := ParseLocation(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	if remoteSrc != nil && remoteDst != nil {
+		return nil, errors.New("only one of source or destination can specify a host")
+	}
+
+	if remoteSrc == nil && remoteDst == nil {
+		return syncLocal(ctx, src, dst, newConfig(options))
+	}
+
+	remote := remoteDst
+	if remoteSrc != nil {
+		remote = remoteSrc
+	}
+	if remote.Module != "" {
+		options = append(options, WithModule(remote.Module))
+	}
+
+	conn, err := Dial(ctx, remote.Addr(), options...)
+	if err != nil {
+		return nil, err
+	}
+	if remoteSrc != nil {
+		return conn.Pull(ctx, remote.Path, dst)
+	}
+	return conn.Push(ctx, src, remote.Path)
+}
+
+func syncLocal(ctx context.Context, src string, dst string, cfg *config) (*Result, error) {
+	path, err := filepath.Abs(src)
+	if err != nil {
+		return nil, err
+	}
+	destination, err := filepath.Abs(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{RequestID: uuid.New()}
+	opts := cfg.options(result.RequestID, path, destination)
+
+	stop := cfg.watchProgress(opts.Stats)
+	stats, err := transfer.SyncLocal(ctx, opts)
+	stop()
+
+	return result.finish(stats, err)
+}
+
+// Conn is a connection to a daemon.  It carries one Push or Pull, Dial
+// again for the next.
+type Conn struct {
+	conn   net.Conn
+	host   string
+	port   int
+	config *config
+	used   bool
+}
+
+// Dial connects to the daemon at addr, host or host:port.  Connections
+// that go unused should be closed.
+func Dial(ctx context.Context, addr string, options ...Option) (*Conn, error) {
+	cfg := newConfig(options)
+
+	host, port, err := splitAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if port == 0 {
+		port = DEFAULT_PORT
+	}
+	addr = fmt.Sprintf("%s:%v", host, port)
+
+	cfg.logger().Info("connecting", "addr", addr)
+
+	var conn net.Conn
+	if cfg.tlsConfig != nil {
+		tlsConfig := cfg.tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = host
+		}
+		dialer := &tls.Dialer{Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		dialer := &net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn = &bufferedConn{Conn: conn, reader: bufio.NewReader(conn)}
+	return &Conn{conn: conn, host: host, port: port, config: cfg}, nil
+}
+
+// bufferedConn reads through one buffer, gob decoders read ahead unless
+// they're given an io.ByteReader.  Otherwise the decoder for the daemon's
+// response could swallow the status the daemon sends right after it,
+// and the transfer's decoder would never see it.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+func (conn *bufferedConn) ReadByte() (byte, error) {
+	return conn.reader.ReadByte()
+}
+
+// Close closes a connection that wasn't used for a Push or Pull
+func (conn *Conn) Close() error {
+	return conn.conn.Close()
+}
+
+// Push syncs the local localPath to remotePath on the daemon
+func (conn *Conn) Push(ctx context.Context, localPath string, remotePath string) (*Result, error) {
+	path, err := filepath.Abs(localPath)
+	if err != nil {
+		conn.conn.Close()
+		return nil, err
+	}
+	return conn.run(ctx, transfer.Outgoing, path, remotePath)
+}
+
+// Pull syncs remotePath on the daemon to the local localPath
+func (conn *Conn) Pull(ctx context.Context, remotePath string, localPath string) (*Result, error) {
+	destination, err := filepath.Abs(localPath)
+	if err != nil {
+		conn.conn.Close()
+		return nil, err
+	}
+	return conn.run(ctx, transfer.Incoming, remotePath, destination)
+}
+
+func (conn *Conn) run(ctx context.Context, direction transfer.Direction, path string, destination string) (*Result, error) {
+	if conn.used {
+		return nil, errors.New("a Conn can only be used for one sync")
+	}
+	conn.used = true
+
+	// the Sync functions close the connection, close it ourselves until
+	// we get that far
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			conn.conn.Close()
+		}
+	}()
+
+	cfg := conn.config
+	log := cfg.logger()
+
+	req := &transfer.Request{
+		RequestID: uuid.New(),
+
+		Host: conn.host,
+		Port: conn.port,
+
+		Direction: direction,
+
+		Path:        path,
+		Destination: destination,
+		Module:      cfg.module,
+
+		BlockSize:       cfg.blockSize,
+		ContinueOnError: cfg.continueOnError,
+
+		FECGroupSize: cfg.fecGroupSize,
+
+		PacketSize:      cfg.packetSize,
+		ProbePacketSize: cfg.probePacketSize,
+
+		Transport: cfg.transport,
+	}
+
+	result := &Result{RequestID: req.RequestID}
+	opts := cfg.options(req.RequestID, req.Path, req.Destination)
+
+	// module paths are relative to the module, only the daemon knows
+	// where they really are, so we root them for our side
+	if req.Module != "" {
+		if direction == transfer.Outgoing {
+			opts.Destination = "/" + req.Destination
+		} else {
+			opts.Path = "/" + req.Path
+		}
+	}
+
+	req.RequesterHost = cfg.hostname
+	if req.RequesterHost == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		req.RequesterHost = hostname
+	}
+
+	// bind our udp socket before asking, so we can tell the daemon
+	// which port we actually got, and send our half of the key exchange
+	// that seals udp packets
+	var sessionKey *ecdh.PrivateKey
+	if req.Transport != transfer.TCPTransport {
+		var err error
+		sessionKey, err = transfer.NewSessionKey()
+		if err != nil {
+			return nil, err
+		}
+		req.PublicKey = sessionKey.PublicKey().Bytes()
+
+		opts.UDPConn, err = transfer.ListenUDP("", cfg.udpPorts)
+		if err != nil {
+			return nil, err
+		}
+		req.RequesterUDPPort = transfer.UDPPort(opts.UDPConn)
+	}
+	// the Sync functions close the udp socket too
+	defer func() {
+		if !handedOff && opts.UDPConn != nil {
+			opts.UDPConn.Close()
+		}
+	}()
+
+	// give up on the daemon if ctx is done before the transfer starts
+	stopWatching := context.AfterFunc(ctx, func() {
+		conn.conn.SetDeadline(time.Now())
+	})
+
+	resp, err := conn.request(req)
+	if !stopWatching() {
+		return nil, errors.New(fmt.Sprintf("transfer aborted: %v", context.Cause(ctx)))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if sessionKey != nil {
+		opts.SourceKey, opts.DestinationKey, err = transfer.DeriveSessionKeys(
+			sessionKey, resp.PublicKey, req.RequestID)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintln("Error deriving session keys:", err))
+		}
+	}
+
+	opts.FECGroupSize = resp.FECGroupSize
+	opts.PacketSize = resp.PacketSize
+	opts.ProbePacketSize = resp.ProbePacketSize
+	opts.Transport = resp.Transport
+
+	stop := cfg.watchProgress(opts.Stats)
+	defer stop()
+
+	handedOff = true
+	var stats *transfer.TransferStats
+	if direction == transfer.Outgoing {
+		opts.SourceHost = req.RequesterHost
+		opts.SourceUDPPort = req.RequesterUDPPort
+
+		opts.DestinationHost = req.Host
+		opts.DestinationUDPPort = resp.UDPPort
+
+		stats, err = transfer.SyncOutgoing(ctx, conn.conn, opts)
+	} else {
+		opts.SourceHost = req.Host
+		opts.SourceUDPPort = resp.UDPPort
+
+		opts.DestinationHost = req.RequesterHost
+		opts.DestinationUDPPort = req.RequesterUDPPort
+
+		stats, err = transfer.SyncIncoming(ctx, conn.conn, opts)
+	}
+	stop()
+
+	log.Debug("sync finished", "request_id", req.RequestID, "error", err)
+	return result.finish(stats, err)
+}
+
+// request sends req and answers the daemon until it accepts or rejects
+// it
+func (conn *Conn) request(req *transfer.Request) (*transfer.RequestResponse, error) {
+	cfg := conn.config
+
+	encoder := gob.NewEncoder(conn.conn)
+	if err := encoder.Encode(req); err != nil {
+		return nil, errors.New(fmt.Sprintln("Error encoding transfer request:", err))
+	}
+
+	decoder := gob.NewDecoder(conn.conn)
+
+	challenge := &transfer.AuthChallenge{}
+	if err := decoder.Decode(challenge); err != nil {
+		return nil, errors.New(fmt.Sprintln("Error decoding auth challenge:", err))
+	}
+
+	var authResponse *transfer.AuthResponse
+	if len(challenge.Nonce) > 0 {
+		response, err := cfg.authResponse(challenge, req)
+		if err != nil {
+			return nil, err
+		}
+		if err := encoder.Encode(response); err != nil {
+			return nil, errors.New(fmt.Sprintln("Error encoding auth response:", err))
+		}
+		authResponse = response
+	}
+
+	// the daemon may queue us behind other transfers before it answers
+	resp := &transfer.RequestResponse{Queued: true}
+	for resp.Queued {
+		resp = &transfer.RequestResponse{}
+		if err := decoder.Decode(resp); err != nil {
+			return nil, errors.New(fmt.Sprintln("Error decoding transfer response:", err))
+		}
+
+		if resp.Queued {
+			cfg.logger().Info("waiting for other transfers", "queue_position", resp.QueuePosition)
+			if cfg.onQueued != nil {
+				cfg.onQueued(resp.QueuePosition)
+			}
+		}
+	}
+
+	if !resp.Accepted {
+		return nil, errors.New(fmt.Sprintln("Transfer request rejected:", resp.Reason))
+	}
+
+	// without TLS this is what tells us the daemon's PublicKey is its own
+	if authResponse != nil && !transfer.CheckResponse(cfg.authSecret(), authResponse.MAC, resp) {
+		return nil, errors.New("the daemon's response failed authentication")
+	}
+	return resp, nil
+}
+
+func (cfg *config) authResponse(challenge *transfer.AuthChallenge, req *transfer.Request) (*transfer.AuthResponse, error) {
+	if cfg.secret == "" {
+		return nil, ErrAuthRequired
+	}
+
+	name := cfg.user
+	if name == "" {
+		current, err := osuser.Current()
+		if err != nil {
+			return nil, err
+		}
+		name = current.Username
+	}
+
+	return &transfer.AuthResponse{
+		User: name,
+		MAC:  transfer.AuthMAC(cfg.authSecret(), challenge.Nonce, req),
+	}, nil
+}
+
+// authSecret is the secret given with WithAuth
+func (cfg *config) authSecret() []byte {
+	return []byte(strings.TrimSpace(cfg.secret))
+}
+
+// options returns the transfer.Options for this side of a sync, the rest
+// is filled in once the daemon answers
+func (cfg *config) options(requestID uuid.UUID, path string, destination string) *transfer.Options {
+	return &transfer.Options{
+		Path:        path,
+		Destination: destination,
+
+		BlockSize:       cfg.blockSize,
+		ContinueOnError: cfg.continueOnError,
+
+		WindowPackets: cfg.windowPackets,
+		WindowBytes:   cfg.windowBytes,
+
+		SignatureWorkers: cfg.signatureWorkers,
+		DeltaWorkers:     cfg.deltaWorkers,
+		PatchWorkers:     cfg.patchWorkers,
+		MaxOpenFiles:     cfg.maxOpenFiles,
+
+		Stats:      transfer.NewTransferStats(),
+		RequestID:  requestID,
+		LogHandler: cfg.logHandler,
+		Observer:   cfg.observer,
+	}
+}
+
+// watchProgress calls the WithProgress callback until the returned func
+// is called, which calls it a last time.  Calling that func again does
+// nothing.
+func (cfg *config) watchProgress(stats *transfer.TransferStats) func() {
+	if cfg.onProgress == nil {
+		return func() {}
+	}
+
+	interval := cfg.progressInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cfg.onProgress(stats.Snapshot())
+			case <-done:
+				cfg.onProgress(stats.Snapshot())
+				return
+			}
+		}
+	}()
+
+	called := false
+	return func() {
+		if called {
+			return
+		}
+		called = true
+		close(done)
+		<-stopped
+	}
+}
+
+func (result *Result) finish(stats *transfer.TransferStats, err error) (*Result, error) {
+	result.Stats = stats
+
+	var partial *transfer.PartialTransferError
+	if errors.As(err, &partial) {
+		result.FileErrors = partial.FileErrors
+	}
+	return result, err
+}
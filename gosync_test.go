@@ -0,0 +1,216 @@
+package gosync
+
+import (
+	"context"
+	"fmt"
+	"github.com/colindr/gosync/transfer"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseLocation(t *testing.T) {
+	cases := []struct {
+		location string
+		expected *Location
+	}{
+		{"/local/path", nil},
+		{"host:/data", &Location{Host: "host", Port: DEFAULT_PORT, Path: "/data"}},
+		{"host:4300:/data", &Location{Host: "host", Port: 4300, Path: "/data"}},
+		{"host::backups/data", &Location{Host: "host", Port: DEFAULT_PORT, Module: "backups", Path: "data"}},
+		{"host:4300::backups", &Location{Host: "host", Port: 4300, Module: "backups"}},
+	}
+
+	for _, c := range cases {
+		location, err := ParseLocation(c.location)
+		if err != nil {
+			t.Errorf("%v: %v", c.location, err)
+			continue
+		}
+		if (location == nil) != (c.expected == nil) ||
+			(location != nil && *location != *c.expected) {
+			t.Errorf("%v should parse to %+v not %+v", c.location, c.expected, location)
+		}
+	}
+
+	for _, bad := range []string{"host::", "a:b:c:d", "host:port:/data"} {
+		if _, err := ParseLocation(bad); err == nil {
+			t.Errorf("%v should not parse", bad)
+		}
+	}
+}
+
+// completedObserver counts the files completed
+type completedObserver struct {
+	transfer.NopObserver
+	completed int
+}
+
+func (observer *completedObserver) FileCompleted(path string, literal int64, matched int64) {
+	observer.completed++
+}
+
+func TestSyncLocal(t *testing.T) {
+	source, err := ioutil.TempDir("/tmp", "gosync.source.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(source)
+	destination, err := ioutil.TempDir("/tmp", "gosync.dest.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+
+	content := []byte("some content to sync")
+	if err := ioutil.WriteFile(filepath.Join(source, "a"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var last *transfer.TransferStats
+	observer := &completedObserver{}
+	result, err := Sync(context.Background(), source, destination,
+		WithBlockSize(8),
+		WithProgress(time.Millisecond, func(stats *transfer.TransferStats) { last = stats }),
+		WithObserver(observer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	synced, err := ioutil.ReadFile(filepath.Join(destination, "a"))
+	if err != nil || string(synced) != string(content) {
+		t.Errorf("a should have been synced, not %q, %v", synced, err)
+	}
+
+	if result.Stats.BytesSent != int64(len(content)) {
+		t.Errorf("BytesSent should be %v not %v", len(content), result.Stats.BytesSent)
+	}
+	// the last progress call is after the sync is done
+	if last == nil || last.BytesSent != result.Stats.BytesSent {
+		t.Errorf("the last progress should have the final stats, not %+v", last)
+	}
+	if observer.completed != 1 {
+		t.Errorf("the observer should have seen 1 file completed, not %v", observer.completed)
+	}
+}
+
+// serveDaemon runs a daemon with config, returning its address
+func serveDaemon(t *testing.T, config *transfer.DaemonConfig) string {
+	server := transfer.NewServer(config)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Shutdown(time.Second) })
+	return ln.Addr().String()
+}
+
+// TestPullFromDaemon pulls, where the daemon sends the first status right
+// behind its response.  Reading the response mustn't swallow it, or the
+// pull hangs.
+func TestPullFromDaemon(t *testing.T) {
+	source, err := ioutil.TempDir("/tmp", "gosync.source.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(source)
+	destination, err := ioutil.TempDir("/tmp", "gosync.dest.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+
+	content := []byte("some content to pull")
+	if err := ioutil.WriteFile(filepath.Join(source, "a"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := serveDaemon(t, &transfer.DaemonConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, transport := range []transfer.Transport{transfer.TCPTransport, transfer.UDPTransport} {
+		os.Remove(filepath.Join(destination, "a"))
+
+		_, err := Sync(ctx, fmt.Sprintf("%v:%v", addr, source), destination,
+			WithBlockSize(8), WithTransport(transport))
+		if err != nil {
+			t.Fatalf("pulling over %v: %v", transport, err)
+		}
+
+		pulled, err := ioutil.ReadFile(filepath.Join(destination, "a"))
+		if err != nil || string(pulled) != string(content) {
+			t.Errorf("a should have been pulled over %v, not %q, %v", transport, pulled, err)
+		}
+	}
+}
+
+func TestConnCarriesOneSync(t *testing.T) {
+	source, err := ioutil.TempDir("/tmp", "gosync.source.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(source)
+	destination, err := ioutil.TempDir("/tmp", "gosync.dest.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+
+	if err := ioutil.WriteFile(filepath.Join(source, "a"), []byte("pushed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := Dial(context.Background(), serveDaemon(t, &transfer.DaemonConfig{}), WithTransport(transfer.TCPTransport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Push(context.Background(), source, destination); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Pull(context.Background(), destination, source); err == nil {
+		t.Error("a Conn should refuse a second sync, Dial again for it")
+	}
+}
+
+func TestSyncWithAuth(t *testing.T) {
+	source, err := ioutil.TempDir("/tmp", "gosync.source.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(source)
+	destination, err := ioutil.TempDir("/tmp", "gosync.dest.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+
+	if err := ioutil.WriteFile(filepath.Join(source, "a"), []byte("authenticated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := serveDaemon(t, &transfer.DaemonConfig{
+		Secrets: transfer.Secrets{"alice": []byte("s3cret")},
+	})
+
+	// both sides MAC what they send, and the client checks the daemon's
+	_, err = Sync(context.Background(), source, fmt.Sprintf("%v:%v", addr, destination),
+		WithAuth("alice", "s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed, err := ioutil.ReadFile(filepath.Join(destination, "a"))
+	if err != nil || string(pushed) != "authenticated" {
+		t.Errorf("a should have been pushed, not %q, %v", pushed, err)
+	}
+
+	_, err = Sync(context.Background(), source, fmt.Sprintf("%v:%v", addr, destination),
+		WithAuth("alice", "guess"))
+	if err == nil {
+		t.Error("the wrong secret shouldn't authenticate")
+	}
+}
@@ -0,0 +1,88 @@
+package gosync
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DEFAULT_PORT is the port gosyncd listens on unless configured otherwise
+const DEFAULT_PORT = 4200
+
+// Location is the daemon's side of a sync, written host:path,
+// host:port:path, host::module/path or host:port::module/path
+type Location struct {
+	Host string
+	Port int
+	// Module is the daemon module Path is in, Path is absolute without
+	// one
+	Module string
+	Path   string
+}
+
+// Addr is the daemon's host:port
+func (location *Location) Addr() string {
+	return fmt.Sprintf("%v:%v", location.Host, location.Port)
+}
+
+// ParseLocation returns nil if location is a local path
+func ParseLocation(location string) (*Location, error) {
+	if !strings.Contains(location, ":") {
+		return nil, nil
+	}
+
+	var address string
+	remote := &Location{Port: DEFAULT_PORT}
+
+	if i := strings.Index(location, "::"); i >= 0 {
+		address = location[:i]
+		modulePath := strings.SplitN(location[i+2:], "/", 2)
+		remote.Module = modulePath[0]
+		if len(modulePath) == 2 {
+			remote.Path = modulePath[1]
+		}
+		if remote.Module == "" {
+			return nil, errors.New(fmt.Sprintf("missing module name: %v", location))
+		}
+	} else {
+		parts := strings.Split(location, ":")
+		if len(parts) > 3 {
+			return nil, errors.New(fmt.Sprintf("unknown sync location format: %v", location))
+		}
+		address = strings.Join(parts[:len(parts)-1], ":")
+		remote.Path = parts[len(parts)-1]
+	}
+
+	hostPort := strings.Split(address, ":")
+	if len(hostPort) > 2 {
+		return nil, errors.New(fmt.Sprintf("unknown sync location format: %v", location))
+	}
+	remote.Host = hostPort[0]
+	if len(hostPort) == 2 {
+		p, err := strconv.Atoi(hostPort[1])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("unparsable port number: %v", hostPort[1]))
+		}
+		remote.Port = p
+	}
+
+	return remote, nil
+}
+
+// splitAddr splits host or host:port, the port is 0 when it's missing
+func splitAddr(address string) (string, int, error) {
+	hostPort := strings.Split(address, ":")
+	if len(hostPort) > 2 {
+		return "", 0, errors.New(fmt.Sprintf("unknown address format: %v", address))
+	}
+	if len(hostPort) == 1 {
+		return hostPort[0], 0, nil
+	}
+
+	port, err := strconv.Atoi(hostPort[1])
+	if err != nil {
+		return "", 0, errors.New(fmt.Sprintf("unparsable port number: %v", hostPort[1]))
+	}
+	return hostPort[0], port, nil
+}
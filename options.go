@@ -0,0 +1,177 @@
+package gosync
+
+import (
+	"crypto/tls"
+	"github.com/colindr/gosync/transfer"
+	"log/slog"
+	"time"
+)
+
+// DEFAULT_BLOCK_SIZE is the block size signatures are made of
+const DEFAULT_BLOCK_SIZE = 4096
+
+// Option configures Sync and Dial
+type Option func(*config)
+
+type config struct {
+	blockSize       int
+	continueOnError bool
+
+	transport       transfer.Transport
+	fecGroupSize    int
+	packetSize      int
+	probePacketSize bool
+	udpPorts        transfer.PortRange
+
+	windowPackets int
+	windowBytes   int
+
+	signatureWorkers int
+	deltaWorkers     int
+	patchWorkers     int
+	maxOpenFiles     int
+
+	tlsConfig *tls.Config
+	user      string
+	secret    string
+	module    string
+	hostname  string
+
+	logHandler slog.Handler
+
+	progressInterval time.Duration
+	onProgress       func(*transfer.TransferStats)
+	onQueued         func(position int)
+	observer         transfer.TransferObserver
+}
+
+func newConfig(options []Option) *config {
+	cfg := &config{
+		blockSize: DEFAULT_BLOCK_SIZE,
+	}
+	for _, option := range options {
+		option(cfg)
+	}
+	return cfg
+}
+
+func (cfg *config) logger() *slog.Logger {
+	if cfg.logHandler != nil {
+		return slog.New(cfg.logHandler)
+	}
+	return slog.Default()
+}
+
+// WithBlockSize sets the block size, DEFAULT_BLOCK_SIZE otherwise
+func WithBlockSize(size int) Option {
+	return func(cfg *config) { cfg.blockSize = size }
+}
+
+// WithContinueOnError skips the files that fail and syncs the rest, see
+// transfer.Options.ContinueOnError
+func WithContinueOnError() Option {
+	return func(cfg *config) { cfg.continueOnError = true }
+}
+
+// WithTransport sets how file data travels to and from a daemon,
+// transfer.UDPTransport otherwise
+func WithTransport(transport transfer.Transport) Option {
+	return func(cfg *config) { cfg.transport = transport }
+}
+
+// WithFEC sends a parity packet for every groupSize data packets
+func WithFEC(groupSize int) Option {
+	return func(cfg *config) { cfg.fecGroupSize = groupSize }
+}
+
+// WithPacketSize sets the largest packet content length, with probe
+// packets start small and grow up to size
+func WithPacketSize(size int, probe bool) Option {
+	return func(cfg *config) {
+		cfg.packetSize = size
+		cfg.probePacketSize = probe
+	}
+}
+
+// WithUDPPorts sets the ports to receive udp packets on, any free port
+// otherwise
+func WithUDPPorts(ports transfer.PortRange) Option {
+	return func(cfg *config) { cfg.udpPorts = ports }
+}
+
+// WithWindow limits the packets kept unacknowledged, see
+// transfer.Options.WindowPackets
+func WithWindow(packets int, bytes int) Option {
+	return func(cfg *config) {
+		cfg.windowPackets = packets
+		cfg.windowBytes = bytes
+	}
+}
+
+// WithWorkers sizes this side's pipeline stages, see
+// transfer.Options.SignatureWorkers
+func WithWorkers(signature int, delta int, patch int) Option {
+	return func(cfg *config) {
+		cfg.signatureWorkers = signature
+		cfg.deltaWorkers = delta
+		cfg.patchWorkers = patch
+	}
+}
+
+// WithMaxOpenFiles caps the files each pipeline stage keeps open
+func WithMaxOpenFiles(n int) Option {
+	return func(cfg *config) { cfg.maxOpenFiles = n }
+}
+
+// WithTLS connects to the daemon with TLS.  The daemon's host is
+// verified unless config has a ServerName.
+func WithTLS(tlsConfig *tls.Config) Option {
+	return func(cfg *config) { cfg.tlsConfig = tlsConfig }
+}
+
+// WithAuth answers daemons that require authentication, user defaults
+// to the login name
+func WithAuth(user string, secret string) Option {
+	return func(cfg *config) {
+		cfg.user = user
+		cfg.secret = secret
+	}
+}
+
+// WithModule makes the daemon's paths relative to its module
+func WithModule(module string) Option {
+	return func(cfg *config) { cfg.module = module }
+}
+
+// WithHostname is the name the daemon is told we have, os.Hostname
+// otherwise
+func WithHostname(hostname string) Option {
+	return func(cfg *config) { cfg.hostname = hostname }
+}
+
+// WithLogHandler gets the sync's log records, slog.Default's handler
+// otherwise
+func WithLogHandler(handler slog.Handler) Option {
+	return func(cfg *config) { cfg.logHandler = handler }
+}
+
+// WithProgress calls f with the stats so far every interval while the
+// sync runs, and once more when it's done
+func WithProgress(interval time.Duration, f func(*transfer.TransferStats)) Option {
+	return func(cfg *config) {
+		cfg.progressInterval = interval
+		cfg.onProgress = f
+	}
+}
+
+// WithQueued calls f while the daemon makes us wait for other transfers,
+// with our place in its queue
+func WithQueued(f func(position int)) Option {
+	return func(cfg *config) { cfg.onQueued = f }
+}
+
+// WithObserver tells observer about our side's files and errors as the
+// sync goes, see transfer.TransferObserver
+func WithObserver(observer transfer.TransferObserver) Option {
+	return func(cfg *config) { cfg.observer = observer }
+}
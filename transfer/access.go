@@ -0,0 +1,89 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// HostAccess decides which addresses may connect, like rsyncd's hosts
+// allow and hosts deny.  An address matching Allow is let in, otherwise
+// one matching Deny is turned away.  Anything else is let in unless there
+// is an Allow list.
+type HostAccess struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// ParseHostAccess parses lists of CIDRs like "10.0.0.0/8", bare addresses
+// are treated as a single host
+func ParseHostAccess(allow []string, deny []string) (HostAccess, error) {
+	var access HostAccess
+	var err error
+
+	if access.Allow, err = parseCIDRs(allow); err != nil {
+		return HostAccess{}, err
+	}
+	if access.Deny, err = parseCIDRs(deny); err != nil {
+		return HostAccess{}, err
+	}
+
+	return access, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.New(fmt.Sprintf("invalid address: %v", cidr))
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			cidr = fmt.Sprintf("%v/%v", cidr, bits)
+		}
+
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+
+	return nets, nil
+}
+
+// Allows returns whether ip may connect
+func (access HostAccess) Allows(ip net.IP) bool {
+	if matchesAny(access.Allow, ip) {
+		return true
+	}
+	if matchesAny(access.Deny, ip) {
+		return false
+	}
+	return len(access.Allow) == 0
+}
+
+func matchesAny(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the address conn connected from
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return net.ParseIP(host)
+}
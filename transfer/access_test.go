@@ -0,0 +1,47 @@
+package transfer
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHostAccess(t *testing.T) {
+	open, err := ParseHostAccess(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !open.Allows(net.ParseIP("192.0.2.1")) {
+		t.Error("no lists should allow everyone")
+	}
+
+	access, err := ParseHostAccess(
+		[]string{"10.1.0.0/16", "192.0.2.7"},
+		[]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, allowed := range map[string]bool{
+		"10.1.2.3":    true,  // allow wins over deny
+		"10.2.0.1":    false, // denied
+		"192.0.2.7":   true,  // single host
+		"192.0.2.8":   false, // not in the allow list
+		"2001:db8::1": false,
+	} {
+		if access.Allows(net.ParseIP(ip)) != allowed {
+			t.Errorf("%v should be allowed: %v", ip, allowed)
+		}
+	}
+
+	denyOnly, err := ParseHostAccess(nil, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if denyOnly.Allows(net.ParseIP("10.9.9.9")) || !denyOnly.Allows(net.ParseIP("192.0.2.1")) {
+		t.Error("a deny list alone should only turn away the denied hosts")
+	}
+
+	if _, err := ParseHostAccess([]string{"not-an-ip"}, nil); err == nil {
+		t.Error("invalid addresses should be refused")
+	}
+}
@@ -0,0 +1,239 @@
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// APIHandler serves the daemon's HTTP API:
+//
+//	GET    /health           whether the daemon is accepting transfers
+//	GET    /config           the daemon's config, without secrets
+//	GET    /transfers        the running transfers
+//	GET    /transfers/{id}   a running or recently finished transfer
+//	DELETE /transfers/{id}   cancel a running transfer
+//	GET    /history          recently finished transfers, newest first
+//	GET    /metrics          daemon-wide counters for Prometheus
+//
+// Responses are JSON, except /metrics which uses the Prometheus text
+// format.  There's no authentication, so only serve it on
+// addresses that trusted clients can reach.
+func (server *Server) APIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", server.handleHealth)
+	mux.HandleFunc("/config", server.handleConfig)
+	mux.HandleFunc("/transfers", server.handleTransfers)
+	mux.HandleFunc("/transfers/", server.handleTransfer)
+	mux.HandleFunc("/history", server.handleHistory)
+	mux.HandleFunc("/metrics", server.handleMetrics)
+	return mux
+}
+
+// Health is the response to /health
+type Health struct {
+	// Status is "ok", or "shutting down" once Shutdown is called
+	Status  string
+	Running int
+	Queued  int
+}
+
+// ConfigInfo is the response to /config, the parts of a DaemonConfig
+// that are safe to show
+type ConfigInfo struct {
+	Addr           string
+	TLS            bool
+	Authentication bool
+
+	UDPPorts        PortRange
+	WindowPackets   int
+	WindowBytes     int
+	MinFECGroupSize int
+	MaxPacketSize   int
+
+	HostsAllow []string
+	HostsDeny  []string
+
+	// Limits is nil without a Limiter
+	Limits *ConnectionLimits
+
+	Modules []ModuleInfo
+}
+
+// ModuleInfo is a Module as shown by /config
+type ModuleInfo struct {
+	Name           string
+	Path           string
+	ReadOnly       bool
+	AllowedUsers   []string
+	HostsAllow     []string
+	HostsDeny      []string
+	Chroot         bool
+	RunAs          *Credentials
+	MaxConnections int
+}
+
+func (server *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	health := Health{Status: "ok", Running: server.Running()}
+	if limiter := server.Config().Limiter; limiter != nil {
+		_, health.Queued = limiter.Active()
+	}
+
+	status := http.StatusOK
+	if server.isClosing() {
+		health.Status = "shutting down"
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, health)
+}
+
+func (server *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	config := server.Config()
+	info := ConfigInfo{
+		Addr:           config.Addr,
+		TLS:            config.TLSConfig != nil,
+		Authentication: config.Secrets != nil,
+
+		UDPPorts:        config.UDPPorts,
+		WindowPackets:   config.WindowPackets,
+		WindowBytes:     config.WindowBytes,
+		MinFECGroupSize: config.MinFECGroupSize,
+		MaxPacketSize:   config.MaxPacketSize,
+
+		HostsAllow: ipNetStrings(config.HostAccess.Allow),
+		HostsDeny:  ipNetStrings(config.HostAccess.Deny),
+
+		Modules: []ModuleInfo{},
+	}
+
+	if config.Limiter != nil {
+		limits := config.Limiter.Limits()
+		info.Limits = &limits
+	}
+
+	for _, module := range config.Modules {
+		info.Modules = append(info.Modules, ModuleInfo{
+			Name:           module.Name,
+			Path:           module.Path,
+			ReadOnly:       module.ReadOnly,
+			AllowedUsers:   module.AllowedUsers,
+			HostsAllow:     ipNetStrings(module.HostAccess.Allow),
+			HostsDeny:      ipNetStrings(module.HostAccess.Deny),
+			Chroot:         module.Chroot,
+			RunAs:          module.RunAs,
+			MaxConnections: module.MaxConnections,
+		})
+	}
+	sort.Slice(info.Modules, func(i, j int) bool {
+		return info.Modules[i].Name < info.Modules[j].Name
+	})
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (server *Server) handleTransfers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, server.Transfers())
+}
+
+func (server *Server) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	requestID, err := uuid.Parse(strings.TrimPrefix(r.URL.Path, "/transfers/"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("invalid request ID: %v", err))
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if !server.Cancel(requestID) {
+			writeError(w, http.StatusNotFound, "no running transfer with that request ID")
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	info, ok := server.Transfer(requestID)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no transfer with that request ID")
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (server *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, server.History())
+}
+
+func (server *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	var queued int
+	if limiter := server.Config().Limiter; limiter != nil {
+		_, queued = limiter.Active()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := server.metrics.Write(w, server.Transfers(), queued); err != nil {
+		server.Config().logger().Warn("error writing metrics", "error", err)
+	}
+}
+
+// allowMethods answers 405 unless the request uses one of methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("method %v not allowed", r.Method))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		slog.Warn("error encoding API response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, struct{ Error string }{message})
+}
+
+func ipNetStrings(nets []*net.IPNet) []string {
+	strs := []string{}
+	for _, ipNet := range nets {
+		strs = append(strs, ipNet.String())
+	}
+	return strs
+}
@@ -0,0 +1,125 @@
+package transfer
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getJSON(t *testing.T, handler http.Handler, method string, path string, expectedStatus int, v interface{}) {
+	request := httptest.NewRequest(method, path, nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Code != expectedStatus {
+		t.Fatalf("%v %v should return %v not %v: %v",
+			method, path, expectedStatus, recorder.Code, recorder.Body.String())
+	}
+	if v != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+			t.Fatalf("%v %v returned invalid JSON: %v", method, path, err)
+		}
+	}
+}
+
+func TestAPITransfers(t *testing.T) {
+	server := NewServer(&DaemonConfig{})
+	handler := server.APIHandler()
+
+	requestID := uuid.New()
+	active, _ := server.startTransfer(TransferInfo{
+		RequestID: requestID,
+		Direction: Outgoing.String(),
+		Path:      "/srv/a",
+	})
+	active.stats.RecordFileInfo(FileInfo{Size: 100})
+	active.stats.RecordDelta(Delta{Content: make([]byte, 25), Len: 25})
+
+	var transfers []TransferInfo
+	getJSON(t, handler, "GET", "/transfers", http.StatusOK, &transfers)
+	if len(transfers) != 1 || transfers[0].RequestID != requestID {
+		t.Fatalf("/transfers should list the running transfer not %v", transfers)
+	}
+	if transfers[0].State != TRANSFER_RUNNING || transfers[0].Progress != 0.25 {
+		t.Errorf("transfer should be running at 0.25 not %v at %v",
+			transfers[0].State, transfers[0].Progress)
+	}
+
+	getJSON(t, handler, "GET", "/transfers/"+uuid.New().String(), http.StatusNotFound, nil)
+	getJSON(t, handler, "POST", "/transfers", http.StatusMethodNotAllowed, nil)
+
+	// cancelling cancels the transfer's context
+	getJSON(t, handler, "DELETE", "/transfers/"+requestID.String(), http.StatusAccepted, nil)
+	select {
+	case <-active.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("cancelling didn't abort the transfer")
+	}
+	server.finishTransfer(active, nil, errTransferAborted)
+
+	getJSON(t, handler, "DELETE", "/transfers/"+requestID.String(), http.StatusNotFound, nil)
+
+	var info TransferInfo
+	getJSON(t, handler, "GET", "/transfers/"+requestID.String(), http.StatusOK, &info)
+	if info.State != TRANSFER_CANCELLED || info.Finished == nil {
+		t.Errorf("transfer should be cancelled not %v", info.State)
+	}
+
+	var history []TransferInfo
+	getJSON(t, handler, "GET", "/history", http.StatusOK, &history)
+	if len(history) != 1 || history[0].RequestID != requestID {
+		t.Errorf("/history should have the cancelled transfer not %v", history)
+	}
+}
+
+func TestAPIConfigAndHealth(t *testing.T) {
+	hostAccess, err := ParseHostAccess([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer(&DaemonConfig{
+		Addr:       "127.0.0.1:0",
+		Secrets:    Secrets{"alice": []byte("hunter2")},
+		HostAccess: hostAccess,
+		Modules: map[string]*Module{
+			"backups": {Name: "backups", Path: "/srv/backups", ReadOnly: true},
+		},
+		Limiter: NewLimiter(ConnectionLimits{MaxConnections: 4}),
+	})
+	handler := server.APIHandler()
+
+	request := httptest.NewRequest("GET", "/config", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if strings.Contains(recorder.Body.String(), "hunter2") {
+		t.Error("/config shouldn't show secrets")
+	}
+
+	var config ConfigInfo
+	getJSON(t, handler, "GET", "/config", http.StatusOK, &config)
+	if !config.Authentication || len(config.Modules) != 1 || !config.Modules[0].ReadOnly {
+		t.Errorf("/config doesn't match the config: %+v", config)
+	}
+	if len(config.HostsAllow) != 1 || config.HostsAllow[0] != "10.0.0.0/8" {
+		t.Errorf("HostsAllow should be [10.0.0.0/8] not %v", config.HostsAllow)
+	}
+	if config.Limits == nil || config.Limits.MaxConnections != 4 {
+		t.Errorf("Limits should have MaxConnections 4 not %v", config.Limits)
+	}
+
+	var health Health
+	getJSON(t, handler, "GET", "/health", http.StatusOK, &health)
+	if health.Status != "ok" {
+		t.Errorf("Status should be ok not %v", health.Status)
+	}
+
+	if err := server.Shutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	getJSON(t, handler, "GET", "/health", http.StatusServiceUnavailable, &health)
+}
@@ -0,0 +1,139 @@
+package transfer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditLog is an append-only file recording every transfer request the
+// daemon answered, one JSON encoded TransferInfo per line.  Rejected
+// requests are recorded in TRANSFER_REJECTED state with the reason in
+// Error.
+type AuditLog struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+}
+
+// OpenAuditLog opens the audit log at path for appending, creating it if
+// it doesn't exist
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, file: file}, nil
+}
+
+// Path returns the file the log is written to
+func (audit *AuditLog) Path() string {
+	return audit.path
+}
+
+// Record appends info to the log and syncs it to disk
+func (audit *AuditLog) Record(info TransferInfo) error {
+	line, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+
+	if _, err := audit.file.Write(line); err != nil {
+		return err
+	}
+	return audit.file.Sync()
+}
+
+func (audit *AuditLog) Close() error {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	return audit.file.Close()
+}
+
+// AuditQuery picks entries out of an audit log, zero fields match
+// anything
+type AuditQuery struct {
+	Since  time.Time
+	Until  time.Time
+	User   string
+	Module string
+	// Host matches either the Peer's address or the requester's Host
+	Host  string
+	State string
+
+	// Limit keeps only the newest Limit entries, 0 keeps them all
+	Limit int
+}
+
+// Matches returns whether info is one of the entries query asks for
+func (query AuditQuery) Matches(info TransferInfo) bool {
+	if !query.Since.IsZero() && info.Started.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && !info.Started.Before(query.Until) {
+		return false
+	}
+	if query.User != "" && info.User != query.User {
+		return false
+	}
+	if query.Module != "" && info.Module != query.Module {
+		return false
+	}
+	if query.Host != "" && info.Host != query.Host && remoteHostOf(info.Peer) != query.Host {
+		return false
+	}
+	if query.State != "" && info.State != query.State {
+		return false
+	}
+	return true
+}
+
+// ReadAuditLog returns the entries of the audit log in r that match
+// query, oldest first.  A last line without a newline is a record the
+// daemon didn't finish writing, it's skipped.
+func ReadAuditLog(r io.Reader, query AuditQuery) ([]TransferInfo, error) {
+	entries := []TransferInfo{}
+	reader := bufio.NewReader(r)
+
+	for number := 1; ; number++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		info := TransferInfo{}
+		if err := json.Unmarshal(line, &info); err != nil {
+			return nil, errors.New(fmt.Sprintf("audit log line %v: %v", number, err))
+		}
+
+		if query.Matches(info) {
+			entries = append(entries, info)
+		}
+	}
+
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[len(entries)-query.Limit:]
+	}
+	return entries, nil
+}
+
+// remoteHostOf strips the port from a Peer address
+func remoteHostOf(peer string) string {
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		return peer
+	}
+	return host
+}
@@ -0,0 +1,112 @@
+package transfer
+
+import (
+	"github.com/google/uuid"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "gosync.audit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history")
+
+	audit, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := time.Now().Add(-time.Hour)
+	stats := NewTransferStats()
+	stats.BytesSent = 42
+	entries := []TransferInfo{
+		{RequestID: uuid.New(), Peer: "10.0.0.1:4000", User: "alice", Module: "backups",
+			State: TRANSFER_DONE, Started: started, Stats: stats},
+		{RequestID: uuid.New(), Peer: "10.0.0.2:4000", Host: "builder",
+			State: TRANSFER_REJECTED, Started: started.Add(time.Minute), Error: "host not allowed"},
+		{RequestID: uuid.New(), Peer: "[::1]:4000", User: "bob", Module: "backups",
+			State: TRANSFER_FAILED, Started: started.Add(2 * time.Minute), Error: "EOF"},
+	}
+	for _, entry := range entries {
+		if err := audit.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	audit.Close()
+
+	// reopening appends
+	if audit, err = OpenAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := audit.Record(TransferInfo{RequestID: uuid.New(), State: TRANSFER_DONE, Started: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	audit.Close()
+
+	// a record the daemon died writing
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"RequestID":"`)
+	f.Close()
+
+	for _, c := range []struct {
+		query    AuditQuery
+		expected []int
+	}{
+		{AuditQuery{}, []int{0, 1, 2, 3}},
+		{AuditQuery{Module: "backups"}, []int{0, 2}},
+		{AuditQuery{User: "alice"}, []int{0}},
+		{AuditQuery{Host: "10.0.0.2"}, []int{1}},
+		{AuditQuery{Host: "builder"}, []int{1}},
+		{AuditQuery{Host: "::1"}, []int{2}},
+		{AuditQuery{State: TRANSFER_REJECTED}, []int{1}},
+		{AuditQuery{Since: started.Add(30 * time.Second), Until: started.Add(90 * time.Second)}, []int{1}},
+		{AuditQuery{Module: "backups", Limit: 1}, []int{2}},
+	} {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := ReadAuditLog(f, c.query)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(found) != len(c.expected) {
+			t.Errorf("%+v should find %v entries not %v", c.query, len(c.expected), len(found))
+			continue
+		}
+		for i, index := range c.expected {
+			if index < len(entries) && found[i].RequestID != entries[index].RequestID {
+				t.Errorf("%+v entry %v should be %v not %v", c.query, i, entries[index].RequestID, found[i].RequestID)
+			}
+		}
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	found, err := ReadAuditLog(f, AuditQuery{User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found[0].Stats == nil || found[0].Stats.BytesSent != 42 {
+		t.Errorf("stats should be recorded, not %+v", found[0].Stats)
+	}
+
+	if _, err := ReadAuditLog(strings.NewReader("not json\n"), AuditQuery{}); err == nil {
+		t.Error("a corrupt line should be an error")
+	}
+}
@@ -0,0 +1,189 @@
+package transfer
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+)
+
+// AUTH_NONCE_LEN is the length of the nonce in an AuthChallenge
+const AUTH_NONCE_LEN = 32
+
+// Secrets maps user names to their shared secrets
+type Secrets map[string][]byte
+
+// AuthChallenge is sent by the daemon after it receives a Request, and
+// before the RequestResponse.  An empty Nonce means the daemon doesn't
+// require authentication and the requester doesn't answer it, otherwise
+// the requester answers with an AuthResponse.
+type AuthChallenge struct {
+	Nonce []byte
+}
+
+// AuthResponse proves the requester knows User's secret without sending
+// it, see AuthMAC.  Once it's accepted the daemon proves it knows the
+// secret too, with RequestResponse.MAC.
+type AuthResponse struct {
+	User string
+	MAC  []byte
+}
+
+// LoadSecrets reads a secrets file with one "user:secret" per line.
+// Blank lines and lines starting with # are skipped.  The file must not
+// be readable by other users.
+func LoadSecrets(path string) (Secrets, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0007 != 0 {
+		return nil, errors.New(fmt.Sprintf(
+			"secrets file %v must not be accessible by other users", path))
+	}
+
+	secrets := make(Secrets)
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New(fmt.Sprintf(
+				"%v:%v: expected user:secret", path, line))
+		}
+		secrets[parts[0]] = []byte(parts[1])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+// NewAuthChallenge makes a challenge with a random nonce
+func NewAuthChallenge() (*AuthChallenge, error) {
+	nonce := make([]byte, AUTH_NONCE_LEN)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &AuthChallenge{Nonce: nonce}, nil
+}
+
+// AuthMAC is HMAC-SHA256 keyed with the secret over the nonce and every
+// field of the request, so a response can't be replayed for another
+// request and the request can't be changed on its way to the daemon.
+// Without TLS that's what keeps the Path, Module and PublicKey the
+// requester sent.
+func AuthMAC(secret []byte, nonce []byte, req *Request) []byte {
+	mac := authWriter{hmac.New(sha256.New, secret)}
+	mac.string("gosync request")
+	mac.bytes(nonce)
+
+	mac.bytes(req.RequestID[:])
+	mac.string(req.RequesterHost)
+	mac.int(int64(req.RequesterUDPPort))
+	mac.string(req.Host)
+	mac.int(int64(req.Port))
+	mac.int(int64(req.Direction))
+	mac.string(req.Path)
+	mac.string(req.Destination)
+	mac.string(req.Module)
+	mac.bool(req.FollowLinks)
+	mac.int(int64(req.BlockSize))
+	mac.bool(req.ContinueOnError)
+	mac.int(int64(req.FECGroupSize))
+	mac.int(int64(req.PacketSize))
+	mac.bool(req.ProbePacketSize)
+	mac.int(int64(req.Transport))
+	mac.bytes(req.PublicKey)
+	return mac.Sum(nil)
+}
+
+// ResponseMAC is HMAC-SHA256 keyed with the secret over the MAC of the
+// accepted request and every field of the daemon's response, including
+// its PublicKey, see RequestResponse.MAC
+func ResponseMAC(secret []byte, requestMAC []byte, resp *RequestResponse) []byte {
+	mac := authWriter{hmac.New(sha256.New, secret)}
+	mac.string("gosync response")
+	mac.bytes(requestMAC)
+
+	mac.bool(resp.Accepted)
+	mac.string(resp.Reason)
+	mac.bytes(resp.RequestID[:])
+	mac.int(int64(resp.UDPPort))
+	mac.int(int64(resp.FECGroupSize))
+	mac.int(int64(resp.PacketSize))
+	mac.bool(resp.ProbePacketSize)
+	mac.int(int64(resp.Transport))
+	mac.bytes(resp.PublicKey)
+	mac.bool(resp.Queued)
+	mac.int(int64(resp.QueuePosition))
+	mac.int(int64(resp.RetryAfter))
+	return mac.Sum(nil)
+}
+
+// CheckResponse returns whether resp came from a daemon that knows the
+// secret the request was authenticated with
+func CheckResponse(secret []byte, requestMAC []byte, resp *RequestResponse) bool {
+	return hmac.Equal(ResponseMAC(secret, requestMAC, resp), resp.MAC)
+}
+
+// authWriter writes the fields of a message into a MAC so no two
+// messages write the same bytes, strings and bytes are length prefixed
+type authWriter struct {
+	hash.Hash
+}
+
+func (mac authWriter) bytes(b []byte) {
+	mac.int(int64(len(b)))
+	mac.Write(b)
+}
+
+func (mac authWriter) string(s string) {
+	mac.bytes([]byte(s))
+}
+
+func (mac authWriter) int(i int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(i))
+	mac.Write(b[:])
+}
+
+func (mac authWriter) bool(b bool) {
+	if b {
+		mac.Write([]byte{1})
+	} else {
+		mac.Write([]byte{0})
+	}
+}
+
+// Check returns whether the response proves the user knows their secret
+// and that req is what they sent
+func (secrets Secrets) Check(challenge *AuthChallenge, response *AuthResponse, req *Request) bool {
+	secret, ok := secrets[response.User]
+	if !ok {
+		// still do the work so unknown users take as long as known ones
+		secret = []byte{}
+	}
+
+	expected := AuthMAC(secret, challenge.Nonce, req)
+	return hmac.Equal(expected, response.MAC) && ok
+}
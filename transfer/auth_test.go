@@ -0,0 +1,141 @@
+package transfer
+
+import (
+	"github.com/google/uuid"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func writeSecrets(t *testing.T, content string, mode os.FileMode) string {
+	dir, err := ioutil.TempDir("/tmp", "gosync.secrets.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	file := path.Join(dir, "gosyncd.secrets")
+	if err := ioutil.WriteFile(file, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(file, mode); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadSecrets(t *testing.T) {
+	file := writeSecrets(t, "# backups\nalice:s3cret\n\nbob:pass:word\n", 0600)
+
+	secrets, err := LoadSecrets(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secrets["alice"]) != "s3cret" || string(secrets["bob"]) != "pass:word" {
+		t.Errorf("secrets weren't parsed correctly: %v", secrets)
+	}
+
+	if _, err := LoadSecrets(writeSecrets(t, "alice:s3cret\n", 0644)); err == nil {
+		t.Error("a world readable secrets file should be refused")
+	}
+
+	if _, err := LoadSecrets(writeSecrets(t, "alice\n", 0600)); err == nil {
+		t.Error("a line without a secret should be refused")
+	}
+}
+
+func TestAuthCheck(t *testing.T) {
+	secrets := Secrets{"alice": []byte("s3cret")}
+	req := &Request{RequestID: uuid.New(), Path: "/src", Destination: "data", Module: "backups"}
+
+	challenge, err := NewAuthChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good := &AuthResponse{User: "alice", MAC: AuthMAC([]byte("s3cret"), challenge.Nonce, req)}
+	if !secrets.Check(challenge, good, req) {
+		t.Error("the right secret should authenticate")
+	}
+
+	other, _ := NewAuthChallenge()
+	if secrets.Check(other, good, req) {
+		t.Error("a response to another challenge shouldn't authenticate")
+	}
+
+	wrong := &AuthResponse{User: "alice", MAC: AuthMAC([]byte("guess"), challenge.Nonce, req)}
+	if secrets.Check(challenge, wrong, req) {
+		t.Error("the wrong secret shouldn't authenticate")
+	}
+
+	unknown := &AuthResponse{User: "mallory", MAC: AuthMAC([]byte{}, challenge.Nonce, req)}
+	if secrets.Check(challenge, unknown, req) {
+		t.Error("an unknown user shouldn't authenticate")
+	}
+}
+
+func TestAuthCheckTamperedRequest(t *testing.T) {
+	secrets := Secrets{"alice": []byte("s3cret")}
+	challenge, err := NewAuthChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := Request{
+		RequestID:   uuid.New(),
+		Direction:   Outgoing,
+		Path:        "/src",
+		Destination: "data",
+		Module:      "backups",
+		BlockSize:   1024,
+		PublicKey:   []byte("requester's key"),
+	}
+	response := &AuthResponse{User: "alice", MAC: AuthMAC([]byte("s3cret"), challenge.Nonce, &sent)}
+
+	// whatever's changed on the way the MAC no longer matches
+	for name, tamper := range map[string]func(req *Request){
+		"RequestID":   func(req *Request) { req.RequestID = uuid.New() },
+		"Direction":   func(req *Request) { req.Direction = Incoming },
+		"Path":        func(req *Request) { req.Path = "/etc" },
+		"Destination": func(req *Request) { req.Destination = "other" },
+		"Module":      func(req *Request) { req.Module = "private" },
+		"BlockSize":   func(req *Request) { req.BlockSize = 1 },
+		"PublicKey":   func(req *Request) { req.PublicKey = []byte("attacker's key") },
+		// the fields are length prefixed, moving bytes between them
+		// changes the MAC too
+		"shifted": func(req *Request) { req.Path, req.Destination = "/srcd", "ata" },
+	} {
+		req := sent
+		tamper(&req)
+		if secrets.Check(challenge, response, &req) {
+			t.Errorf("a request with a changed %v shouldn't authenticate", name)
+		}
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	secret := []byte("s3cret")
+	requestMAC := AuthMAC(secret, []byte("nonce"), &Request{RequestID: uuid.New()})
+
+	resp := &RequestResponse{Accepted: true, UDPPort: 4300, PublicKey: []byte("daemon's key")}
+	resp.MAC = ResponseMAC(secret, requestMAC, resp)
+	if !CheckResponse(secret, requestMAC, resp) {
+		t.Error("the daemon's response should check out")
+	}
+
+	swapped := *resp
+	swapped.PublicKey = []byte("attacker's key")
+	if CheckResponse(secret, requestMAC, &swapped) {
+		t.Error("a response with a swapped PublicKey shouldn't check out")
+	}
+
+	otherRequest := AuthMAC(secret, []byte("nonce"), &Request{RequestID: uuid.New()})
+	if CheckResponse(secret, otherRequest, resp) {
+		t.Error("a response to another request shouldn't check out")
+	}
+
+	if CheckResponse([]byte("guess"), requestMAC, resp) {
+		t.Error("a response MACed with another secret shouldn't check out")
+	}
+}
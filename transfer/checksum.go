@@ -1,10 +1,18 @@
 package transfer
 
 import (
+	"encoding/gob"
 	"golang.org/x/crypto/blake2b"
 	"hash"
 )
 
+// signatures carry their hash.Hash, which gob can only decode once the
+// concrete type is registered, on both sides and in every process
+func init() {
+	h, _ := blake2b.New256(make([]byte, 0))
+	gob.Register(h)
+}
+
 func Signature(data []byte) (hash.Hash, error) {
 	var key []byte
 	key = nil
@@ -1,60 +1,638 @@
 package transfer
 
 import (
+	"crypto/tls"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"log/slog"
 	"net"
+	"sort"
+	"sync"
+	"time"
 )
 
-func Daemon(addr string) {
-	// TODO: add tls support
-	// config := &tls.Config{
-	// 	InsecureSkipVerify: true,
-	// }
-	// ln, err := tls.Listen("tcp", addr, config)
-	ln, err := net.Listen("tcp", addr)
+// DaemonConfig holds the settings the daemon applies to every transfer
+type DaemonConfig struct {
+	Addr string
 
-	if err != nil {
-		fmt.Println(err)
+	// TLSConfig enables TLS on the TCP connection when set
+	TLSConfig *tls.Config
+
+	WindowPackets int
+	WindowBytes   int
+
+	// SignatureWorkers, DeltaWorkers and PatchWorkers size the
+	// daemon's side of each transfer's pipeline, see Options
+	SignatureWorkers int
+	DeltaWorkers     int
+	PatchWorkers     int
+	MaxOpenFiles     int
+
+	// MinFECGroupSize caps the forward error correction overhead a
+	// client can ask for, smaller groups are raised to it
+	MinFECGroupSize int
+
+	// UDPPorts is the range of ports transfers bind, the zero value
+	// means any ephemeral port
+	UDPPorts PortRange
+
+	// MaxPacketSize caps the packet content length a client can ask
+	// for, 0 allows anything up to MAX_PACKET_SIZE
+	MaxPacketSize int
+
+	// Secrets are the users allowed to make requests, nil lets
+	// anyone make requests
+	Secrets Secrets
+
+	// Modules are the directories requests can name, without modules
+	// requests can name any absolute path
+	Modules map[string]*Module
+
+	// HostAccess filters the addresses requests may come from, each
+	// module can filter them further
+	HostAccess HostAccess
+
+	// WorkerCommand starts a worker process for modules that chroot or
+	// run as another user, see RunWorker
+	WorkerCommand []string
+
+	// Limiter caps the transfers running at once, nil for no limit
+	Limiter *Limiter
+
+	// HandshakeTimeout is how long a connection has to send its request
+	// and authenticate, 0 for DEFAULT_HANDSHAKE_TIMEOUT.  MaxHandshakes
+	// caps the connections doing that at once, 0 for
+	// DEFAULT_MAX_HANDSHAKES, the Limiter only counts the requests that
+	// got through.
+	HandshakeTimeout time.Duration
+	MaxHandshakes    int
+
+	// HistorySize is how many finished transfers are remembered for
+	// the API, 0 for DEFAULT_HISTORY_SIZE
+	HistorySize int
+
+	// AuditLog records every request answered, nil for no record
+	AuditLog *AuditLog
+
+	// Logger gets the daemon's and its transfers' log records, nil
+	// uses slog.Default.  Workers can't share it, they log at LogLevel
+	// in LogFormat to LogOutput, which default to info, text and stderr.
+	Logger    *slog.Logger
+	LogLevel  slog.Leveler
+	LogFormat string
+	LogOutput io.Writer
+}
+
+// DEFAULT_HANDSHAKE_TIMEOUT and DEFAULT_MAX_HANDSHAKES are the
+// DaemonConfig defaults for connections that haven't been admitted yet
+const DEFAULT_HANDSHAKE_TIMEOUT = 30 * time.Second
+const DEFAULT_MAX_HANDSHAKES = 256
+
+func (config *DaemonConfig) handshakeTimeout() time.Duration {
+	if config.HandshakeTimeout > 0 {
+		return config.HandshakeTimeout
+	}
+	return DEFAULT_HANDSHAKE_TIMEOUT
+}
+
+func (config *DaemonConfig) maxHandshakes() int {
+	if config.MaxHandshakes > 0 {
+		return config.MaxHandshakes
+	}
+	return DEFAULT_MAX_HANDSHAKES
+}
+
+func (config *DaemonConfig) logger() *slog.Logger {
+	if config.Logger == nil {
+		return slog.Default()
+	}
+	return config.Logger
+}
+
+// audit records info in the AuditLog, if there is one
+func (config *DaemonConfig) audit(info TransferInfo) {
+	if config.AuditLog == nil {
 		return
 	}
-	listen(ln)
+	if err := config.AuditLog.Record(info); err != nil {
+		config.logger().Error("error writing audit log", "request_id", info.RequestID, "error", err)
+	}
 }
 
+// ErrServerClosed is returned by Serve after Shutdown
+var ErrServerClosed = errors.New("server closed")
+
+// Server runs the daemon.  Reload swaps its config without touching
+// running transfers, and Shutdown stops it without cutting them off.
+type Server struct {
+	mutex    sync.Mutex
+	config   *DaemonConfig
+	listener net.Listener
+	closing  bool
+
+	// transfers are the accepted transfers that haven't finished, and
+	// drain waits for them
+	transfers map[uuid.UUID]*activeTransfer
+	drain     sync.WaitGroup
+	history   *transferHistory
+
+	// handshakes counts the connections that haven't been admitted yet
+	handshakes int
+
+	metrics *Metrics
+}
+
+func NewServer(config *DaemonConfig) *Server {
+	return &Server{
+		config:    config,
+		transfers: make(map[uuid.UUID]*activeTransfer),
+		history:   newTransferHistory(config.HistorySize),
+		metrics:   NewMetrics(),
+	}
+}
+
+func Daemon(config *DaemonConfig) {
+	if err := NewServer(config).ListenAndServe(); err != nil && err != ErrServerClosed {
+		config.logger().Error("daemon stopped", "error", err)
+	}
+}
+
+// ListenAndServe listens on the config's Addr and calls Serve
+func (server *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", server.Config().Addr)
+	if err != nil {
+		return err
+	}
+	return server.Serve(ln)
+}
+
+// Serve handles connections from listener until Shutdown.  TLS is set up
+// on each connection with the config at the time, so a Reload can change
+// certificates.
+func (server *Server) Serve(listener net.Listener) error {
+	server.mutex.Lock()
+	if server.closing {
+		server.mutex.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	server.listener = listener
+	server.mutex.Unlock()
 
-func listen(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Println("Error while listening:", err)
+			if server.isClosing() {
+				return ErrServerClosed
+			}
+			server.Config().logger().Error("error accepting connection", "error", err)
 			continue
 		}
-		go handleConn(conn)
+
+		config := server.Config()
+		if !server.startHandshake(config) {
+			config.logger().Warn("rejected connection", "peer", conn.RemoteAddr().String(),
+				"reason", "too many connections handshaking")
+			server.metrics.RecordRejection("", REJECTED_HANDSHAKES)
+			conn.Close()
+			continue
+		}
+
+		// the connection has HandshakeTimeout to get admitted, TLS
+		// handshake included
+		conn.SetDeadline(time.Now().Add(config.handshakeTimeout()))
+		if config.TLSConfig != nil {
+			conn = tls.Server(conn, config.TLSConfig)
+		}
+		go server.handleConn(conn, config)
+	}
+}
+
+// startHandshake counts a new connection against MaxHandshakes,
+// returning false if there's no room for it
+func (server *Server) startHandshake(config *DaemonConfig) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.handshakes >= config.maxHandshakes() {
+		return false
+	}
+	server.handshakes++
+	return true
+}
+
+func (server *Server) finishHandshake() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.handshakes--
+}
+
+// Config returns the config new connections are handled with
+func (server *Server) Config() *DaemonConfig {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.config
+}
+
+// Reload makes new connections use config, running transfers keep the
+// config they started with.  The listening address can't change.  The
+// old Limiter is kept with the new limits, so it still counts the
+// running transfers.
+func (server *Server) Reload(config *DaemonConfig) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if config.Limiter != nil && server.config.Limiter != nil {
+		server.config.Limiter.SetLimits(config.Limiter.Limits())
+		config.Limiter = server.config.Limiter
+	}
+	server.config = config
+	server.history.resize(config.HistorySize)
+}
+
+// Running returns the number of transfers that haven't finished
+func (server *Server) Running() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return len(server.transfers)
+}
+
+// Transfers returns the running transfers, oldest first
+func (server *Server) Transfers() []TransferInfo {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	infos := make([]TransferInfo, 0, len(server.transfers))
+	for _, active := range server.transfers {
+		infos = append(infos, active.snapshot())
 	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Started.Before(infos[j].Started)
+	})
+	return infos
+}
+
+// History returns the recently finished transfers, newest first
+func (server *Server) History() []TransferInfo {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.history.list()
+}
+
+// Transfer returns the running or recently finished transfer for
+// requestID
+func (server *Server) Transfer(requestID uuid.UUID) (TransferInfo, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if active, ok := server.transfers[requestID]; ok {
+		return active.snapshot(), true
+	}
+	return server.history.find(requestID)
+}
+
+// Cancel aborts the running transfer for requestID, its peer is told it
+// Failed.  It returns false if there's no such transfer.
+func (server *Server) Cancel(requestID uuid.UUID) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	active, ok := server.transfers[requestID]
+	if ok {
+		server.config.logger().Info("cancelling transfer", "request_id", requestID)
+		active.cancel()
+	}
+	return ok
+}
+
+// Shutdown stops accepting connections and waits up to timeout for the
+// running transfers to finish.  Transfers still running after that are
+// aborted, which tells their peers they Failed, and Shutdown returns an
+// error saying how many there were.
+func (server *Server) Shutdown(timeout time.Duration) error {
+	server.mutex.Lock()
+	server.closing = true
+	listener := server.listener
+	server.mutex.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+
+	drained := make(chan bool)
+	go func() {
+		server.drain.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	server.mutex.Lock()
+	running := len(server.transfers)
+	for _, active := range server.transfers {
+		active.cancelFunc()
+	}
+	server.mutex.Unlock()
+	server.Config().logger().Warn("aborting transfers still running", "transfers", running, "timeout", timeout)
+
+	// aborted transfers get a moment to tell their peers, plus a
+	// little for the workers to report back
+	select {
+	case <-drained:
+	case <-time.After(ABORT_TIMEOUT + time.Second):
+	}
+
+	return errors.New(fmt.Sprintf("aborted %v transfers after %v", running, timeout))
+}
+
+func (server *Server) isClosing() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.closing
+}
+
+// startTransfer records a transfer that's about to start, unless we're
+// shutting down or its RequestID is already running.  Otherwise it
+// returns the REJECTED_ constant of why not.
+func (server *Server) startTransfer(info TransferInfo) (*activeTransfer, string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.closing {
+		return nil, REJECTED_SHUTDOWN
+	}
+
+	// the client picks the RequestID, a second transfer with it would
+	// take the running one's place
+	if _, ok := server.transfers[info.RequestID]; ok {
+		return nil, REJECTED_DUPLICATE
+	}
+
+	active := newActiveTransfer(info)
+	server.transfers[info.RequestID] = active
+	server.drain.Add(1)
+	return active, ""
+}
+
+// finishTransfer moves a transfer to the history, see activeTransfer.finish
+func (server *Server) finishTransfer(active *activeTransfer, stats *TransferStats, err error) {
+	server.mutex.Lock()
+	info := active.finish(stats, err)
+	delete(server.transfers, info.RequestID)
+	server.history.add(info)
+	server.mutex.Unlock()
+
+	server.metrics.RecordTransfer(info)
+	server.Config().audit(info)
+
+	server.drain.Done()
+}
+
+// rejectRequest records a request turned away for reason, rejection is
+// one of the REJECTED_ constants
+func (server *Server) rejectRequest(config *DaemonConfig, info TransferInfo, module *Module, rejection string, reason string) {
+	server.metrics.RecordRejection(module.name(), rejection)
+
+	info.State = TRANSFER_REJECTED
+	info.Error = reason
+	config.audit(info)
 }
 
-func handleConn(conn net.Conn) {
-	fmt.Println(conn)
+func (server *Server) handleConn(conn net.Conn, config *DaemonConfig) {
+	// the Sync functions close conn too, this is for every way out
+	// before them
+	defer conn.Close()
+
+	// admitted ends the handshake, once the request got through
+	handshaking := true
+	admitted := func() {
+		if handshaking {
+			handshaking = false
+			conn.SetDeadline(time.Time{})
+			server.finishHandshake()
+		}
+	}
+	defer admitted()
+
+	log := config.logger().With("peer", conn.RemoteAddr().String())
+	log.Debug("connection accepted")
 
 	decoder := gob.NewDecoder(conn)
+	encoder := gob.NewEncoder(conn)
 	req := &Request{}
 
 	if err := decoder.Decode(req); err != nil {
-		fmt.Println("Error decoding transfer request:", err)
+		log.Warn("error decoding transfer request", "error", err)
 		return
 	}
+	log = log.With("request_id", req.RequestID)
+
+	// info describes the request for the audit log and the API, it's
+	// filled in as we go
+	info := TransferInfo{
+		RequestID:   req.RequestID,
+		Direction:   req.Direction.String(),
+		Peer:        conn.RemoteAddr().String(),
+		Host:        req.RequesterHost,
+		Module:      req.Module,
+		Source:      req.Path,
+		Destination: req.Destination,
+		Started:     time.Now(),
+	}
 
-	// TODO: validate request before accepting
 	resp := &RequestResponse{
 		RequestID: req.RequestID,
 		Accepted:  true,
-		UDPPort: 30001,  // TODO: identify available port
+
+		FECGroupSize: req.FECGroupSize,
 	}
+	// rejection says why resp isn't Accepted, for the metrics and audit log
+	var rejection string
 
-	encoder := gob.NewEncoder(conn)
+	// turn away hosts we don't serve before asking them to authenticate
+	ip := remoteIP(conn)
+	if !config.HostAccess.Allows(ip) {
+		log.Warn("rejected transfer request", "reason", "host not allowed")
+		resp.Accepted = false
+		resp.Reason = "host not allowed"
+		server.rejectRequest(config, info, nil, REJECTED_HOST, resp.Reason)
+
+		if err := encoder.Encode(&AuthChallenge{}); err == nil {
+			encoder.Encode(resp)
+		}
+		conn.Close()
+		return
+	}
+
+	user, requestMAC, err := authenticate(decoder, encoder, req, config)
+	if err != nil {
+		log.Warn("error authenticating transfer request", "error", err)
+		conn.Close()
+		return
+	}
+	if user != "" {
+		info.User = user
+		log = log.With("user", user)
+		log.Debug("authenticated")
+	}
+	if config.Secrets != nil && user == "" {
+		log.Warn("rejected transfer request", "reason", "authentication failed")
+		rejection = REJECTED_AUTHENTICATION
+		resp.Accepted = false
+		resp.Reason = "authentication failed"
+	}
+
+	// work out which local path the request names, the requester's path
+	// is only meaningful to the requester
+	var module *Module
+	var localPath string
+	if resp.Accepted {
+		module, localPath, err = resolveRequest(req, user, ip, config.Modules)
+		if err != nil {
+			log.Warn("rejected transfer request", "reason", err)
+			rejection = REJECTED_ACCESS
+			resp.Accepted = false
+			resp.Reason = err.Error()
+		}
+	}
+
+	// turn away requests the transfer would fail on before setting
+	// anything up for them
+	if resp.Accepted {
+		if err := verifyRequest(req, localPath); err != nil {
+			log.Warn("rejected transfer request", "reason", err)
+			rejection = REJECTED_INVALID
+			resp.Accepted = false
+			resp.Reason = err.Error()
+		}
+	}
+
+	// wait for a slot, telling the requester where they are in the queue
+	// the request's authenticated and valid, the Limiter counts it from
+	// here and it can take its time in the queue
+	admitted()
+
+	if resp.Accepted && config.Limiter != nil {
+		gone, stopWatching := watchConn(conn)
+		release, err := config.Limiter.Acquire(ip.String(), module, func(position int) error {
+			return encoder.Encode(&RequestResponse{
+				RequestID:     req.RequestID,
+				Queued:        true,
+				QueuePosition: position,
+			})
+		}, gone)
+		stopWatching()
+
+		if limitErr, ok := err.(*LimitError); ok {
+			log.Info("rejected transfer request", "reason", limitErr)
+			rejection = REJECTED_LIMIT
+			resp.Accepted = false
+			resp.Reason = limitErr.Reason
+			resp.RetryAfter = limitErr.RetryAfter
+		} else if err != nil {
+			log.Info("transfer request left the queue", "error", err)
+			info.State = TRANSFER_FAILED
+			info.Error = fmt.Sprintf("left the queue: %v", err)
+			config.audit(info)
+			conn.Close()
+			return
+		} else {
+			defer release()
+		}
+	}
+
+	// bind our udp socket on the address the client reached us at, and
+	// send to the address the client connected from rather than its
+	// hostname, which may not resolve or may be behind a NAT
+	localHost, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	remoteHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	var udpConn net.PacketConn
+	if resp.Accepted && req.Transport != TCPTransport {
+		udpConn, err = ListenUDP(localHost, config.UDPPorts)
+		if err != nil {
+			log.Error("error binding udp port", "error", err)
+			rejection = REJECTED_SETUP
+			resp.Accepted = false
+			resp.Reason = "no udp port available"
+		} else {
+			resp.UDPPort = UDPPort(udpConn)
+		}
+	}
+
+	// udp packets are sealed with keys from the requester's key and ours,
+	// tcp transfers send packets on the connection itself
+	var sourceKey, destinationKey []byte
+	if resp.Accepted && req.Transport != TCPTransport {
+		if len(req.PublicKey) == 0 {
+			rejection = REJECTED_SETUP
+			resp.Accepted = false
+			resp.Reason = "udp packets must be encrypted, no public key sent"
+		} else if key, err := NewSessionKey(); err != nil {
+			log.Error("error making session key", "error", err)
+			rejection = REJECTED_SETUP
+			resp.Accepted = false
+			resp.Reason = "couldn't make session key"
+		} else if sourceKey, destinationKey, err = DeriveSessionKeys(key, req.PublicKey, req.RequestID); err != nil {
+			rejection = REJECTED_SETUP
+			resp.Accepted = false
+			resp.Reason = fmt.Sprintf("invalid public key: %v", err)
+		} else {
+			resp.PublicKey = key.PublicKey().Bytes()
+		}
+	}
+
+	// Shutdown waits for the transfers that start from here on, and the
+	// API can watch them
+	var active *activeTransfer
+	if resp.Accepted {
+		info.Path = localPath
+		active, rejection = server.startTransfer(info)
+		if rejection == REJECTED_SHUTDOWN {
+			resp.Accepted = false
+			resp.Reason = "daemon shutting down"
+			resp.RetryAfter = DEFAULT_RETRY_AFTER
+		} else if rejection == REJECTED_DUPLICATE {
+			resp.Accepted = false
+			resp.Reason = fmt.Sprintf("request %v is already running", req.RequestID)
+		}
+	}
+
+	if resp.FECGroupSize > 0 && resp.FECGroupSize < config.MinFECGroupSize {
+		resp.FECGroupSize = config.MinFECGroupSize
+	}
+
+	resp.Transport = req.Transport
+	resp.PacketSize = req.PacketSize
+	resp.ProbePacketSize = req.ProbePacketSize
+	if config.MaxPacketSize > 0 && resp.PacketSize > config.MaxPacketSize {
+		resp.PacketSize = config.MaxPacketSize
+	}
+
+	// the requester checks an authenticated response came from us, and
+	// that nobody swapped our PublicKey
+	if user != "" {
+		resp.MAC = ResponseMAC(config.Secrets[user], requestMAC, resp)
+	}
 
 	if err := encoder.Encode(resp); err != nil {
-		fmt.Println("Error encoding transfer request response:", err)
+		log.Warn("error encoding transfer request response", "error", err)
+	}
+
+	if !resp.Accepted {
+		if udpConn != nil {
+			udpConn.Close()
+		}
+		conn.Close()
+		server.rejectRequest(config, info, module, rejection, resp.Reason)
+		return
 	}
 
 	opts := &Options{
@@ -63,23 +641,153 @@ func handleConn(conn net.Conn) {
 
 		FollowLinks: req.FollowLinks,
 		BlockSize: req.BlockSize,
+		ContinueOnError: req.ContinueOnError,
+
+		WindowPackets: config.WindowPackets,
+		WindowBytes: config.WindowBytes,
+
+		SignatureWorkers: config.SignatureWorkers,
+		DeltaWorkers: config.DeltaWorkers,
+		PatchWorkers: config.PatchWorkers,
+		MaxOpenFiles: config.MaxOpenFiles,
+
+		FECGroupSize: resp.FECGroupSize,
+
+		PacketSize: resp.PacketSize,
+		ProbePacketSize: resp.ProbePacketSize,
+
+		Transport: resp.Transport,
+		UDPConn: udpConn,
+
+		SourceKey: sourceKey,
+		DestinationKey: destinationKey,
+
+		Stats: active.stats,
+
+		RequestID: req.RequestID,
+		LogHandler: config.logger().Handler(),
 	}
 
 	if req.Direction == Incoming {
-		opts.SourceHost = req.Host
+		opts.Path = localPath
+
+		opts.SourceHost = localHost
 		opts.SourceUDPPort = resp.UDPPort
 
-		opts.DestinationHost = req.RequesterHost
+		opts.DestinationHost = remoteHost
 		opts.DestinationUDPPort = req.RequesterUDPPort
-
-		SyncOutgoing(conn, opts)
 	} else {
-		opts.SourceHost = req.RequesterHost
+		opts.Destination = localPath
+
+		opts.SourceHost = remoteHost
 		opts.SourceUDPPort = req.RequesterUDPPort
 
-		opts.DestinationHost = req.Host
+		opts.DestinationHost = localHost
 		opts.DestinationUDPPort = resp.UDPPort
+	}
 
-		SyncIncoming(conn, opts)
+	// our side's files stay inside the module, symlinks and all
+	if module != nil {
+		opts.Root = module.Path
 	}
+
+	log.Info("transfer started",
+		"direction", req.Direction.String(), "module", module.name(), "path", localPath, "transport", opts.Transport.String())
+
+	// transfers in a worker record their stats there, the others record
+	// them in active.stats as they go
+	var stats *TransferStats
+	if module.needsWorker() {
+		var job *WorkerJob
+		job, err = newWorkerJob(module, req.Direction, opts)
+		if err == nil {
+			stats, err = runInWorker(active.ctx, conn, job, udpConn, config)
+		}
+		if err != nil && udpConn != nil {
+			udpConn.Close()
+		}
+		conn.Close()
+	} else if req.Direction == Incoming {
+		_, err = SyncOutgoing(active.ctx, conn, opts)
+	} else {
+		_, err = SyncIncoming(active.ctx, conn, opts)
+	}
+
+	if partial, ok := err.(*PartialTransferError); ok {
+		log.Warn("transfer done, some files skipped", "files", len(partial.FileErrors),
+			"duration", time.Since(active.info.Started))
+	} else if err != nil {
+		log.Error("transfer failed", "error", err)
+	} else {
+		log.Info("transfer done", "duration", time.Since(active.info.Started))
+	}
+	server.finishTransfer(active, stats, err)
+}
+
+// watchConn returns a channel that's closed if the requester hangs up,
+// and a func that stops watching.  The requester sends nothing while it
+// waits for our response, anything read means it's gone.
+func watchConn(conn net.Conn) (<-chan struct{}, func()) {
+	gone := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		_, err := conn.Read(make([]byte, 1))
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			close(gone)
+		}
+	}()
+
+	return gone, func() {
+		conn.SetReadDeadline(time.Now())
+		<-stopped
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// verifyRequest runs Options.Verify on what the options for req will be,
+// with localPath as our side's path
+func verifyRequest(req *Request, localPath string) error {
+	opts := Options{
+		Path:         req.Path,
+		Destination:  req.Destination,
+		BlockSize:    req.BlockSize,
+		FECGroupSize: req.FECGroupSize,
+		PacketSize:   req.PacketSize,
+		Transport:    req.Transport,
+	}
+	if req.Direction == Incoming {
+		opts.Path = localPath
+	} else {
+		opts.Destination = localPath
+	}
+	return opts.Verify()
+}
+
+// authenticate sends the AuthChallenge and checks the AuthResponse.  It
+// returns the authenticated user and the MAC they sent, to answer with,
+// or "" if authentication failed or isn't required.
+func authenticate(decoder *gob.Decoder, encoder *gob.Encoder, req *Request, config *DaemonConfig) (string, []byte, error) {
+	if config.Secrets == nil {
+		return "", nil, encoder.Encode(&AuthChallenge{})
+	}
+
+	challenge, err := NewAuthChallenge()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := encoder.Encode(challenge); err != nil {
+		return "", nil, err
+	}
+
+	response := &AuthResponse{}
+	if err := decoder.Decode(response); err != nil {
+		return "", nil, err
+	}
+
+	if !config.Secrets.Check(challenge, response, req) {
+		return "", nil, nil
+	}
+
+	return response.User, response.MAC, nil
 }
@@ -0,0 +1,463 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"github.com/google/uuid"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerShutdown(t *testing.T) {
+	server := NewServer(&DaemonConfig{})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error)
+	go func() {
+		served <- server.Serve(ln)
+	}()
+
+	active, rejection := server.startTransfer(TransferInfo{RequestID: uuid.New()})
+	if rejection != "" {
+		t.Fatalf("transfers should start before Shutdown, not be rejected for %v", rejection)
+	}
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- server.Shutdown(time.Second)
+	}()
+
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Errorf("Serve should return ErrServerClosed not %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve didn't stop")
+	}
+
+	if _, rejection := server.startTransfer(TransferInfo{RequestID: uuid.New()}); rejection != REJECTED_SHUTDOWN {
+		t.Errorf("transfers shouldn't start during Shutdown, not rejected for %q", rejection)
+	}
+
+	// Shutdown waits for the running transfer
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown didn't wait for the running transfer")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	server.finishTransfer(active, nil, nil)
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown didn't return after the transfer finished")
+	}
+}
+
+func TestServerRejectsDuplicateRequestID(t *testing.T) {
+	server := NewServer(&DaemonConfig{})
+
+	requestID := uuid.New()
+	first, rejection := server.startTransfer(TransferInfo{RequestID: requestID})
+	if rejection != "" {
+		t.Fatalf("the first transfer should start, not be rejected for %v", rejection)
+	}
+
+	if _, rejection := server.startTransfer(TransferInfo{RequestID: requestID}); rejection != REJECTED_DUPLICATE {
+		t.Fatalf("a running RequestID should be rejected as a duplicate, not %q", rejection)
+	}
+	if running := server.Running(); running != 1 {
+		t.Errorf("only the first transfer should be running, not %v", running)
+	}
+	if !server.Cancel(requestID) || first.ctx.Err() == nil {
+		t.Error("Cancel should still reach the first transfer")
+	}
+
+	// once it's finished the RequestID can be used again
+	server.finishTransfer(first, nil, nil)
+	second, rejection := server.startTransfer(TransferInfo{RequestID: requestID})
+	if rejection != "" {
+		t.Fatalf("a finished RequestID should start again, not be rejected for %v", rejection)
+	}
+	server.finishTransfer(second, nil, nil)
+}
+
+func TestSyncAbort(t *testing.T) {
+	source, err := ioutil.TempDir("/tmp", "gosync.source.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(source)
+
+	destination, err := ioutil.TempDir("/tmp", "gosync.dest.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+
+	makeFiles(testcasebasic.SourceFiles, source)
+
+	opts := Options{
+		Path:        source,
+		Destination: destination,
+		BlockSize:   testcasebasic.BlockSize,
+		Transport:   TCPTransport,
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the source is aborted before it starts, the destination should
+	// hear about it
+	sourceOpts := opts
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	sourceErr := make(chan error)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			sourceErr <- err
+			return
+		}
+		_, err = SyncOutgoing(ctx, conn, &sourceOpts)
+		sourceErr <- err
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destOpts := opts
+	_, err = SyncIncoming(context.Background(), conn, &destOpts)
+	if err == nil || !strings.Contains(err.Error(), errTransferAborted.Error()) {
+		t.Errorf("destination should fail with %v not %v", errTransferAborted, err)
+	}
+
+	if err := <-sourceErr; !errors.Is(err, errTransferAborted) || !errors.Is(err, context.Canceled) {
+		t.Errorf("source should fail with %v not %v", errTransferAborted, err)
+	}
+}
+
+// serveTest runs server on a local port until the test is done and
+// returns its address
+func serveTest(t *testing.T, server *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Shutdown(time.Second) })
+	return ln.Addr().String()
+}
+
+// readerConn reads conn through reader, so the transfer gets what the
+// response decoder buffered
+type readerConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn readerConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+func (conn readerConn) ReadByte() (byte, error) {
+	return conn.reader.ReadByte()
+}
+
+// requestTest sends req to the daemon at addr and returns its response,
+// with the connection the transfer would go on
+func requestTest(t *testing.T, addr string, req *Request) (*RequestResponse, net.Conn) {
+	tcpConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpConn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn := readerConn{Conn: tcpConn, reader: bufio.NewReader(tcpConn)}
+
+	decoder := gob.NewDecoder(conn)
+	if err := gob.NewEncoder(conn).Encode(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoder.Decode(&AuthChallenge{}); err != nil {
+		t.Fatal(err)
+	}
+	resp := &RequestResponse{}
+	if err := decoder.Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp, conn
+}
+
+func TestServerRejectsInvalidRequest(t *testing.T) {
+	addr := serveTest(t, NewServer(&DaemonConfig{}))
+
+	resp, conn := requestTest(t, addr, &Request{
+		RequestID:   uuid.New(),
+		Direction:   Outgoing,
+		Path:        "/source",
+		Destination: "/destination",
+		BlockSize:   0,
+		Transport:   TCPTransport,
+	})
+	defer conn.Close()
+
+	if resp.Accepted || !strings.Contains(resp.Reason, "BlockSize") {
+		t.Errorf("a request without a BlockSize should be rejected, not %+v", resp)
+	}
+	// and the daemon hangs up rather than leaving us waiting
+	if _, err := conn.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Errorf("the daemon should have closed the connection, not %v", err)
+	}
+}
+
+// expectHangUp checks the daemon closes conn within timeout
+func expectHangUp(t *testing.T, conn net.Conn, timeout time.Duration, why string) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Errorf("the daemon should have hung up %v, not %v", why, err)
+	}
+}
+
+func TestServerHandshakeLimits(t *testing.T) {
+	server := NewServer(&DaemonConfig{HandshakeTimeout: 200 * time.Millisecond, MaxHandshakes: 1})
+	addr := serveTest(t, server)
+
+	// a connection that never sends its request takes the only
+	// handshake, the next one is turned away straight away
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	expectHangUp(t, second, 100*time.Millisecond, "with too many connections handshaking")
+
+	// the idle one is cut off after HandshakeTimeout and makes room
+	expectHangUp(t, idle, time.Second, "after HandshakeTimeout")
+	time.Sleep(50 * time.Millisecond)
+
+	resp, conn := requestTest(t, addr, &Request{RequestID: uuid.New(), Direction: Outgoing, Path: "/a", Destination: "relative"})
+	defer conn.Close()
+	if resp.Accepted {
+		t.Error("a relative Destination should be rejected")
+	}
+	if server.handshakes != 0 {
+		t.Errorf("no connection should be handshaking, not %v", server.handshakes)
+	}
+}
+
+func TestServerClosesUndecodableRequest(t *testing.T) {
+	addr := serveTest(t, NewServer(&DaemonConfig{}))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("not a request\n")); err != nil {
+		t.Fatal(err)
+	}
+	// the decoder fails once it can't read any more, our side's still
+	// open for the daemon to hang up on
+	conn.(*net.TCPConn).CloseWrite()
+	expectHangUp(t, conn, time.Second, "after a request it can't decode")
+}
+
+func TestServerDropsQueuedRequesterThatHangsUp(t *testing.T) {
+	limiter := NewLimiter(ConnectionLimits{MaxConnections: 1, MaxQueued: 1})
+	addr := serveTest(t, NewServer(&DaemonConfig{Limiter: limiter}))
+
+	// something else has the only slot
+	release, err := limiter.Acquire("elsewhere", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	resp, conn := requestTest(t, addr, &Request{
+		RequestID:   uuid.New(),
+		Direction:   Outgoing,
+		Path:        "/source",
+		Destination: "/destination",
+		BlockSize:   10,
+		Transport:   TCPTransport,
+	})
+	if !resp.Queued || resp.QueuePosition != 1 {
+		t.Fatalf("the request should be queued first, not %+v", resp)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, queued := limiter.Active(); queued == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("a requester that hung up should leave the queue")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSyncClosesConnOnInvalidOptions(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	udpConn, err := ListenUDP("localhost", PortRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &Options{Path: "relative", Destination: "/destination", BlockSize: 10, UDPConn: udpConn}
+	if _, err := SyncIncoming(context.Background(), local, opts); err == nil {
+		t.Fatal("SyncIncoming should fail on a relative Path")
+	}
+
+	if _, err := local.Write([]byte{0}); err == nil {
+		t.Error("SyncIncoming should have closed conn")
+	}
+	if _, err := udpConn.WriteTo([]byte{0}, udpConn.LocalAddr()); err == nil {
+		t.Error("SyncIncoming should have closed the udp socket")
+	}
+}
+
+// syncWithDaemon runs req against the daemon at addr, with local as our
+// side's options
+func syncWithDaemon(t *testing.T, addr string, req *Request, local Options) error {
+	resp, conn := requestTest(t, addr, req)
+	if !resp.Accepted {
+		conn.Close()
+		t.Fatalf("the request should be accepted: %v", resp.Reason)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if req.Direction == Outgoing {
+		_, err := SyncOutgoing(context.Background(), conn, &local)
+		return err
+	}
+	_, err := SyncIncoming(context.Background(), conn, &local)
+	return err
+}
+
+func TestModuleSymlinksStayInside(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "gosync.module.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	moduleDir := filepath.Join(dir, "module")
+	outside := filepath.Join(dir, "outside")
+	source := filepath.Join(dir, "source")
+	for _, d := range []string{moduleDir, outside, source} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addr := serveTest(t, NewServer(&DaemonConfig{
+		Modules: map[string]*Module{"backups": {Name: "backups", Path: moduleDir}},
+	}))
+
+	push := func() error {
+		return syncWithDaemon(t, addr, &Request{
+			RequestID:       uuid.New(),
+			Direction:       Outgoing,
+			Module:          "backups",
+			Path:            source,
+			Destination:     "",
+			BlockSize:       10,
+			ContinueOnError: true,
+			Transport:       TCPTransport,
+		}, Options{
+			Path:            source,
+			Destination:     "/",
+			BlockSize:       10,
+			ContinueOnError: true,
+			Transport:       TCPTransport,
+		})
+	}
+
+	// a pushed link out of the module is refused
+	makeFiles([]SyncTestCaseFile{
+		{RelPath: "a", Pieces: []SyncTestCaseFilePiece{{'a', 10}}},
+	}, source)
+	if err := os.Symlink("../outside", filepath.Join(source, "evil")); err != nil {
+		t.Fatal(err)
+	}
+	var partial *PartialTransferError
+	if err := push(); !errors.As(err, &partial) || partial.FileErrors[0].Path != "evil" {
+		t.Fatalf("pushing evil should have skipped it, not %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(moduleDir, "evil")); !os.IsNotExist(err) {
+		t.Fatalf("evil shouldn't have been made: %v", err)
+	}
+
+	// and one that's there anyway isn't followed by the next push
+	if err := os.Symlink("../outside", filepath.Join(moduleDir, "evil")); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(source, "evil"))
+	makeFiles([]SyncTestCaseFile{
+		{RelPath: "evil/x", Pieces: []SyncTestCaseFilePiece{{'x', 10}}},
+	}, source)
+	if err := push(); !errors.As(err, &partial) {
+		t.Fatalf("pushing evil/x should have skipped it, not %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "x")); !os.IsNotExist(err) {
+		t.Errorf("evil/x should not have been written outside the module: %v", err)
+	}
+
+	// nor by a pull
+	makeFiles([]SyncTestCaseFile{
+		{RelPath: "y", Pieces: []SyncTestCaseFilePiece{{'y', 10}}},
+	}, outside)
+	destination := filepath.Join(dir, "pulled")
+	err = syncWithDaemon(t, addr, &Request{
+		RequestID:   uuid.New(),
+		Direction:   Incoming,
+		Module:      "backups",
+		Path:        "evil/y",
+		Destination: destination,
+		BlockSize:   10,
+		Transport:   TCPTransport,
+	}, Options{
+		Path:        "/evil/y",
+		Destination: destination,
+		BlockSize:   10,
+		Transport:   TCPTransport,
+	})
+	if err == nil {
+		t.Error("pulling evil/y should fail")
+	}
+	if _, err := os.Lstat(destination); !os.IsNotExist(err) {
+		t.Errorf("nothing should have been pulled from outside the module: %v", err)
+	}
+}
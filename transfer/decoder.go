@@ -2,81 +2,58 @@ package transfer
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
-	"time"
 )
 
-func DecodePackets(manager Manager) {
-	// loop until we're done or an error is reported
-	for !manager.Done() && manager.Error() == nil {
-		// iterate from LastPacketDecoded to LastPacketReceived
-		// if we get consecutive packets up to an end packet then
-		// we put all the content into a buffer and decode it
-		start := manager.Packeter().LastPacketDecoded + 1
-		i := start
-		end := manager.Packeter().LastPacketReceived
-
-		for i <= end {
-
-			manager.Packeter().receiveCacheMutex.RLock()
-			packet, ok := manager.Packeter().receiveCache[i]
-			manager.Packeter().receiveCacheMutex.RUnlock()
-
+// DecodePackets decodes the groups of packets the packeter receives and
+// queues what's in them with the manager, until the transfer is finished
+// or ctx is done
+func DecodePackets(ctx context.Context, manager Manager) {
+	packeter := manager.Packeter()
+
+	for {
+		// decode every consecutive set of packets up to an end packet
+		// we have, there may be a hole after them
+		for {
+			packets, ok := packeter.NextGroup()
 			if !ok {
-				// There's a hole in our receiveCache dear 'liza,
-				// break and try again later
 				break
+			}
 
-			} else if packet.IsEndPacket {
-				// We've found a consecutive set of packets!
-				// ReadDecodeAndSend them
-				err := readDecodeAndSend(manager, start, i)
-				if err != nil {
-					manager.ReportError(err)
-				}
-
-				// The start of the next packetset is i + 1
-				start = i + 1
+			if err := decodeAndSend(manager, packets); err != nil {
+				manager.ReportError(err)
+				return
 			}
-			i++
+
+			packeter.GroupDecoded(packets[len(packets)-1].PacketID)
 		}
-		// NOTE: if this sleep isn't here then the whole process can get
-		// stuck, seemingly because this goroutine hogs all available
-		// CPU or something dumb like that?
-		time.Sleep(time.Millisecond * 100)
 
+		// wait for more packets
+		select {
+		case <-packeter.Received():
+		case <-manager.Finished():
+			return
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-func readDecodeAndSend(manager Manager, start uint64, end uint64) error {
+func decodeAndSend(manager Manager, packets []Packet) error {
 	var buff bytes.Buffer
 
-	var contentType PacketContentType
 	// read the content from our packet range in the buffer
 	// for decoding
-	for i := start; i <= end; i++ {
-		manager.Packeter().receiveCacheMutex.RLock()
-		// this function assumes it's the only thing that removes stuff
-		// from the receive cache, and that all packets from start to
-		// end exist in the cache, so we don't check "ok"
-		packet, _ := manager.Packeter().receiveCache[i]
-		manager.Packeter().receiveCacheMutex.RUnlock()
-
+	for _, packet := range packets {
 		if _, err := buff.Write(packet.Content); err != nil {
 			return err
 		}
-
-		contentType = packet.ContentType
-
-		// remove from the receiveCache
-		manager.Packeter().receiveCacheMutex.Lock()
-		delete(manager.Packeter().receiveCache, i)
-		manager.Packeter().receiveCacheMutex.Unlock()
 	}
 
 	decoder := gob.NewDecoder(&buff)
 
-	switch contentType {
+	switch packets[0].ContentType {
 
 	case FileInfoPacket:
 		var fi FileInfo
@@ -98,8 +75,5 @@ func readDecodeAndSend(manager Manager, start uint64, end uint64) error {
 		manager.QueueDelta(delta)
 	}
 
-	// update the LastPacketDecoded
-	manager.Packeter().LastPacketDecoded = end
-
 	return nil
 }
@@ -2,13 +2,18 @@ package transfer
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"sync"
 )
 
 // Delta can be applied to the basis file to produce the desired
 // result file
 type Delta struct {
+	// Path is relative to the Destination
 	Path    string
 	Len     int
 	Content []byte
@@ -16,40 +21,167 @@ type Delta struct {
 	EOF     bool
 	NoOp    bool
 	Done    bool
+	// Skip says the file failed after some of its deltas were sent,
+	// the patcher gives up on it too
+	Skip    bool
+	// Mode is the source file's, the patcher makes new files with it
+	Mode    os.FileMode
 }
 
 
-func ProcessDeltas(opts *Options, manager Manager)  {
+// ProcessDeltas makes the deltas for the signatures it gets, with
+// Options.DeltaWorkers workers that each handle some of the files
+func ProcessDeltas(ctx context.Context, opts *Options, manager Manager)  {
 
 	defer manager.DeltaDone()
 
-	fdmap := make(map[string]*os.File)
+	root, err := openRoot(opts, opts.Path)
+	if err != nil {
+		manager.ReportError(err)
+		return
+	}
+	defer root.Close()
+
+	files := newOpenFiles(maxOpenFiles(opts))
+	defer files.closeAll()
+
+	workers := stageWorkers(opts.DeltaWorkers)
+	shards := make([]chan Checksum, workers)
+	var wait sync.WaitGroup
+	for i := range shards {
+		shards[i] = make(chan Checksum, SIGNATURE_BUF_SIZE)
+		wait.Add(1)
+		go func(sigs chan Checksum) {
+			defer wait.Done()
+			deltaWorker(ctx, opts, manager, root, files, sigs)
+		}(shards[i])
+	}
+	// the workers return once their shards are closed and drained
+	defer func() {
+		for _, sigs := range shards {
+			close(sigs)
+		}
+		wait.Wait()
+	}()
+
+	for {
+		var sig Checksum
+		select {
+		case s, ok := <-manager.SignatureChannel():
+			if !ok {
+				return
+			}
+			sig = s
+		case <-ctx.Done():
+			return
+		}
+
+		select {
+		case shards[shardFor(sig.TransferFile.RelPath, workers)] <- sig:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deltaWorker makes the deltas for the signatures in sigs, which are all
+// for files sharded to it
+func deltaWorker(ctx context.Context, opts *Options, manager Manager, root *transferRoot, files *openFiles, sigs chan Checksum) {
 
 	eofmap := make(map[string]int64)
+	// started files had deltas made, until their EOF signature
+	started := make(map[string]bool)
+	// skipped files failed, their remaining checksums are dropped
+	skipped := make(map[string]bool)
+
+	// finish forgets the file at sourcePath, it won't get any more
+	// signatures
+	finish := func(sourcePath string) {
+		delete(eofmap, sourcePath)
+		delete(started, sourcePath)
+		files.close(sourcePath)
+	}
+
+	// giveUp drops the file sig is for, telling the patcher in case it
+	// has some of its deltas
+	giveUp := func(sig Checksum, sourcePath string) {
+		skipped[sourcePath] = true
+		if started[sourcePath] {
+			manager.QueueDelta(makeSkipDelta(sig))
+		}
+		finish(sourcePath)
+	}
+
+	// skip gives up on the file after err, returning false if the
+	// transfer failed instead
+	skip := func(sig Checksum, sourcePath string, err error) bool {
+		if !manager.ReportFileError(sig.TransferFile.RelPath, PHASE_DELTA, err) {
+			return false
+		}
+		giveUp(sig, sourcePath)
+		return true
+	}
 
 	buf := make([]byte, opts.BlockSize)
 
-	for sig := range manager.SignatureChannel() {
-		var f *os.File
-		f, ok := fdmap[sig.TransferFile.SourcePath]
-		if (!ok) {
-			openf, err := os.Open(sig.TransferFile.SourcePath)
-			if (err != nil) {
-				manager.ReportError(err)
+	// the file the last signature was for, it may be closed to make room
+	// for others while we're onto the next signature
+	held := ""
+	defer func() { files.release(held) }()
+
+	for sig := range sigs {
+		files.release(held)
+		held = ""
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		sourcePath := opts.SourcePath(sig.TransferFile.RelPath)
+
+		if skipped[sourcePath] {
+			continue
+		}
+
+		if sig.Skip {
+			// the destination gave up on the file, so do we
+			giveUp(sig, sourcePath)
+			continue
+		}
+
+		// the checksums come from the peer, one that doesn't fit a
+		// block can't be compared
+		if !sig.EOF && (sig.Len < 0 || sig.Len > opts.BlockSize || sig.Sum == nil) {
+			err := errors.New(fmt.Sprintf("bad checksum at offset %v, length %v", sig.Offset, sig.Len))
+			if !skip(sig, sourcePath, err) {
 				return
 			}
-			fdmap[sig.TransferFile.SourcePath] = openf
-			f = openf
+			continue
 		}
 
-		if fileEOF, ok := eofmap[sig.TransferFile.SourcePath]; ok {
+		if fileEOF, ok := eofmap[sourcePath]; ok {
 			// we've already hit the end of this file, don't make any
 			// more deltas
 			if sig.Offset >= fileEOF {
+				if sig.EOF {
+					finish(sourcePath)
+				}
 				continue
 			}
 		}
 
+		f, err := files.get(sourcePath, func() (*os.File, error) {
+			return root.Open(root.name(sig.TransferFile.RelPath))
+		})
+		if (err != nil) {
+			if !skip(sig, sourcePath, err) {
+				return
+			}
+			continue
+		}
+		held = sourcePath
+		started[sourcePath] = true
+
 		if (sig.EOF) {
 			// This signature represents the end of the file
 			// so we should generate deltas for the rest of the file after
@@ -59,11 +191,10 @@ func ProcessDeltas(opts *Options, manager Manager)  {
 
 			var err error
 			var n   int
-			for {
+			for ctx.Err() == nil {
 				// seek in the source file
-				if _, err := f.Seek(offset, 0); err != nil{
-					manager.ReportError(err)
-					return
+				if _, err = f.Seek(offset, 0); err != nil{
+					break
 				}
 
 				n, err = f.Read(buf)
@@ -79,21 +210,28 @@ func ProcessDeltas(opts *Options, manager Manager)  {
 
 			}
 
-			if err != io.EOF {
-				manager.ReportError(err)
+			if ctx.Err() != nil {
 				return
+			} else if err != io.EOF {
+				if !skip(sig, sourcePath, err) {
+					return
+				}
+				continue
 			}
 
 			// make EOF delta
 			manager.QueueDelta(makeEOFDelta(sig, offset))
-			// done with this EOF sig, continue getting more sigs
+			// the EOF sig is the file's last, we're done with it
+			finish(sourcePath)
 			continue
 		}
 
 		// seek in the source file
 		if _, err := f.Seek(sig.Offset, 0); err != nil{
-			manager.ReportError(err)
-			return
+			if !skip(sig, sourcePath, err) {
+				return
+			}
+			continue
 		}
 
 		// We don't want to READ *more* bytes than the sig.Len
@@ -102,11 +240,13 @@ func ProcessDeltas(opts *Options, manager Manager)  {
 		n, err := f.Read(buf)
 
 		if err==io.EOF {
-			eofmap[sig.TransferFile.SourcePath] = sig.Offset
+			eofmap[sourcePath] = sig.Offset
 			manager.QueueDelta(makeEOFDelta(sig, sig.Offset))
 		} else if err != nil {
-			manager.ReportError(err)
-			return
+			if !skip(sig, sourcePath, err) {
+				return
+			}
+			continue
 		}
 
 		if n != sig.Len {
@@ -116,8 +256,10 @@ func ProcessDeltas(opts *Options, manager Manager)  {
 			h, err := Signature(buf[:n])
 
 			if err != nil {
-				manager.ReportError(err)
-				return
+				if !skip(sig, sourcePath, err) {
+					return
+				}
+				continue
 			}
 
 			if !bytes.Equal(h.Sum(nil), sig.Sum.Sum(nil)) {
@@ -131,13 +273,11 @@ func ProcessDeltas(opts *Options, manager Manager)  {
 		if n < len(buf) {
 			// We've probably reached the end of the file, so
 			// make a EOFDelta and record the end
-			eofmap[sig.TransferFile.SourcePath] = sig.Offset + int64(n)
+			eofmap[sourcePath] = sig.Offset + int64(n)
 			manager.QueueDelta(makeEOFDelta(sig, sig.Offset + int64(n)))
 		}
 
 	}
-
-	return
 }
 
 func makeCopyDelta(sig Checksum, buf []byte, length int, offset int64) Delta {
@@ -147,11 +287,12 @@ func makeCopyDelta(sig Checksum, buf []byte, length int, offset int64) Delta {
 	copy(newbuf, buf[:length])
 
 	b := Delta{
-		Path:  sig.TransferFile.DestinationPath,
+		Path:  sig.TransferFile.RelPath,
 		Len: length,
 		Content: newbuf[:length],
 		Offset: offset,
 		NoOp: false,
+		Mode: sig.TransferFile.Mode,
 	}
 
 	return b
@@ -161,19 +302,27 @@ func makeCopyDelta(sig Checksum, buf []byte, length int, offset int64) Delta {
 
 func makeEOFDelta(sig Checksum, offset int64) Delta {
 	b := Delta{
-		Path:  sig.TransferFile.DestinationPath,
+		Path:  sig.TransferFile.RelPath,
 		Len: 0,
 		Offset: offset,
 		EOF: true,
+		Mode: sig.TransferFile.Mode,
 	}
 
 	return b
 }
 
+func makeSkipDelta(sig Checksum) Delta {
+	return Delta{
+		Path: sig.TransferFile.RelPath,
+		Skip: true,
+	}
+}
+
 func makeNoCopyDelta(sig Checksum) Delta {
 
 	b := Delta{
-		Path:  sig.TransferFile.DestinationPath,
+		Path:  sig.TransferFile.RelPath,
 		Len: sig.Len,
 		Offset: sig.Offset,
 		NoOp: true,
@@ -0,0 +1,68 @@
+package transfer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestBadChecksumsSkipped(t *testing.T) {
+	source, err := ioutil.TempDir("/tmp", "gosync.source.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(source)
+
+	makeFiles([]SyncTestCaseFile{
+		{RelPath: "long", Pieces: []SyncTestCaseFilePiece{{'l', 10}}},
+		{RelPath: "nosum", Pieces: []SyncTestCaseFilePiece{{'n', 10}}},
+		{RelPath: "good", Pieces: []SyncTestCaseFilePiece{{'g', 10}}},
+	}, source)
+
+	opts := &Options{Path: source, BlockSize: 5, ContinueOnError: true}
+	manager := MakeLocalManager(opts)
+
+	sum, err := Signature([]byte("ggggg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the peer's checksums would index past the block or compare with
+	// a checksum that isn't there
+	for _, sig := range []Checksum{
+		{TransferFile: FileInfo{RelPath: "long"}, Sum: sum, Len: 100},
+		{TransferFile: FileInfo{RelPath: "nosum"}, Len: 5},
+		{TransferFile: FileInfo{RelPath: "good"}, Sum: sum, Len: 5},
+		{TransferFile: FileInfo{RelPath: "long"}, Offset: 5, EOF: true},
+		{TransferFile: FileInfo{RelPath: "nosum"}, Offset: 5, EOF: true},
+		{TransferFile: FileInfo{RelPath: "good"}, Offset: 5, EOF: true},
+	} {
+		manager.QueueSignature(sig)
+	}
+	manager.SignatureDone()
+	ProcessDeltas(context.Background(), opts, manager)
+
+	if err := manager.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	fileErrs := manager.FileErrors()
+	sort.Slice(fileErrs, func(i, j int) bool { return fileErrs[i].Path < fileErrs[j].Path })
+	if len(fileErrs) != 2 || fileErrs[0].Path != "long" || fileErrs[1].Path != "nosum" {
+		t.Fatalf("the bad checksums' files should be skipped, not %v", fileErrs)
+	}
+	for _, fileErr := range fileErrs {
+		if fileErr.Phase != PHASE_DELTA {
+			t.Errorf("%v should fail making deltas not %v", fileErr.Path, fileErr.Phase)
+		}
+	}
+
+	deltas := map[string]int{}
+	for delta := range manager.DeltaChannel() {
+		deltas[delta.Path]++
+	}
+	if deltas["long"] != 0 || deltas["nosum"] != 0 || deltas["good"] == 0 {
+		t.Errorf("only good should have deltas, not %v", deltas)
+	}
+}
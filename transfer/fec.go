@@ -0,0 +1,203 @@
+package transfer
+
+import (
+	"encoding/binary"
+)
+
+// Forward error correction lets the receiver rebuild a lost packet
+// without waiting for it to be resent.  For every FECGroupSize data packets
+// the sender emits one parity packet whose content is the XOR of the
+// data packets.  If exactly one data packet of a group is lost it can be
+// rebuilt from the parity packet and the rest of the group.
+//
+// Groups are aligned on packet ids, the first group is packets
+// 1..FECGroupSize, the second FECGroupSize+1..2*FECGroupSize and so on.
+// Parity packets use the id of the first packet in their group.  They are
+// never acknowledged or resent, if they're lost we fall back to resends.
+
+// fecHeaderLen is the length of the header prepended to a packet's content
+// before it's XORed into a parity: the content length and the packet's
+// ContentType and IsEndPacket flag
+const fecHeaderLen = 3
+
+// fecGroupStart returns the id of the first packet in packetID's group
+func fecGroupStart(packetID uint64, groupSize int) uint64 {
+	return ((packetID-1)/uint64(groupSize))*uint64(groupSize) + 1
+}
+
+// fecXOR XORs packet's content and header into parity, growing parity
+// as needed, and returns it
+func fecXOR(parity []byte, packet Packet) []byte {
+	n := fecHeaderLen + len(packet.Content)
+	for len(parity) < n {
+		parity = append(parity, 0)
+	}
+
+	var header [fecHeaderLen]byte
+	binary.BigEndian.PutUint16(header[:2], uint16(len(packet.Content)))
+	header[2] = byte(packet.ContentType)
+	if packet.IsEndPacket {
+		header[2] |= 0x80
+	}
+
+	for i, b := range header {
+		parity[i] ^= b
+	}
+	for i, b := range packet.Content {
+		parity[fecHeaderLen+i] ^= b
+	}
+
+	return parity
+}
+
+// fecEncoder builds parity packets on the sending side. Packets must be
+// added in packet id order.
+type fecEncoder struct {
+	groupSize int
+	count     int
+	parity    []byte
+}
+
+// Add adds a data packet to the current group and returns the group's
+// parity packet once the group is complete
+func (e *fecEncoder) Add(packet Packet) (Packet, bool) {
+	e.parity = fecXOR(e.parity, packet)
+	e.count++
+
+	if e.count < e.groupSize {
+		return Packet{}, false
+	}
+
+	parity := Packet{
+		PacketID:  fecGroupStart(packet.PacketID, e.groupSize),
+		IsParity:  true,
+		GroupSize: e.groupSize,
+		Content:   e.parity,
+	}
+
+	e.count = 0
+	e.parity = nil
+
+	return parity, true
+}
+
+// fecGroup accumulates the data packets of a group on the receiving side
+type fecGroup struct {
+	received int
+	idSum    uint64
+	xor      []byte
+	parity   *Packet
+}
+
+// fecDecoder tracks incomplete groups on the receiving side.  Groups at
+// or below lastReceived have nothing left to rebuild, so they're dropped
+// and their late parity packets ignored.
+type fecDecoder struct {
+	groupSize    int
+	lastReceived uint64
+	groups       map[uint64]*fecGroup
+}
+
+func newFECDecoder(groupSize int) *fecDecoder {
+	return &fecDecoder{
+		groupSize: groupSize,
+		groups:    make(map[uint64]*fecGroup),
+	}
+}
+
+// complete returns whether every packet of the group at start was
+// received
+func (d *fecDecoder) complete(start uint64) bool {
+	return start+uint64(d.groupSize)-1 <= d.lastReceived
+}
+
+// Received drops the groups completed now that every packet up to
+// lastReceived was received
+func (d *fecDecoder) Received(lastReceived uint64) {
+	d.lastReceived = lastReceived
+	for start := range d.groups {
+		if d.complete(start) {
+			delete(d.groups, start)
+		}
+	}
+}
+
+func (d *fecDecoder) group(start uint64) *fecGroup {
+	g, ok := d.groups[start]
+	if !ok {
+		g = &fecGroup{}
+		d.groups[start] = g
+	}
+	return g
+}
+
+// AddData records a received data packet and returns the group's missing
+// packet if it can now be rebuilt
+func (d *fecDecoder) AddData(packet Packet) (Packet, bool) {
+	start := fecGroupStart(packet.PacketID, d.groupSize)
+	if d.complete(start) {
+		return Packet{}, false
+	}
+	g := d.group(start)
+
+	g.received++
+	g.idSum += packet.PacketID
+	g.xor = fecXOR(g.xor, packet)
+
+	return d.recover(start, g)
+}
+
+// AddParity records a received parity packet and returns the group's
+// missing packet if it can now be rebuilt
+func (d *fecDecoder) AddParity(packet Packet) (Packet, bool) {
+	if packet.GroupSize != d.groupSize || d.complete(packet.PacketID) {
+		return Packet{}, false
+	}
+	g := d.group(packet.PacketID)
+	g.parity = &packet
+
+	return d.recover(packet.PacketID, g)
+}
+
+func (d *fecDecoder) recover(start uint64, g *fecGroup) (Packet, bool) {
+	if g.received == d.groupSize {
+		// nothing is missing
+		delete(d.groups, start)
+		return Packet{}, false
+	}
+
+	if g.parity == nil || g.received != d.groupSize-1 {
+		return Packet{}, false
+	}
+
+	delete(d.groups, start)
+
+	// the ids of a group sum up to n*start + n*(n-1)/2, whatever is
+	// left over after subtracting what we received is the missing id
+	n := uint64(d.groupSize)
+	missing := n*start + n*(n-1)/2 - g.idSum
+
+	content := append([]byte(nil), g.parity.Content...)
+	if len(content) < fecHeaderLen {
+		return Packet{}, false
+	}
+	for i, b := range g.xor {
+		if i < len(content) {
+			content[i] ^= b
+		}
+	}
+
+	length := int(binary.BigEndian.Uint16(content[:2]))
+	if fecHeaderLen+length > len(content) {
+		// parity doesn't match the data we have, give up and let
+		// the packet be resent
+		return Packet{}, false
+	}
+
+	return Packet{
+		PacketID:    missing,
+		ContentType: PacketContentType(content[2] & 0x7f),
+		IsEndPacket: content[2]&0x80 != 0,
+		Content:     content[fecHeaderLen : fecHeaderLen+length],
+	}, true
+}
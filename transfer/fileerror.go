@@ -0,0 +1,109 @@
+package transfer
+
+import (
+	"fmt"
+	"sync"
+)
+
+// The phases of a transfer a FileError can happen in
+const (
+	PHASE_WALK      = "walk"
+	PHASE_SIGNATURE = "signature"
+	PHASE_DELTA     = "delta"
+	PHASE_PATCH     = "patch"
+)
+
+// FileError is a failure to transfer one file.  With
+// Options.ContinueOnError the file is skipped and the transfer goes on.
+type FileError struct {
+	// Path is relative to the source Path and the Destination
+	Path  string
+	Phase string
+	// Err is the error's message, so it can travel to the peer
+	Err string
+}
+
+func (fileErr FileError) Error() string {
+	return fmt.Sprintf("%v %v: %v", fileErr.Phase, fileErr.Path, fileErr.Err)
+}
+
+// PartialTransferError is returned by the Sync functions when everything
+// but the files in FileErrors was transferred
+type PartialTransferError struct {
+	FileErrors []FileError
+}
+
+func (partial *PartialTransferError) Error() string {
+	if len(partial.FileErrors) == 1 {
+		return fmt.Sprintf("1 file failed: %v", partial.FileErrors[0])
+	}
+	return fmt.Sprintf("%v files failed, the first: %v", len(partial.FileErrors), partial.FileErrors[0])
+}
+
+// fileErrorList collects a transfer's FileErrors, both this side's and
+// the ones its peer sends
+type fileErrorList struct {
+	mutex sync.Mutex
+
+	continueOnError bool
+	errors          []FileError
+	// unsent are this side's errors the peer hasn't been told about
+	unsent []FileError
+
+	// tally tells the observer about every skipped file
+	tally *fileTally
+}
+
+func newFileErrorList(opts *Options, tally *fileTally) *fileErrorList {
+	return &fileErrorList{continueOnError: opts.ContinueOnError, tally: tally}
+}
+
+// report is Manager.ReportFileError for the managers
+func (list *fileErrorList) report(manager Manager, path string, phase string, err error) bool {
+	if !list.continueOnError {
+		manager.ReportError(err)
+		return false
+	}
+
+	manager.Logger().Warn("skipping file", "path", path, "phase", phase, "error", err)
+
+	fileErr := FileError{Path: path, Phase: phase, Err: err.Error()}
+
+	list.mutex.Lock()
+	list.errors = append(list.errors, fileErr)
+	list.unsent = append(list.unsent, fileErr)
+	list.mutex.Unlock()
+
+	list.tally.skipped(fileErr)
+	return true
+}
+
+// fromPeer records the errors the peer sent
+func (list *fileErrorList) fromPeer(fileErrs []FileError) {
+	if len(fileErrs) == 0 {
+		return
+	}
+
+	list.mutex.Lock()
+	list.errors = append(list.errors, fileErrs...)
+	list.mutex.Unlock()
+
+	for _, fileErr := range fileErrs {
+		list.tally.skipped(fileErr)
+	}
+}
+
+// takeUnsent returns the errors to send to the peer with the next status
+func (list *fileErrorList) takeUnsent() []FileError {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	unsent := list.unsent
+	list.unsent = nil
+	return unsent
+}
+
+func (list *fileErrorList) all() []FileError {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	return append([]FileError{}, list.errors...)
+}
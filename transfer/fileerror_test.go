@@ -0,0 +1,183 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// makeFileErrorDirs makes a source with files a and b and a symlink c,
+// and a destination where b is a directory and c a file, so b and c
+// fail even for root
+func makeFileErrorDirs(t *testing.T) (string, string) {
+	source, err := ioutil.TempDir("/tmp", "gosync.source.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination, err := ioutil.TempDir("/tmp", "gosync.dest.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeFiles([]SyncTestCaseFile{
+		{RelPath: "a", Pieces: []SyncTestCaseFilePiece{{'a', 25}}},
+		{RelPath: "b", Pieces: []SyncTestCaseFilePiece{{'b', 25}}},
+		{RelPath: "c", Target: "a", Mode: os.ModeSymlink},
+	}, source)
+
+	if err := os.Mkdir(filepath.Join(destination, "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	makeFiles([]SyncTestCaseFile{
+		{RelPath: "c", Pieces: []SyncTestCaseFilePiece{{'c', 5}}},
+	}, destination)
+
+	return source, destination
+}
+
+func assertPartial(t *testing.T, side string, err error) {
+	var partial *PartialTransferError
+	if !errors.As(err, &partial) {
+		t.Fatalf("%v should be partial not %v", side, err)
+	}
+
+	fileErrs := partial.FileErrors
+	sort.Slice(fileErrs, func(i, j int) bool { return fileErrs[i].Path < fileErrs[j].Path })
+	if len(fileErrs) != 2 || fileErrs[0].Path != "b" || fileErrs[1].Path != "c" {
+		t.Fatalf("%v should skip b and c not %v", side, fileErrs)
+	}
+	for _, fileErr := range fileErrs {
+		if fileErr.Phase != PHASE_SIGNATURE || fileErr.Err == "" {
+			t.Errorf("%v has the wrong error for %v: %v", side, fileErr.Path, fileErr)
+		}
+	}
+}
+
+// assertSkippedAround checks a was synced despite b and c failing
+func assertSkippedAround(t *testing.T, destination string) {
+	content, err := ioutil.ReadFile(filepath.Join(destination, "a"))
+	if err != nil || string(content) != "aaaaaaaaaaaaaaaaaaaaaaaaa" {
+		t.Errorf("a should have been synced, not %q, %v", content, err)
+	}
+}
+
+func TestContinueOnErrorLocal(t *testing.T) {
+	source, destination := makeFileErrorDirs(t)
+	defer os.RemoveAll(source)
+	defer os.RemoveAll(destination)
+
+	opts := &Options{Path: source, Destination: destination, BlockSize: 10}
+
+	// by default the first bad file fails the transfer
+	_, err := SyncLocal(context.Background(), opts)
+	var partial *PartialTransferError
+	if err == nil || errors.As(err, &partial) {
+		t.Fatalf("sync without ContinueOnError should fail not %v", err)
+	}
+
+	opts.ContinueOnError = true
+	_, err = SyncLocal(context.Background(), opts)
+	assertPartial(t, "local", err)
+	assertSkippedAround(t, destination)
+}
+
+func TestContinueOnErrorNet(t *testing.T) {
+	source, destination := makeFileErrorDirs(t)
+	defer os.RemoveAll(source)
+	defer os.RemoveAll(destination)
+
+	opts := Options{
+		Path:            source,
+		Destination:     destination,
+		BlockSize:       10,
+		Transport:       TCPTransport,
+		ContinueOnError: true,
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	sourceErr := make(chan error)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			sourceErr <- err
+			return
+		}
+		sourceOpts := opts
+		_, err = SyncOutgoing(context.Background(), conn, &sourceOpts)
+		sourceErr <- err
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destOpts := opts
+	_, err = SyncIncoming(context.Background(), conn, &destOpts)
+	assertPartial(t, "destination", err)
+	// the destination's failures reach the source
+	assertPartial(t, "source", <-sourceErr)
+
+	assertSkippedAround(t, destination)
+}
+
+func TestSkippedFileKeepsContent(t *testing.T) {
+	destination, err := ioutil.TempDir("/tmp", "gosync.dest.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+
+	makeFiles([]SyncTestCaseFile{
+		{RelPath: "a", Pieces: []SyncTestCaseFilePiece{{'a', 10}}},
+		{RelPath: "b", Pieces: []SyncTestCaseFilePiece{{'b', 10}}},
+		{RelPath: "c", Pieces: []SyncTestCaseFilePiece{{'c', 10}}},
+	}, destination)
+
+	opts := &Options{Destination: destination, BlockSize: 5, ContinueOnError: true}
+	manager := MakeLocalManager(opts)
+
+	// a is skipped after it's been partly patched, b is patched and c
+	// never gets its EOF delta
+	for _, delta := range []Delta{
+		{Path: "a", Content: []byte("xxxxx"), Len: 5},
+		{Path: "b", Content: []byte("yyyyy"), Len: 5},
+		{Path: "c", Content: []byte("zzzzz"), Len: 5},
+		{Path: "a", Skip: true},
+		{Path: "b", Offset: 5, Len: 5, NoOp: true},
+		{Path: "b", Offset: 10, EOF: true},
+	} {
+		manager.QueueDelta(delta)
+	}
+	manager.DeltaDone()
+	ProcessPatches(context.Background(), opts, manager)
+
+	for name, expected := range map[string]string{
+		"a": "aaaaaaaaaa",
+		"b": "yyyyybbbbb",
+		"c": "cccccccccc",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(destination, name))
+		if err != nil || string(content) != expected {
+			t.Errorf("%v should be %q not %q, %v", name, expected, content, err)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("the copies being patched should be gone, not %v entries left", len(entries))
+	}
+}
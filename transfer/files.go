@@ -0,0 +1,165 @@
+package transfer
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// DEFAULT_MAX_OPEN_FILES is the most files a pipeline stage keeps open
+// unless Options.MaxOpenFiles says otherwise.  It's lowered to fit the
+// process's file descriptor limit.
+const DEFAULT_MAX_OPEN_FILES = 64
+
+// maxOpenFiles returns how many files each pipeline stage of a transfer
+// keeps open
+func maxOpenFiles(opts *Options) int {
+	if opts.MaxOpenFiles > 0 {
+		return opts.MaxOpenFiles
+	}
+
+	// the daemon runs many transfers with a few stages each, and needs
+	// descriptors for their connections too
+	limit := DEFAULT_MAX_OPEN_FILES
+	if fdLimit := fileLimit(); fdLimit > 0 && fdLimit/16 < limit {
+		limit = fdLimit / 16
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	return limit
+}
+
+type openFile struct {
+	// file is nil while it's being opened
+	file *os.File
+	// idle is the file's place in openFiles.idle, nil while a worker
+	// is using it
+	idle *list.Element
+}
+
+// openFiles are the files a pipeline stage has open, by path.  The
+// stage's workers share it, but each file is only used by the worker
+// its path is sharded to.  Once more than limit files are open the least
+// recently used idle ones are closed, they're opened again if they're
+// needed again.
+type openFiles struct {
+	mutex sync.Mutex
+	limit int
+	files map[string]*openFile
+	// idle are the paths of the files no worker is using, the least
+	// recently used at the back
+	idle *list.List
+}
+
+func newOpenFiles(limit int) *openFiles {
+	return &openFiles{
+		limit: limit,
+		files: make(map[string]*openFile),
+		idle:  list.New(),
+	}
+}
+
+// get returns the open file at path, calling open to open it if it
+// isn't yet.  The file isn't closed to make room for others until it's
+// released.  open runs without the mutex held, opening a file can mean
+// copying it, so the other workers don't wait for it.
+func (files *openFiles) get(path string, open func() (*os.File, error)) (*os.File, error) {
+	files.mutex.Lock()
+	if of, ok := files.files[path]; ok {
+		if of.idle != nil {
+			files.idle.Remove(of.idle)
+			of.idle = nil
+		}
+		files.mutex.Unlock()
+		return of.file, nil
+	}
+
+	for len(files.files) >= files.limit && files.evict() {
+	}
+	// the file's slot is taken while it opens, it's not idle so it's
+	// not evicted
+	of := &openFile{}
+	files.files[path] = of
+	files.mutex.Unlock()
+
+	f, err := open()
+	// other transfers may be using up the descriptors, make do with
+	// fewer
+	for err != nil && isTooManyOpenFiles(err) && files.makeRoom() {
+		f, err = open()
+	}
+
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	if err != nil {
+		delete(files.files, path)
+		return nil, err
+	}
+	of.file = f
+	return f, nil
+}
+
+// release says the worker is done with the file at path for now
+func (files *openFiles) release(path string) {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+
+	if of, ok := files.files[path]; ok && of.idle == nil {
+		of.idle = files.idle.PushFront(path)
+	}
+}
+
+// evict closes the least recently used idle file, returning false if
+// there's none.  It must be called with the mutex held.
+func (files *openFiles) evict() bool {
+	back := files.idle.Back()
+	if back == nil {
+		return false
+	}
+
+	path := files.idle.Remove(back).(string)
+	files.files[path].file.Close()
+	delete(files.files, path)
+	return true
+}
+
+// makeRoom is evict for when the mutex isn't held
+func (files *openFiles) makeRoom() bool {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	return files.evict()
+}
+
+// close closes the file at path, returning whether it was open
+func (files *openFiles) close(path string) (bool, error) {
+	files.mutex.Lock()
+	of, ok := files.files[path]
+	if ok {
+		if of.idle != nil {
+			files.idle.Remove(of.idle)
+		}
+		delete(files.files, path)
+	}
+	files.mutex.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, of.file.Close()
+}
+
+// closeAll closes the files left open when a stage stops early
+func (files *openFiles) closeAll() {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+
+	for path, of := range files.files {
+		// a file that's still being opened has nothing to close
+		if of.file != nil {
+			of.file.Close()
+		}
+		delete(files.files, path)
+	}
+	files.idle.Init()
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package transfer
+
+// fileLimit is only known on unix, elsewhere DEFAULT_MAX_OPEN_FILES is
+// used as is
+func fileLimit() int {
+	return 0
+}
+
+func isTooManyOpenFiles(err error) bool {
+	return false
+}
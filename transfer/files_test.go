@@ -0,0 +1,130 @@
+package transfer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOpenFilesEvictsLeastRecentlyUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "gosync.files.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opened := make(map[string]int)
+	files := newOpenFiles(2)
+	defer files.closeAll()
+
+	get := func(name string) *os.File {
+		path := filepath.Join(dir, name)
+		f, err := files.get(path, func() (*os.File, error) {
+			opened[name]++
+			return os.Create(path)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	a := get("a")
+	files.release(filepath.Join(dir, "a"))
+	get("b")
+	files.release(filepath.Join(dir, "b"))
+	// a is used again, so b is the least recently used
+	get("a")
+	files.release(filepath.Join(dir, "a"))
+
+	// c makes room by closing b
+	c := get("c")
+	if _, err := a.Stat(); err != nil {
+		t.Errorf("a should still be open: %v", err)
+	}
+	// and b is opened again by closing a
+	get("b")
+	if opened["b"] != 2 {
+		t.Errorf("b should have been opened again, it was opened %v times", opened["b"])
+	}
+	if _, err := a.Stat(); err == nil {
+		t.Error("a should have been closed to make room")
+	}
+
+	// c and b are in use, they're never closed to make room
+	get("d")
+	if _, err := c.Stat(); err != nil {
+		t.Errorf("c is in use and should still be open: %v", err)
+	}
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	if n := maxOpenFiles(&Options{MaxOpenFiles: 5}); n != 5 {
+		t.Errorf("MaxOpenFiles should be used as is, not %v", n)
+	}
+	if n := maxOpenFiles(&Options{}); n < 1 || n > DEFAULT_MAX_OPEN_FILES {
+		t.Errorf("the default should be between 1 and %v, not %v", DEFAULT_MAX_OPEN_FILES, n)
+	}
+}
+
+func TestOpenFilesOpensUnlocked(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "gosync.files.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := newOpenFiles(2)
+	defer files.closeAll()
+
+	// a is slow to open, like a big file being copied to patch it
+	opening := make(chan struct{})
+	slow := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		_, err := files.get(filepath.Join(dir, "a"), func() (*os.File, error) {
+			close(opening)
+			<-slow
+			return os.Create(filepath.Join(dir, "a"))
+		})
+		done <- err
+	}()
+	<-opening
+
+	// b is opened meanwhile
+	opened := make(chan error)
+	go func() {
+		_, err := files.get(filepath.Join(dir, "b"), func() (*os.File, error) {
+			return os.Create(filepath.Join(dir, "b"))
+		})
+		opened <- err
+	}()
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("b waited for a to open")
+	}
+
+	close(slow)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed open frees its slot
+	failed := errors.New("failed")
+	files.release(filepath.Join(dir, "b"))
+	if _, err := files.get(filepath.Join(dir, "c"), func() (*os.File, error) { return nil, failed }); err != failed {
+		t.Fatalf("the open's error should be returned not %v", err)
+	}
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	if _, ok := files.files[filepath.Join(dir, "c")]; ok {
+		t.Error("c's slot should be freed")
+	}
+}
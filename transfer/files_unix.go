@@ -0,0 +1,26 @@
+//go:build unix
+
+package transfer
+
+import (
+	"errors"
+	"syscall"
+)
+
+// fileLimit returns the soft RLIMIT_NOFILE, 0 if it's unknown.  The go
+// runtime already raised it to the hard limit when the process started.
+func fileLimit() int {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0
+	}
+	// unlimited or close to it
+	if uint64(rlimit.Cur) > 1<<30 {
+		return 1 << 30
+	}
+	return int(rlimit.Cur)
+}
+
+func isTooManyOpenFiles(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
@@ -0,0 +1,272 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DEFAULT_RETRY_AFTER is how long rejected requesters are told to wait
+// unless configured otherwise
+const DEFAULT_RETRY_AFTER = time.Minute
+
+// ConnectionLimits caps the transfers a daemon runs at once.  Zero means
+// no limit.
+type ConnectionLimits struct {
+	// MaxConnections caps the transfers running at once, modules can
+	// have their own cap too, see Module.MaxConnections
+	MaxConnections int
+	// MaxPerHost caps the transfers running or queued for one host,
+	// requests over it are rejected rather than queued
+	MaxPerHost int
+	// MaxQueued caps the requests waiting for a transfer to finish,
+	// requests over it are rejected.  0 rejects instead of queueing.
+	MaxQueued int
+	// RetryAfter is what rejected requesters are told to wait
+	RetryAfter time.Duration
+}
+
+// LimitError is returned for requests turned away by a Limiter
+type LimitError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (err *LimitError) Error() string {
+	return err.Reason
+}
+
+// Limiter admits transfers within its ConnectionLimits, queueing the
+// requests that don't fit in the order they arrived
+type Limiter struct {
+	mutex  sync.Mutex
+	limits ConnectionLimits
+
+	active        int
+	activeModules map[string]int
+	// hosts counts running and queued requests
+	hosts map[string]int
+
+	queue []*limiterWaiter
+}
+
+type limiterWaiter struct {
+	module   *Module
+	admitted bool
+	// wake is signalled whenever the queue moves
+	wake chan bool
+}
+
+func NewLimiter(limits ConnectionLimits) *Limiter {
+	if limits.RetryAfter <= 0 {
+		limits.RetryAfter = DEFAULT_RETRY_AFTER
+	}
+
+	return &Limiter{
+		limits:        limits,
+		activeModules: make(map[string]int),
+		hosts:         make(map[string]int),
+	}
+}
+
+// SetLimits changes the limits, running transfers aren't affected
+func (limiter *Limiter) SetLimits(limits ConnectionLimits) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limits.RetryAfter <= 0 {
+		limits.RetryAfter = DEFAULT_RETRY_AFTER
+	}
+	limiter.limits = limits
+	limiter.admit()
+}
+
+// Limits returns the limits in force
+func (limiter *Limiter) Limits() ConnectionLimits {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.limits
+}
+
+// ErrRequesterGone is returned by Acquire when the requester hung up
+// while it was queued
+var ErrRequesterGone = errors.New("requester hung up")
+
+// Acquire waits for room to run a transfer for host in module, which is
+// nil without modules.  While the request is queued, queued is called
+// with its position in the queue each time it changes, if queued fails
+// or gone is closed the request leaves the queue.  The returned func
+// releases the slot.
+func (limiter *Limiter) Acquire(host string, module *Module, queued func(position int) error, gone <-chan struct{}) (func(), error) {
+	limiter.mutex.Lock()
+
+	if limiter.limits.MaxPerHost > 0 && limiter.hosts[host] >= limiter.limits.MaxPerHost {
+		limiter.mutex.Unlock()
+		return nil, limiter.reject("too many connections from host")
+	}
+
+	if len(limiter.queue) == 0 && limiter.fits(module) {
+		limiter.take(module)
+		limiter.hosts[host]++
+		limiter.mutex.Unlock()
+		return limiter.releaseFunc(host, module), nil
+	}
+
+	if len(limiter.queue) >= limiter.limits.MaxQueued {
+		limiter.mutex.Unlock()
+		return nil, limiter.reject("too many connections")
+	}
+
+	waiter := &limiterWaiter{module: module, wake: make(chan bool, 1)}
+	limiter.queue = append(limiter.queue, waiter)
+	limiter.hosts[host]++
+
+	reported := 0
+	for !waiter.admitted {
+		position := limiter.position(waiter)
+		limiter.mutex.Unlock()
+
+		if position != reported {
+			if err := queued(position); err != nil {
+				limiter.abandon(host, waiter)
+				return nil, err
+			}
+			reported = position
+		}
+
+		select {
+		case <-waiter.wake:
+		case <-gone:
+			limiter.abandon(host, waiter)
+			return nil, ErrRequesterGone
+		}
+		limiter.mutex.Lock()
+	}
+
+	limiter.mutex.Unlock()
+	return limiter.releaseFunc(host, module), nil
+}
+
+// Active returns the number of running transfers and queued requests
+func (limiter *Limiter) Active() (int, int) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.active, len(limiter.queue)
+}
+
+func (limiter *Limiter) reject(reason string) error {
+	retryAfter := limiter.limits.RetryAfter
+	return &LimitError{
+		Reason:     fmt.Sprintf("%v, retry after %v", reason, retryAfter),
+		RetryAfter: retryAfter,
+	}
+}
+
+// fits must be called with the mutex held
+func (limiter *Limiter) fits(module *Module) bool {
+	if limiter.limits.MaxConnections > 0 && limiter.active >= limiter.limits.MaxConnections {
+		return false
+	}
+	if module != nil && module.MaxConnections > 0 &&
+		limiter.activeModules[module.Name] >= module.MaxConnections {
+		return false
+	}
+	return true
+}
+
+// take must be called with the mutex held
+func (limiter *Limiter) take(module *Module) {
+	limiter.active++
+	if module != nil {
+		limiter.activeModules[module.Name]++
+	}
+}
+
+// position must be called with the mutex held
+func (limiter *Limiter) position(waiter *limiterWaiter) int {
+	for i, queued := range limiter.queue {
+		if queued == waiter {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// admit starts the queued requests that fit now, in order, and wakes the
+// rest so they can report their new position.  It must be called with
+// the mutex held.
+func (limiter *Limiter) admit() {
+	remaining := limiter.queue[:0]
+	for _, waiter := range limiter.queue {
+		if limiter.fits(waiter.module) {
+			limiter.take(waiter.module)
+			waiter.admitted = true
+		} else {
+			remaining = append(remaining, waiter)
+		}
+		wakeWaiter(waiter)
+	}
+	limiter.queue = remaining
+}
+
+func wakeWaiter(waiter *limiterWaiter) {
+	select {
+	case waiter.wake <- true:
+	default:
+	}
+}
+
+func (limiter *Limiter) abandon(host string, waiter *limiterWaiter) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.hosts[host]--
+	if limiter.hosts[host] == 0 {
+		delete(limiter.hosts, host)
+	}
+
+	if waiter.admitted {
+		// admitted after it gave up, give the slot back
+		limiter.release(waiter.module)
+		return
+	}
+
+	for i, queued := range limiter.queue {
+		if queued == waiter {
+			limiter.queue = append(limiter.queue[:i], limiter.queue[i+1:]...)
+			break
+		}
+	}
+	for _, queued := range limiter.queue {
+		wakeWaiter(queued)
+	}
+}
+
+func (limiter *Limiter) releaseFunc(host string, module *Module) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			limiter.mutex.Lock()
+			defer limiter.mutex.Unlock()
+
+			limiter.hosts[host]--
+			if limiter.hosts[host] == 0 {
+				delete(limiter.hosts, host)
+			}
+			limiter.release(module)
+		})
+	}
+}
+
+// release must be called with the mutex held
+func (limiter *Limiter) release(module *Module) {
+	limiter.active--
+	if module != nil {
+		limiter.activeModules[module.Name]--
+		if limiter.activeModules[module.Name] == 0 {
+			delete(limiter.activeModules, module.Name)
+		}
+	}
+	limiter.admit()
+}
@@ -0,0 +1,179 @@
+package transfer
+
+import (
+	"testing"
+	"time"
+)
+
+// queueAcquire runs Acquire in the background, sending the positions it
+// reports on positions and the release func on acquired
+func queueAcquire(t *testing.T, limiter *Limiter, host string, module *Module) (chan int, chan func()) {
+	positions := make(chan int, 16)
+	acquired := make(chan func(), 1)
+
+	go func() {
+		release, err := limiter.Acquire(host, module, func(position int) error {
+			positions <- position
+			return nil
+		}, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		acquired <- release
+	}()
+
+	return positions, acquired
+}
+
+func expectPosition(t *testing.T, positions chan int, expected int) {
+	select {
+	case position := <-positions:
+		if position != expected {
+			t.Errorf("queue position should be %v not %v", expected, position)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("queue position %v wasn't reported", expected)
+	}
+}
+
+func expectAcquired(t *testing.T, acquired chan func()) func() {
+	select {
+	case release := <-acquired:
+		return release
+	case <-time.After(time.Second):
+		t.Fatal("queued request wasn't admitted")
+	}
+	return nil
+}
+
+func TestLimiterPerHost(t *testing.T) {
+	limiter := NewLimiter(ConnectionLimits{MaxPerHost: 1, RetryAfter: time.Second})
+
+	release, err := limiter.Acquire("10.0.0.1", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = limiter.Acquire("10.0.0.1", nil, nil, nil)
+	limitErr, ok := err.(*LimitError)
+	if !ok {
+		t.Fatalf("second request from a host should be rejected, got %v", err)
+	}
+	if limitErr.RetryAfter != time.Second {
+		t.Errorf("RetryAfter should be %v not %v", time.Second, limitErr.RetryAfter)
+	}
+
+	if _, err := limiter.Acquire("10.0.0.2", nil, nil, nil); err != nil {
+		t.Errorf("other hosts shouldn't be limited: %v", err)
+	}
+
+	release()
+	release()
+	if _, err := limiter.Acquire("10.0.0.1", nil, nil, nil); err != nil {
+		t.Errorf("host should be let in after releasing: %v", err)
+	}
+}
+
+func TestLimiterQueue(t *testing.T) {
+	limiter := NewLimiter(ConnectionLimits{MaxConnections: 1, MaxQueued: 2})
+
+	release, err := limiter.Acquire("a", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstPositions, first := queueAcquire(t, limiter, "b", nil)
+	expectPosition(t, firstPositions, 1)
+	secondPositions, second := queueAcquire(t, limiter, "c", nil)
+	expectPosition(t, secondPositions, 2)
+
+	if _, err := limiter.Acquire("d", nil, nil, nil); err == nil {
+		t.Fatal("request over a full queue should be rejected")
+	}
+
+	// the first in the queue runs next and the second moves up
+	release()
+	releaseFirst := expectAcquired(t, first)
+	expectPosition(t, secondPositions, 1)
+
+	if active, queued := limiter.Active(); active != 1 || queued != 1 {
+		t.Errorf("should have 1 running and 1 queued not %v and %v", active, queued)
+	}
+
+	releaseFirst()
+	expectAcquired(t, second)()
+
+	if active, queued := limiter.Active(); active != 0 || queued != 0 {
+		t.Errorf("should have nothing running or queued not %v and %v", active, queued)
+	}
+}
+
+func TestLimiterModules(t *testing.T) {
+	limiter := NewLimiter(ConnectionLimits{MaxQueued: 1})
+	busy := &Module{Name: "busy", MaxConnections: 1}
+	quiet := &Module{Name: "quiet"}
+
+	release, err := limiter.Acquire("a", busy, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	positions, acquired := queueAcquire(t, limiter, "b", busy)
+	expectPosition(t, positions, 1)
+
+	// the full queue is for another module, but requests still line up
+	// behind it
+	if _, err := limiter.Acquire("c", quiet, nil, nil); err == nil {
+		t.Fatal("request over a full queue should be rejected")
+	}
+
+	release()
+	expectAcquired(t, acquired)()
+
+	if _, err := limiter.Acquire("c", quiet, nil, nil); err != nil {
+		t.Errorf("unlimited module should be let in: %v", err)
+	}
+}
+
+func TestLimiterRequesterGone(t *testing.T) {
+	limiter := NewLimiter(ConnectionLimits{MaxConnections: 1, MaxQueued: 1, MaxPerHost: 1})
+
+	release, err := limiter.Acquire("a", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	gone := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		_, err := limiter.Acquire("b", nil, func(position int) error { return nil }, gone)
+		result <- err
+	}()
+
+	// wait for it to be queued, then hang up without the queue moving
+	for _, queued := limiter.Active(); queued == 0; _, queued = limiter.Active() {
+		time.Sleep(time.Millisecond)
+	}
+	close(gone)
+
+	select {
+	case err := <-result:
+		if err != ErrRequesterGone {
+			t.Errorf("Acquire should return ErrRequesterGone not %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a requester that's gone should leave the queue")
+	}
+
+	if _, queued := limiter.Active(); queued != 0 {
+		t.Errorf("the queue should be empty, not %v", queued)
+	}
+	// and its host doesn't count any more
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if limiter.hosts["b"] != 0 {
+		t.Errorf("b shouldn't be counted any more, not %v times", limiter.hosts["b"])
+	}
+}
@@ -1,14 +1,54 @@
 package transfer
 
 import (
+	"errors"
 	"fmt"
-	"time"
+	"github.com/google/uuid"
+	"io"
+	"log/slog"
+	"strings"
 )
 
-func Debug(msg string) {
-	fmt.Printf("%s - DEBUG: %s\n", time.Now(), msg)
+// The formats NewLogger writes
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+// NewLogger makes a logger that writes records at level and above to w,
+// as LOG_FORMAT_TEXT or LOG_FORMAT_JSON.  level can be a *slog.LevelVar
+// to change it later.
+func NewLogger(w io.Writer, level slog.Leveler, format string) (*slog.Logger, error) {
+	handlerOpts := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(format) {
+	case LOG_FORMAT_TEXT, "":
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	case LOG_FORMAT_JSON:
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown log format: %v", format))
+	}
 }
 
-func Info(msg string) {
+// ParseLogLevel parses "debug", "info", "warn" or "error"
+func ParseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, errors.New(fmt.Sprintf("unknown log level: %v", s))
+	}
+	return level, nil
+}
 
+// logger returns the logger for the transfer opts describe, its
+// records are tagged with the RequestID
+func (opts *Options) logger() *slog.Logger {
+	logger := slog.Default()
+	if opts.LogHandler != nil {
+		logger = slog.New(opts.LogHandler)
+	}
+	if opts.RequestID != uuid.Nil {
+		logger = logger.With("request_id", opts.RequestID)
+	}
+	return logger
 }
@@ -0,0 +1,101 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"github.com/google/uuid"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	if level, err := ParseLogLevel("warn"); err != nil || level != slog.LevelWarn {
+		t.Errorf("warn should parse as %v not %v, %v", slog.LevelWarn, level, err)
+	}
+	if _, err := ParseLogLevel("loud"); err == nil {
+		t.Error("unknown levels shouldn't parse")
+	}
+	if _, err := NewLogger(ioutil.Discard, slog.LevelInfo, "xml"); err == nil {
+		t.Error("unknown formats should be an error")
+	}
+}
+
+func TestSyncLogs(t *testing.T) {
+	source, err := ioutil.TempDir("/tmp", "gosync.source.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(source)
+
+	destination, err := ioutil.TempDir("/tmp", "gosync.dest.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+
+	makeFiles(testcasebasic.SourceFiles, source)
+
+	var logs bytes.Buffer
+	logger, err := NewLogger(&logs, slog.LevelDebug, LOG_FORMAT_JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestID := uuid.New()
+	opts := Options{
+		Path:        source,
+		Destination: destination,
+		BlockSize:   testcasebasic.BlockSize,
+		Transport:   TCPTransport,
+		RequestID:   requestID,
+		LogHandler:  logger.Handler(),
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	sourceErr := make(chan error)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			sourceErr <- err
+			return
+		}
+		sourceOpts := opts
+		_, err = SyncOutgoing(context.Background(), conn, &sourceOpts)
+		sourceErr <- err
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destOpts := opts
+	if _, err := SyncIncoming(context.Background(), conn, &destOpts); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sourceErr; err != nil {
+		t.Fatal(err)
+	}
+
+	if logs.Len() == 0 {
+		t.Fatal("nothing was logged at debug level")
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if !strings.Contains(line, `"request_id":"`+requestID.String()+`"`) {
+			t.Errorf("log record should have the request ID: %v", line)
+		}
+		// the first file is ten a's, file contents must stay out of logs
+		if strings.Contains(line, "aaaaaaaaaa") || strings.Contains(line, "Content") {
+			t.Errorf("log record has file contents: %v", line)
+		}
+	}
+}
@@ -1,5 +1,10 @@
 package transfer
 
+import (
+	"context"
+	"log/slog"
+)
+
 type Manager interface {
 	// QueueFileInfo will queue a FileInfo that will be
 	// sent to the signature processor
@@ -35,26 +40,44 @@ type Manager interface {
 	// processed by the patch processor and the transfer is
 	// complete.
 	PatchDone()
+	// FilePatched should be called by the patch processor once
+	// the file at path, relative to the Destination, is written.
+	FilePatched(path string)
 
 	Packeter() *Packeter
 	// TCPDone is called by the TCP loops when they are done.
-	// It tells the manager that those loops are no longer
-	// running.
+	// It closes the packeter, which stops the UDPSender.
 	TCPDone()
 	// ReportError should be called when an error has been
 	// reported, it will make sure all channels are closed
 	// and it will also make sure that InError() will return
-	// True so goroutines will stop doing anything.
+	// True so goroutines will stop doing anything.  Only the
+	// first error is kept, later ones are usually fallout from it.
 	ReportError(err error)
+	// ReportFileError reports a failure to transfer the file at path,
+	// relative to the transfer.  It returns whether the caller should
+	// skip the file and go on, otherwise it was passed to ReportError
+	// because Options.ContinueOnError isn't set.
+	ReportFileError(path string, phase string, err error) bool
+	// FileErrors returns the files that were skipped, on both sides
+	FileErrors() []FileError
 	// Error returns whatever non-nil error that was passed by anyone
 	// to ReportError
 	Error() error
 	// Done returns true PatchDone was called
 	Done() bool
-	// NetDone returns true when all net communication is done
-	NetDone() bool
+	// Finished returns a channel that's closed when PatchDone is
+	// called
+	Finished() <-chan struct{}
 	// Stats returns the stats recorded by the manager
 	Stats() *TransferStats
+	// Logger returns the transfer's logger, see Options.LogHandler
+	Logger() *slog.Logger
+	// Observer returns the transfer's observer, see Options.Observer
+	Observer() TransferObserver
+	// Context is cancelled by ReportError, everything working on the
+	// transfer should stop then.  The tcp loops still tell the peer.
+	Context() context.Context
 }
 
 // TransferStatus is a struct that represents
@@ -71,14 +94,52 @@ type SourceTransferStatus struct {
 
 	SourcePacketerStatus PacketerStatus
 
+	// Packets are only sent with the status when using TCPTransport
+	Packets []Packet
+
+	// FileErrors are the files skipped since the last status
+	FileErrors []FileError
+
 	Failed string
 }
 
+// LogValue leaves out the Packets, they carry file data
+func (status SourceTransferStatus) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("last_file_info_packet", status.LastFileInfoPacket),
+		slog.Uint64("last_delta_packet", status.LastDeltaPacket),
+		slog.Uint64("last_packet_sent", status.SourcePacketerStatus.LastPacketSent),
+		slog.Uint64("last_packet_received", status.SourcePacketerStatus.LastPacketReceived),
+		slog.Int("packets", len(status.Packets)),
+		slog.Int("file_errors", len(status.FileErrors)),
+		slog.String("failed", status.Failed),
+	)
+}
+
 type DestinationTransferStatus struct {
 	LastSignaturePacket uint64
 	PatchDone           bool
 
 	DestinationPacketerStatus PacketerStatus
 
+	// Packets are only sent with the status when using TCPTransport
+	Packets []Packet
+
+	// FileErrors are the files skipped since the last status
+	FileErrors []FileError
+
 	Failed string
 }
+
+// LogValue leaves out the Packets, they carry file data
+func (status DestinationTransferStatus) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("last_signature_packet", status.LastSignaturePacket),
+		slog.Bool("patch_done", status.PatchDone),
+		slog.Uint64("last_packet_sent", status.DestinationPacketerStatus.LastPacketSent),
+		slog.Uint64("last_packet_received", status.DestinationPacketerStatus.LastPacketReceived),
+		slog.Int("packets", len(status.Packets)),
+		slog.Int("file_errors", len(status.FileErrors)),
+		slog.String("failed", status.Failed),
+	)
+}
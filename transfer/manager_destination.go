@@ -2,10 +2,12 @@ package transfer
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"errors"
-	"fmt"
+	"log/slog"
 	"runtime/debug"
+	"sync"
 )
 
 type DestinationManager struct {
@@ -13,30 +15,56 @@ type DestinationManager struct {
 	fileInfoChan chan FileInfo
 	deltaChan    chan Delta
 
+	// mutex guards the fields below and status, the tcp loop and the
+	// pipeline goroutines all use them
+	mutex sync.Mutex
+
 	fileInfoClosed bool
 	deltaClosed    bool
 
 	latestSignaturePacket uint64
 
-	tcpdone bool
-	done    bool
-	err     error
+	done bool
+	err  error
+
+	// finished is closed by PatchDone
+	finished chan struct{}
 
 	packeter *Packeter
 
 	status *DestinationTransferStatus
 	stats  *TransferStats
+
+	log *slog.Logger
+
+	fileErrors *fileErrorList
+
+	observer TransferObserver
+	tally    *fileTally
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewDestinationManager() *DestinationManager {
+func NewDestinationManager(opts *Options) *DestinationManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	observer := opts.observer()
+	tally := newFileTally(observer, true)
 
 	return &DestinationManager{
 		packetChan:   make(chan Packet, 100),
 		fileInfoChan: make(chan FileInfo, FILE_INFO_BUF_SIZE),
 		deltaChan:    make(chan Delta, DELTA_BUF_SIZE),
 		status:       &DestinationTransferStatus{},
-		stats:        NewTransferStats(),
-		packeter:     NewPacketer(),
+		finished:     make(chan struct{}),
+		stats:        opts.transferStats(),
+		packeter:     NewPacketer(opts),
+		log:          opts.logger(),
+		fileErrors:   newFileErrorList(opts, tally),
+		observer:     observer,
+		tally:        tally,
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 }
 
@@ -45,50 +73,74 @@ func NewDestinationManager() *DestinationManager {
 // as well, because the packeter may need to resend some packets, or delete
 // some sent packets.
 func (manager *DestinationManager) ReceiveStatusUpdate(status SourceTransferStatus) DestinationTransferStatus {
-
-	if status.Failed != "" {
+	// the observer hears about the peer's failures once we've unlocked
+	var failed error
+	defer func() {
+		if failed != nil {
+			manager.observer.Error(failed)
+		}
+		manager.fileErrors.fromPeer(status.FileErrors)
+	}()
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	// the peer echoes our own failure back, keep the error we have
+	if status.Failed != "" && manager.err == nil {
 		manager.status.Failed = status.Failed
 		manager.err = errors.New(status.Failed)
+		manager.cancel()
+		failed = manager.err
 	}
 
-	// Record the number of packets the source is requesting to be resent
-	manager.stats.RecordResentSourcePackets(
-		len(status.SourcePacketerStatus.ResendPackets))
-
 	// Tell the packeter about it's counterpart's status. The packeter then
 	// return's it's status, which will be sent by the TCPer on it's next iteration.
 	manager.status.DestinationPacketerStatus = manager.packeter.ReceivePacketerStatusUpdate(
 		status.SourcePacketerStatus)
 
-	// Record the number of packets the destination is requesting to be resent
-	manager.stats.RecordResentDestinationPackets(
-		len(manager.status.DestinationPacketerStatus.ResendPackets))
+	// Record the resend counters of both packeters
+	manager.stats.RecordPacketerStatuses(
+		status.SourcePacketerStatus, manager.status.DestinationPacketerStatus)
 
 	// All FileInfo packets have been decoded, call FileInfoDone
 	if status.LastFileInfoPacket != 0 &&
-		manager.packeter.LastPacketDecoded >= status.LastFileInfoPacket &&
+		manager.packeter.LastDecoded() >= status.LastFileInfoPacket &&
 		!manager.fileInfoClosed {
-		manager.FileInfoDone()
+		manager.fileInfoClosed = true
+		close(manager.fileInfoChan)
 	}
 
 	// All delta packets have been decoded, call DeltaDone
 	if status.LastDeltaPacket != 0 &&
-		manager.packeter.LastPacketDecoded >= status.LastDeltaPacket &&
+		manager.packeter.LastDecoded() >= status.LastDeltaPacket &&
 		!manager.deltaClosed {
-		manager.DeltaDone()
+		manager.deltaClosed = true
+		close(manager.deltaChan)
 	}
 
-	return *manager.status
+	// take the errors after copying the status, so the status that says
+	// we're done has all of them
+	next := *manager.status
+	next.FileErrors = manager.fileErrors.takeUnsent()
+	return next
 }
 
 func (manager *DestinationManager) QueueFileInfo(fi FileInfo) {
 	manager.stats.RecordFileInfo(fi)
-	manager.fileInfoChan <- fi
+	manager.tally.started(fi)
+	select {
+	case manager.fileInfoChan <- fi:
+	case <-manager.ctx.Done():
+	}
 }
 
 func (manager *DestinationManager) FileInfoDone() {
-	manager.fileInfoClosed = true
-	close(manager.fileInfoChan)
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if !manager.fileInfoClosed {
+		manager.fileInfoClosed = true
+		close(manager.fileInfoChan)
+	}
 }
 
 func (manager *DestinationManager) FileInfoChannel() chan FileInfo {
@@ -105,17 +157,24 @@ func (manager *DestinationManager) QueueSignature(sig Checksum) {
 		return
 	}
 
-	packets := MakePackets(&buff, SignaturePacket)
+	packets := MakePackets(&buff, SignaturePacket, manager.packeter.PacketSize())
 	packetNumber, err := manager.packeter.SendPackets(packets)
 	if err != nil {
 		manager.ReportError(err)
 		return
 	}
 
-	manager.latestSignaturePacket = packetNumber
+	// the workers queue at the same time, keep the highest
+	manager.mutex.Lock()
+	if packetNumber > manager.latestSignaturePacket {
+		manager.latestSignaturePacket = packetNumber
+	}
+	manager.mutex.Unlock()
 }
 
 func (manager *DestinationManager) SignatureDone() {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
 	// record the latestFileInfoPacket as the LastFileInfoPacket
 	manager.status.LastSignaturePacket = manager.latestSignaturePacket
 }
@@ -126,12 +185,20 @@ func (manager *DestinationManager) SignatureChannel() chan Checksum {
 
 func (manager *DestinationManager) QueueDelta(delta Delta) {
 	manager.stats.RecordDelta(delta)
-	manager.deltaChan <- delta
+	manager.tally.delta(delta)
+	select {
+	case manager.deltaChan <- delta:
+	case <-manager.ctx.Done():
+	}
 }
 
 func (manager *DestinationManager) DeltaDone() {
-	manager.deltaClosed = true
-	close(manager.deltaChan)
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if !manager.deltaClosed {
+		manager.deltaClosed = true
+		close(manager.deltaChan)
+	}
 }
 
 func (manager *DestinationManager) DeltaChannel() chan Delta {
@@ -139,8 +206,17 @@ func (manager *DestinationManager) DeltaChannel() chan Delta {
 }
 
 func (manager *DestinationManager) PatchDone() {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
 	manager.status.PatchDone = true
-	manager.done = true
+	if !manager.done {
+		manager.done = true
+		close(manager.finished)
+	}
+}
+
+func (manager *DestinationManager) FilePatched(path string) {
+	manager.tally.patched(path)
 }
 
 func (manager *DestinationManager) Packeter() *Packeter {
@@ -149,28 +225,63 @@ func (manager *DestinationManager) Packeter() *Packeter {
 
 func (manager *DestinationManager) TCPDone() {
 	manager.packeter.Close()
-	manager.tcpdone = true
 }
 
 func (manager *DestinationManager) ReportError(err error) {
-	Debug(fmt.Sprintf("Error reported: %v", err))
-	stack := debug.Stack()
-	manager.err = fmt.Errorf("%s: %s", stack, err)
-	manager.status.Failed = fmt.Sprintf("%s: %s", stack, err)
+	manager.log.Debug("error reported", "error", err, "stack", string(debug.Stack()))
+
+	manager.mutex.Lock()
+	// the first error is the one worth reporting, later ones (like the
+	// packeter closing) are usually fallout from it
+	first := manager.err == nil
+	if first {
+		manager.err = err
+		manager.status.Failed = err.Error()
+	}
+	manager.cancel()
+	manager.mutex.Unlock()
+
+	if first {
+		manager.observer.Error(err)
+	}
+}
+
+func (manager *DestinationManager) ReportFileError(path string, phase string, err error) bool {
+	return manager.fileErrors.report(manager, path, phase, err)
+}
+
+func (manager *DestinationManager) FileErrors() []FileError {
+	return manager.fileErrors.all()
+}
+
+func (manager *DestinationManager) Logger() *slog.Logger {
+	return manager.log
+}
+
+func (manager *DestinationManager) Context() context.Context {
+	return manager.ctx
 }
 
 func (manager *DestinationManager) Error() error {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
 	return manager.err
 }
 
 func (manager *DestinationManager) Done() bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
 	return manager.done
 }
 
-func (manager *DestinationManager) NetDone() bool {
-	return manager.packeter.Done() && manager.tcpdone
+func (manager *DestinationManager) Finished() <-chan struct{} {
+	return manager.finished
 }
 
 func (manager *DestinationManager) Stats() *TransferStats {
 	return manager.stats
 }
+
+func (manager *DestinationManager) Observer() TransferObserver {
+	return manager.observer
+}
@@ -1,14 +1,35 @@
 package transfer
 
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
 type LocalManager struct {
 	fileInfoChan  chan FileInfo
 	signatureChan chan Checksum
 	deltaChan     chan Delta
 
-	done bool
-	err  error
+	// mutex guards done and err
+	mutex sync.Mutex
+	done  bool
+	err   error
+
+	// finished is closed by PatchDone
+	finished chan struct{}
 
 	stats *TransferStats
+
+	log *slog.Logger
+
+	fileErrors *fileErrorList
+
+	observer TransferObserver
+	tally    *fileTally
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // TODO: make these args?
@@ -16,19 +37,33 @@ var FILE_INFO_BUF_SIZE = 10
 var SIGNATURE_BUF_SIZE = 10
 var DELTA_BUF_SIZE = 10
 
-func MakeLocalManager() *LocalManager {
+func MakeLocalManager(opts *Options) *LocalManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	observer := opts.observer()
+	tally := newFileTally(observer, true)
 
 	return &LocalManager{
 		fileInfoChan:  make(chan FileInfo, FILE_INFO_BUF_SIZE),
 		signatureChan: make(chan Checksum, SIGNATURE_BUF_SIZE),
 		deltaChan:     make(chan Delta, DELTA_BUF_SIZE),
-		stats:         NewTransferStats(),
+		finished:      make(chan struct{}),
+		stats:         opts.transferStats(),
+		log:           opts.logger(),
+		fileErrors:    newFileErrorList(opts, tally),
+		observer:      observer,
+		tally:         tally,
+		ctx:           ctx,
+		cancel:        cancel,
 	}
 }
 
 func (manager *LocalManager) QueueFileInfo(fi FileInfo) {
 	manager.stats.RecordFileInfo(fi)
-	manager.fileInfoChan <- fi
+	manager.tally.started(fi)
+	select {
+	case manager.fileInfoChan <- fi:
+	case <-manager.ctx.Done():
+	}
 }
 
 func (manager *LocalManager) FileInfoDone() {
@@ -41,7 +76,10 @@ func (manager *LocalManager) FileInfoChannel() chan FileInfo {
 
 func (manager *LocalManager) QueueSignature(sig Checksum) {
 	manager.stats.RecordSignature(sig)
-	manager.signatureChan <- sig
+	select {
+	case manager.signatureChan <- sig:
+	case <-manager.ctx.Done():
+	}
 }
 
 func (manager *LocalManager) SignatureDone() {
@@ -54,7 +92,11 @@ func (manager *LocalManager) SignatureChannel() chan Checksum {
 
 func (manager *LocalManager) QueueDelta(delta Delta) {
 	manager.stats.RecordDelta(delta)
-	manager.deltaChan <- delta
+	manager.tally.delta(delta)
+	select {
+	case manager.deltaChan <- delta:
+	case <-manager.ctx.Done():
+	}
 }
 
 func (manager *LocalManager) DeltaDone() {
@@ -66,7 +108,16 @@ func (manager *LocalManager) DeltaChannel() chan Delta {
 }
 
 func (manager *LocalManager) PatchDone() {
-	manager.done = true
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if !manager.done {
+		manager.done = true
+		close(manager.finished)
+	}
+}
+
+func (manager *LocalManager) FilePatched(path string) {
+	manager.tally.patched(path)
 }
 
 func (manager *LocalManager) Packeter() *Packeter {
@@ -74,25 +125,59 @@ func (manager *LocalManager) Packeter() *Packeter {
 }
 
 func (manager *LocalManager) ReportError(err error) {
-	manager.err = err
+	manager.mutex.Lock()
+	first := manager.err == nil
+	if first {
+		manager.err = err
+	}
+	manager.cancel()
+	manager.mutex.Unlock()
+
+	if first {
+		manager.observer.Error(err)
+	}
+}
+
+func (manager *LocalManager) ReportFileError(path string, phase string, err error) bool {
+	return manager.fileErrors.report(manager, path, phase, err)
+}
+
+func (manager *LocalManager) FileErrors() []FileError {
+	return manager.fileErrors.all()
+}
+
+func (manager *LocalManager) Logger() *slog.Logger {
+	return manager.log
+}
+
+func (manager *LocalManager) Context() context.Context {
+	return manager.ctx
 }
 
 func (manager *LocalManager) Error() error {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
 	return manager.err
 }
 
 func (manager *LocalManager) Done() bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
 	return manager.done
 }
 
+func (manager *LocalManager) Finished() <-chan struct{} {
+	return manager.finished
+}
+
 func (manager *LocalManager) Stats() *TransferStats {
 	return manager.stats
 }
 
-func (manager *LocalManager) TCPDone() {
-
+func (manager *LocalManager) Observer() TransferObserver {
+	return manager.observer
 }
 
-func (manager *LocalManager) NetDone() bool {
-	return true
+func (manager *LocalManager) TCPDone() {
+
 }
@@ -2,39 +2,67 @@ package transfer
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"errors"
-	"fmt"
+	"log/slog"
 	"runtime/debug"
+	"sync"
 )
 
 type SourceManager struct {
 	packetChan    chan Packet
 	signatureChan chan Checksum
 
+	// mutex guards the fields below and status, the tcp loop and the
+	// pipeline goroutines all use them
+	mutex sync.Mutex
+
 	signatureClosed bool
 
 	latestFileInfoPacket uint64
 	latestDeltaPacket    uint64
 
-	done    bool
-	tcpdone bool
-	err     error
+	done bool
+	err  error
+
+	// finished is closed by PatchDone
+	finished chan struct{}
 
 	packeter *Packeter
 
 	status *SourceTransferStatus
 	stats  *TransferStats
+
+	log *slog.Logger
+
+	fileErrors *fileErrorList
+
+	observer TransferObserver
+	tally    *fileTally
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewSourceManager() *SourceManager {
+func NewSourceManager(opts *Options) *SourceManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	observer := opts.observer()
+	tally := newFileTally(observer, false)
 
 	return &SourceManager{
 		packetChan:    make(chan Packet, 100),
 		signatureChan: make(chan Checksum, SIGNATURE_BUF_SIZE),
-		stats:         NewTransferStats(),
+		stats:         opts.transferStats(),
 		status:        &SourceTransferStatus{},
-		packeter:      NewPacketer(),
+		finished:      make(chan struct{}),
+		packeter:      NewPacketer(opts),
+		log:           opts.logger(),
+		fileErrors:    newFileErrorList(opts, tally),
+		observer:      observer,
+		tally:         tally,
+		ctx:           ctx,
+		cancel:        cancel,
 	}
 }
 
@@ -43,41 +71,57 @@ func NewSourceManager() *SourceManager {
 // as well, because the packeter may need to resend some packets, or delete
 // some sent packets.
 func (manager *SourceManager) ReceiveStatusUpdate(status DestinationTransferStatus) SourceTransferStatus {
-
-	if status.Failed != "" {
+	// the observer hears about the peer's failures once we've unlocked
+	var failed error
+	defer func() {
+		if failed != nil {
+			manager.observer.Error(failed)
+		}
+		manager.fileErrors.fromPeer(status.FileErrors)
+	}()
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	// the peer echoes our own failure back, keep the error we have
+	if status.Failed != "" && manager.err == nil {
 		manager.status.Failed = status.Failed
 		manager.err = errors.New(status.Failed)
+		manager.cancel()
+		failed = manager.err
 	}
 
-	// Record the number of packets the destination is requesting to be resent
-	manager.stats.RecordResentDestinationPackets(
-		len(status.DestinationPacketerStatus.ResendPackets))
-
 	// Tell the packeter about it's counterpart's status. The packeter then
 	// return's it's status, which will be sent by the TCPer on it's next iteration.
 	manager.status.SourcePacketerStatus = manager.packeter.ReceivePacketerStatusUpdate(
 		status.DestinationPacketerStatus)
 
-	// Record the number of packets the source is requesting to be resent
-	manager.stats.RecordResentSourcePackets(
-		len(manager.status.SourcePacketerStatus.ResendPackets))
+	// Record the resend counters of both packeters
+	manager.stats.RecordPacketerStatuses(
+		manager.status.SourcePacketerStatus, status.DestinationPacketerStatus)
 
 	// All signature packets have been decoded, call SignatureDone
 	if status.LastSignaturePacket != 0 &&
-		manager.packeter.LastPacketDecoded >= status.LastSignaturePacket &&
+		manager.packeter.LastDecoded() >= status.LastSignaturePacket &&
 		!manager.signatureClosed {
-		manager.SignatureDone()
+		manager.signatureClosed = true
+		close(manager.signatureChan)
 	}
 
 	if status.PatchDone {
-		manager.PatchDone()
+		manager.finish()
 	}
 
-	return *manager.status
+	// take the errors after copying the status, so the status that says
+	// we're done has all of them
+	next := *manager.status
+	next.FileErrors = manager.fileErrors.takeUnsent()
+	return next
 }
 
 func (manager *SourceManager) QueueFileInfo(fi FileInfo) {
 	manager.stats.RecordFileInfo(fi)
+	manager.tally.started(fi)
 
 	var buff bytes.Buffer
 	encoder := gob.NewEncoder(&buff)
@@ -86,18 +130,22 @@ func (manager *SourceManager) QueueFileInfo(fi FileInfo) {
 		return
 	}
 
-	packets := MakePackets(&buff, FileInfoPacket)
+	packets := MakePackets(&buff, FileInfoPacket, manager.packeter.PacketSize())
 	packetNumber, err := manager.packeter.SendPackets(packets)
 	if err != nil {
 		manager.ReportError(err)
 		return
 	}
 
+	manager.mutex.Lock()
 	manager.latestFileInfoPacket = packetNumber
+	manager.mutex.Unlock()
 
 }
 
 func (manager *SourceManager) FileInfoDone() {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
 	// record the latestFileInfoPacket as the LastFileInfoPacket
 	manager.status.LastFileInfoPacket = manager.latestFileInfoPacket
 }
@@ -108,12 +156,19 @@ func (manager *SourceManager) FileInfoChannel() chan FileInfo {
 
 func (manager *SourceManager) QueueSignature(sig Checksum) {
 	manager.stats.RecordSignature(sig)
-	manager.signatureChan <- sig
+	select {
+	case manager.signatureChan <- sig:
+	case <-manager.ctx.Done():
+	}
 }
 
 func (manager *SourceManager) SignatureDone() {
-	manager.signatureClosed = true
-	close(manager.signatureChan)
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if !manager.signatureClosed {
+		manager.signatureClosed = true
+		close(manager.signatureChan)
+	}
 }
 
 func (manager *SourceManager) SignatureChannel() chan Checksum {
@@ -122,6 +177,7 @@ func (manager *SourceManager) SignatureChannel() chan Checksum {
 
 func (manager *SourceManager) QueueDelta(delta Delta) {
 	manager.stats.RecordDelta(delta)
+	manager.tally.delta(delta)
 
 	var buff bytes.Buffer
 	encoder := gob.NewEncoder(&buff)
@@ -130,17 +186,24 @@ func (manager *SourceManager) QueueDelta(delta Delta) {
 		return
 	}
 
-	packets := MakePackets(&buff, DeltaPacket)
+	packets := MakePackets(&buff, DeltaPacket, manager.packeter.PacketSize())
 	packetNumber, err := manager.packeter.SendPackets(packets)
 	if err != nil {
 		manager.ReportError(err)
 		return
 	}
 
-	manager.latestDeltaPacket = packetNumber
+	// the workers queue at the same time, keep the highest
+	manager.mutex.Lock()
+	if packetNumber > manager.latestDeltaPacket {
+		manager.latestDeltaPacket = packetNumber
+	}
+	manager.mutex.Unlock()
 }
 
 func (manager *SourceManager) DeltaDone() {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
 	// record the latestDeltaPacket as the LastDeltaPacket
 	manager.status.LastDeltaPacket = manager.latestDeltaPacket
 }
@@ -150,7 +213,20 @@ func (manager *SourceManager) DeltaChannel() chan Delta {
 }
 
 func (manager *SourceManager) PatchDone() {
-	manager.done = true
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	manager.finish()
+}
+
+// the source completes files on their EOF delta, it doesn't patch
+func (manager *SourceManager) FilePatched(path string) {}
+
+// finish must be called with the mutex held
+func (manager *SourceManager) finish() {
+	if !manager.done {
+		manager.done = true
+		close(manager.finished)
+	}
 }
 
 func (manager *SourceManager) Packeter() *Packeter {
@@ -159,29 +235,63 @@ func (manager *SourceManager) Packeter() *Packeter {
 
 func (manager *SourceManager) TCPDone() {
 	manager.packeter.Close()
-	manager.tcpdone = true
 }
 
 func (manager *SourceManager) ReportError(err error) {
-	Debug(fmt.Sprintf("Error reported: %v", err))
-	stack := debug.Stack()
-	manager.err = fmt.Errorf("%s: %s", stack, err)
-	manager.status.Failed = fmt.Sprintf("%s: %s", stack, err)
+	manager.log.Debug("error reported", "error", err, "stack", string(debug.Stack()))
+
+	manager.mutex.Lock()
+	// the first error is the one worth reporting, later ones (like the
+	// packeter closing) are usually fallout from it
+	first := manager.err == nil
+	if first {
+		manager.err = err
+		manager.status.Failed = err.Error()
+	}
+	manager.cancel()
+	manager.mutex.Unlock()
+
+	if first {
+		manager.observer.Error(err)
+	}
+}
+
+func (manager *SourceManager) ReportFileError(path string, phase string, err error) bool {
+	return manager.fileErrors.report(manager, path, phase, err)
+}
 
+func (manager *SourceManager) FileErrors() []FileError {
+	return manager.fileErrors.all()
+}
+
+func (manager *SourceManager) Logger() *slog.Logger {
+	return manager.log
+}
+
+func (manager *SourceManager) Context() context.Context {
+	return manager.ctx
 }
 
 func (manager *SourceManager) Error() error {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
 	return manager.err
 }
 
 func (manager *SourceManager) Done() bool {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
 	return manager.done
 }
 
-func (manager *SourceManager) NetDone() bool {
-	return manager.packeter.Done() && manager.tcpdone
+func (manager *SourceManager) Finished() <-chan struct{} {
+	return manager.finished
 }
 
 func (manager *SourceManager) Stats() *TransferStats {
 	return manager.stats
 }
+
+func (manager *SourceManager) Observer() TransferObserver {
+	return manager.observer
+}
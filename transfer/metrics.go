@@ -0,0 +1,314 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Why a request was rejected, the reason label of
+// gosync_requests_rejected_total
+const (
+	REJECTED_HOST           = "host"
+	REJECTED_AUTHENTICATION = "authentication"
+	REJECTED_ACCESS         = "access"
+	REJECTED_LIMIT          = "limit"
+	REJECTED_SHUTDOWN       = "shutdown"
+	REJECTED_SETUP          = "setup"
+	REJECTED_INVALID        = "invalid"
+	REJECTED_DUPLICATE      = "duplicate"
+	REJECTED_HANDSHAKES     = "handshakes"
+)
+
+// DURATION_BUCKETS are the upper bounds, in seconds, of the transfer
+// duration histogram
+var DURATION_BUCKETS = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// Metrics adds up the stats of every transfer the daemon ran, for
+// Prometheus.  Transfers that don't name a module are recorded with
+// module="".
+type Metrics struct {
+	mutex sync.Mutex
+
+	transfers map[transferLabels]int64
+	rejected  map[rejectionLabels]int64
+	totals    map[moduleLabels]*transferTotals
+}
+
+type transferLabels struct {
+	Module    string
+	Direction string
+	State     string
+}
+
+type rejectionLabels struct {
+	Module string
+	Reason string
+}
+
+type moduleLabels struct {
+	Module    string
+	Direction string
+}
+
+// transferTotals are the counters and histogram of one module and
+// direction
+type transferTotals struct {
+	bytesSent   int64
+	bytesSame   int64
+	files       int64
+	directories int64
+	symlinks    int64
+
+	resentPackets    int64
+	spuriousResends  int64
+	recoveredPackets int64
+	forgedPackets    int64
+	replayedPackets  int64
+
+	// durationBuckets[i] counts the transfers that took at most
+	// DURATION_BUCKETS[i]
+	durationBuckets []int64
+	durationSum     float64
+	durationCount   int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		transfers: map[transferLabels]int64{},
+		rejected:  map[rejectionLabels]int64{},
+		totals:    map[moduleLabels]*transferTotals{},
+	}
+}
+
+// RecordTransfer adds a finished transfer
+func (metrics *Metrics) RecordTransfer(info TransferInfo) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.transfers[transferLabels{info.Module, info.Direction, info.State}]++
+
+	labels := moduleLabels{info.Module, info.Direction}
+	totals, ok := metrics.totals[labels]
+	if !ok {
+		totals = &transferTotals{durationBuckets: make([]int64, len(DURATION_BUCKETS))}
+		metrics.totals[labels] = totals
+	}
+
+	if stats := info.Stats; stats != nil {
+		totals.bytesSent += stats.BytesSent
+		totals.bytesSame += stats.BytesSame
+		totals.files += stats.Files
+		totals.directories += stats.Directories
+		totals.symlinks += stats.Symlinks
+
+		if net := stats.NetStats; net != nil {
+			totals.resentPackets += net.ResentSourcePackets + net.ResentDestinationPackets
+			totals.spuriousResends += net.SpuriousSourceResends + net.SpuriousDestinationResends
+			totals.recoveredPackets += net.RecoveredSourcePackets + net.RecoveredDestinationPackets
+			totals.forgedPackets += net.ForgedSourcePackets + net.ForgedDestinationPackets
+			totals.replayedPackets += net.ReplayedSourcePackets + net.ReplayedDestinationPackets
+		}
+	}
+
+	if info.Finished != nil {
+		seconds := info.Finished.Sub(info.Started).Seconds()
+		for i, bound := range DURATION_BUCKETS {
+			if seconds <= bound {
+				totals.durationBuckets[i]++
+			}
+		}
+		totals.durationSum += seconds
+		totals.durationCount++
+	}
+}
+
+// RecordRejection adds a request that was turned away for reason, one of
+// the REJECTED_ constants
+func (metrics *Metrics) RecordRejection(module string, reason string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.rejected[rejectionLabels{module, reason}]++
+}
+
+// Write writes the metrics in the Prometheus text format.  running and
+// queued are the daemon's current transfers, for the gauges.
+func (metrics *Metrics) Write(w io.Writer, running []TransferInfo, queued int) error {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	out := &metricsWriter{w: w}
+
+	out.header("gosync_transfers_total", "counter", "Transfers the daemon finished, by state.")
+	transfers := make([]transferLabels, 0, len(metrics.transfers))
+	for labels := range metrics.transfers {
+		transfers = append(transfers, labels)
+	}
+	sort.Slice(transfers, func(i, j int) bool {
+		a, b := transfers[i], transfers[j]
+		if a.Module != b.Module {
+			return a.Module < b.Module
+		}
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		return a.State < b.State
+	})
+	for _, labels := range transfers {
+		out.sample("gosync_transfers_total",
+			[]string{"module", labels.Module, "direction", labels.Direction, "state", labels.State},
+			float64(metrics.transfers[labels]))
+	}
+
+	out.header("gosync_requests_rejected_total", "counter", "Transfer requests the daemon turned away, by reason.")
+	rejected := make([]rejectionLabels, 0, len(metrics.rejected))
+	for labels := range metrics.rejected {
+		rejected = append(rejected, labels)
+	}
+	sort.Slice(rejected, func(i, j int) bool {
+		if rejected[i].Module != rejected[j].Module {
+			return rejected[i].Module < rejected[j].Module
+		}
+		return rejected[i].Reason < rejected[j].Reason
+	})
+	for _, labels := range rejected {
+		out.sample("gosync_requests_rejected_total",
+			[]string{"module", labels.Module, "reason", labels.Reason},
+			float64(metrics.rejected[labels]))
+	}
+
+	modules := make([]moduleLabels, 0, len(metrics.totals))
+	for labels := range metrics.totals {
+		modules = append(modules, labels)
+	}
+	sort.Slice(modules, func(i, j int) bool {
+		if modules[i].Module != modules[j].Module {
+			return modules[i].Module < modules[j].Module
+		}
+		return modules[i].Direction < modules[j].Direction
+	})
+
+	counters := []struct {
+		name  string
+		help  string
+		value func(*transferTotals) int64
+	}{
+		{"gosync_bytes_sent_total", "Bytes of file contents sent.",
+			func(t *transferTotals) int64 { return t.bytesSent }},
+		{"gosync_bytes_same_total", "Bytes of file contents the destination already had.",
+			func(t *transferTotals) int64 { return t.bytesSame }},
+		{"gosync_files_total", "Files synced.",
+			func(t *transferTotals) int64 { return t.files }},
+		{"gosync_directories_total", "Directories synced.",
+			func(t *transferTotals) int64 { return t.directories }},
+		{"gosync_symlinks_total", "Symlinks synced.",
+			func(t *transferTotals) int64 { return t.symlinks }},
+		{"gosync_resent_packets_total", "Packets resent by either side.",
+			func(t *transferTotals) int64 { return t.resentPackets }},
+		{"gosync_spurious_resends_total", "Resent packets that had already arrived.",
+			func(t *transferTotals) int64 { return t.spuriousResends }},
+		{"gosync_recovered_packets_total", "Packets rebuilt from parity packets.",
+			func(t *transferTotals) int64 { return t.recoveredPackets }},
+		{"gosync_forged_packets_total", "Packets dropped because they failed authentication.",
+			func(t *transferTotals) int64 { return t.forgedPackets }},
+		{"gosync_replayed_packets_total", "Packets dropped because they were replayed.",
+			func(t *transferTotals) int64 { return t.replayedPackets }},
+	}
+	for _, counter := range counters {
+		out.header(counter.name, "counter", counter.help)
+		for _, labels := range modules {
+			out.sample(counter.name,
+				[]string{"module", labels.Module, "direction", labels.Direction},
+				float64(counter.value(metrics.totals[labels])))
+		}
+	}
+
+	out.header("gosync_transfer_duration_seconds", "histogram", "How long finished transfers took.")
+	for _, labels := range modules {
+		totals := metrics.totals[labels]
+		for i, bound := range DURATION_BUCKETS {
+			out.sample("gosync_transfer_duration_seconds_bucket",
+				[]string{"module", labels.Module, "direction", labels.Direction, "le", formatFloat(bound)},
+				float64(totals.durationBuckets[i]))
+		}
+		out.sample("gosync_transfer_duration_seconds_bucket",
+			[]string{"module", labels.Module, "direction", labels.Direction, "le", "+Inf"},
+			float64(totals.durationCount))
+		out.sample("gosync_transfer_duration_seconds_sum",
+			[]string{"module", labels.Module, "direction", labels.Direction},
+			totals.durationSum)
+		out.sample("gosync_transfer_duration_seconds_count",
+			[]string{"module", labels.Module, "direction", labels.Direction},
+			float64(totals.durationCount))
+	}
+
+	// every module that ran keeps a sample, at 0 when it's idle, so the
+	// series doesn't go missing between transfers
+	active := map[string]int{"": 0}
+	for labels := range metrics.totals {
+		active[labels.Module] = 0
+	}
+	for _, info := range running {
+		active[info.Module]++
+	}
+	activeModules := make([]string, 0, len(active))
+	for module := range active {
+		activeModules = append(activeModules, module)
+	}
+	sort.Strings(activeModules)
+
+	out.header("gosync_active_transfers", "gauge", "Transfers running now.")
+	for _, module := range activeModules {
+		out.sample("gosync_active_transfers", []string{"module", module}, float64(active[module]))
+	}
+
+	out.header("gosync_queued_requests", "gauge", "Transfer requests waiting for a connection slot.")
+	out.sample("gosync_queued_requests", nil, float64(queued))
+
+	return out.err
+}
+
+// metricsWriter writes the text format, keeping the first error
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (out *metricsWriter) printf(format string, a ...interface{}) {
+	if out.err == nil {
+		_, out.err = fmt.Fprintf(out.w, format, a...)
+	}
+}
+
+func (out *metricsWriter) header(name string, kind string, help string) {
+	out.printf("# HELP %v %v\n", name, help)
+	out.printf("# TYPE %v %v\n", name, kind)
+}
+
+// sample writes one value, labels are name, value pairs
+func (out *metricsWriter) sample(name string, labels []string, value float64) {
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=\"%v\"", labels[i], escapeLabel(labels[i+1])))
+	}
+
+	if len(pairs) > 0 {
+		out.printf("%v{%v} %v\n", name, strings.Join(pairs, ","), formatFloat(value))
+	} else {
+		out.printf("%v %v\n", name, formatFloat(value))
+	}
+}
+
+func escapeLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,125 @@
+package transfer
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	metrics := NewMetrics()
+
+	started := time.Now()
+	finished := started.Add(2 * time.Second)
+	stats := NewTransferStats()
+	stats.Files = 3
+	stats.BytesSent = 100
+	stats.BytesSame = 50
+	stats.NetStats.ResentSourcePackets = 2
+	stats.NetStats.ResentDestinationPackets = 1
+
+	metrics.RecordTransfer(TransferInfo{
+		Module:    "backups",
+		Direction: "push",
+		State:     TRANSFER_DONE,
+		Started:   started,
+		Finished:  &finished,
+		Stats:     stats,
+	})
+	metrics.RecordTransfer(TransferInfo{
+		Module:    "backups",
+		Direction: "push",
+		State:     TRANSFER_FAILED,
+		Started:   started,
+		Finished:  &finished,
+		Stats:     stats,
+	})
+	metrics.RecordRejection("backups", REJECTED_LIMIT)
+	metrics.RecordRejection("", REJECTED_HOST)
+
+	var out bytes.Buffer
+	running := []TransferInfo{{Module: "backups"}, {Module: `we"ird`}}
+	if err := metrics.Write(&out, running, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`# TYPE gosync_transfers_total counter`,
+		`gosync_transfers_total{module="backups",direction="push",state="done"} 1`,
+		`gosync_transfers_total{module="backups",direction="push",state="failed"} 1`,
+		`gosync_requests_rejected_total{module="",reason="host"} 1`,
+		`gosync_requests_rejected_total{module="backups",reason="limit"} 1`,
+		`gosync_bytes_sent_total{module="backups",direction="push"} 200`,
+		`gosync_bytes_same_total{module="backups",direction="push"} 100`,
+		`gosync_files_total{module="backups",direction="push"} 6`,
+		`gosync_resent_packets_total{module="backups",direction="push"} 6`,
+		`# TYPE gosync_transfer_duration_seconds histogram`,
+		`gosync_transfer_duration_seconds_bucket{module="backups",direction="push",le="1"} 0`,
+		`gosync_transfer_duration_seconds_bucket{module="backups",direction="push",le="5"} 2`,
+		`gosync_transfer_duration_seconds_bucket{module="backups",direction="push",le="+Inf"} 2`,
+		`gosync_transfer_duration_seconds_sum{module="backups",direction="push"} 4`,
+		`gosync_transfer_duration_seconds_count{module="backups",direction="push"} 2`,
+		`gosync_active_transfers{module="backups"} 1`,
+		`gosync_active_transfers{module="we\"ird"} 1`,
+		`gosync_active_transfers{module=""} 0`,
+		`gosync_queued_requests 4`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("metrics should have %v:\n%v", line, out.String())
+		}
+	}
+}
+
+func TestMetricsIdleModules(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.RecordTransfer(TransferInfo{Module: "backups", Direction: "push", State: TRANSFER_DONE})
+
+	// nothing running, the modules that ran are still there at 0
+	var out bytes.Buffer
+	if err := metrics.Write(&out, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`gosync_active_transfers{module=""} 0`,
+		`gosync_active_transfers{module="backups"} 0`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("metrics should have %v:\n%v", line, out.String())
+		}
+	}
+}
+
+func TestAPIMetrics(t *testing.T) {
+	server := NewServer(&DaemonConfig{})
+	handler := server.APIHandler()
+
+	active, _ := server.startTransfer(TransferInfo{
+		RequestID: uuid.New(),
+		Direction: Incoming.String(),
+	})
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("/metrics should return 200 not %v", recorder.Code)
+	}
+	if !strings.Contains(recorder.Body.String(), `gosync_active_transfers{module=""} 1`) {
+		t.Errorf("/metrics should count the running transfer:\n%v", recorder.Body.String())
+	}
+
+	server.finishTransfer(active, nil, nil)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	if !strings.Contains(body, `gosync_transfers_total{module="",direction="pull",state="done"} 1`) {
+		t.Errorf("/metrics should count the finished transfer:\n%v", body)
+	}
+	if !strings.Contains(body, `gosync_active_transfers{module=""} 0`) {
+		t.Errorf("/metrics should have no running transfers rather than no sample:\n%v", body)
+	}
+}
@@ -0,0 +1,119 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// Module is a named directory the daemon serves.  Requests for a module
+// name a path relative to its root and can't reach outside it.
+type Module struct {
+	Name string
+	Path string
+
+	// ReadOnly modules can be pulled from but not pushed to
+	ReadOnly bool
+
+	// AllowedUsers are the authenticated users that may use the
+	// module, empty allows anyone the daemon accepts
+	AllowedUsers []string
+
+	// HostAccess filters the addresses that may use the module, on top
+	// of the daemon's own filter
+	HostAccess HostAccess
+
+	// Chroot confines transfers to Path with chroot, and RunAs runs them
+	// as another user.  Either runs transfers in a worker process, see
+	// WorkerJob.  Without RunAs transfers keep the daemon's privileges,
+	// which preserving ownership needs.  Chroot needs RunAs with a uid
+	// other than 0 though, root can get back out of a chroot.
+	Chroot bool
+	RunAs  *Credentials
+
+	// MaxConnections caps the transfers running at once in the module,
+	// 0 means no limit
+	MaxConnections int
+}
+
+// Resolve returns the absolute path of subpath inside the module.  Any
+// ".." component is refused rather than cleaned away, so a request can
+// never name something outside the root.
+func (module *Module) Resolve(subpath string) (string, error) {
+	for _, part := range strings.Split(subpath, "/") {
+		if part == ".." {
+			return "", errors.New(fmt.Sprintf(
+				"path escapes module %v: %v", module.Name, subpath))
+		}
+	}
+
+	return path.Join(module.Path, path.Clean("/"+subpath)), nil
+}
+
+// name returns the module's name, "" without a module
+func (module *Module) name() string {
+	if module == nil {
+		return ""
+	}
+	return module.Name
+}
+
+// Allows returns whether user may use the module
+func (module *Module) Allows(user string) bool {
+	if len(module.AllowedUsers) == 0 {
+		return true
+	}
+	for _, allowed := range module.AllowedUsers {
+		if allowed == user {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRequest works out which module a request is for and the local
+// path it names, and checks the user at ip may use it that way.  Without
+// modules configured requests name absolute paths directly.
+func resolveRequest(req *Request, user string, ip net.IP, modules map[string]*Module) (*Module, string, error) {
+	if req.Direction != Incoming && req.Direction != Outgoing {
+		return nil, "", errors.New(fmt.Sprintf("unknown direction: %v", req.Direction))
+	}
+
+	remotePath := req.Destination
+	if req.Direction == Incoming {
+		remotePath = req.Path
+	}
+
+	if len(modules) == 0 {
+		if req.Module != "" {
+			return nil, "", errors.New(fmt.Sprintf("unknown module: %v", req.Module))
+		}
+		return nil, remotePath, nil
+	}
+
+	module, ok := modules[req.Module]
+	if !ok {
+		return nil, "", errors.New(fmt.Sprintf("unknown module: %v", req.Module))
+	}
+
+	if !module.HostAccess.Allows(ip) {
+		return nil, "", errors.New(fmt.Sprintf("host not allowed to use module %v", module.Name))
+	}
+
+	if !module.Allows(user) {
+		return nil, "", errors.New(fmt.Sprintf("access to module %v denied", module.Name))
+	}
+
+	if module.ReadOnly && req.Direction == Outgoing {
+		return nil, "", errors.New(fmt.Sprintf("module %v is read only", module.Name))
+	}
+
+	resolved, err := module.Resolve(remotePath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return module, resolved, nil
+}
@@ -0,0 +1,114 @@
+package transfer
+
+import (
+	"net"
+	"testing"
+)
+
+func TestModuleResolve(t *testing.T) {
+	module := &Module{Name: "backups", Path: "/srv/backups"}
+
+	for subpath, expected := range map[string]string{
+		"":        "/srv/backups",
+		"a/b":     "/srv/backups/a/b",
+		"/a/./b/": "/srv/backups/a/b",
+		"a..b/c":  "/srv/backups/a..b/c",
+	} {
+		resolved, err := module.Resolve(subpath)
+		if err != nil || resolved != expected {
+			t.Errorf("%q should resolve to %v not %v %v", subpath, expected, resolved, err)
+		}
+	}
+
+	for _, subpath := range []string{"..", "../etc", "a/../../etc", "a/.."} {
+		if resolved, err := module.Resolve(subpath); err == nil {
+			t.Errorf("%q should be refused, not resolved to %v", subpath, resolved)
+		}
+	}
+}
+
+func TestResolveRequest(t *testing.T) {
+	modules := map[string]*Module{
+		"backups": {Name: "backups", Path: "/srv/backups", AllowedUsers: []string{"alice"}},
+		"mirror":  {Name: "mirror", Path: "/srv/mirror", ReadOnly: true},
+	}
+
+	push := &Request{Direction: Outgoing, Path: "/home/alice", Destination: "alice", Module: "backups"}
+	if _, path, err := resolveRequest(push, "alice", nil, modules); err != nil || path != "/srv/backups/alice" {
+		t.Errorf("push to backups should resolve to /srv/backups/alice not %v %v", path, err)
+	}
+	if _, _, err := resolveRequest(push, "bob", nil, modules); err == nil {
+		t.Error("bob isn't allowed to use backups")
+	}
+
+	pull := &Request{Direction: Incoming, Path: "debian", Destination: "/home/bob", Module: "mirror"}
+	if _, path, err := resolveRequest(pull, "bob", nil, modules); err != nil || path != "/srv/mirror/debian" {
+		t.Errorf("pull from mirror should resolve to /srv/mirror/debian not %v %v", path, err)
+	}
+
+	push = &Request{Direction: Outgoing, Path: "/home/bob", Destination: "debian", Module: "mirror"}
+	if _, _, err := resolveRequest(push, "bob", nil, modules); err == nil {
+		t.Error("mirror is read only")
+	}
+
+	lan, _ := ParseHostAccess([]string{"10.0.0.0/8"}, nil)
+	modules["mirror"].HostAccess = lan
+	if _, _, err := resolveRequest(pull, "bob", net.ParseIP("192.0.2.1"), modules); err == nil {
+		t.Error("hosts outside the module's allow list should be refused")
+	}
+	if _, _, err := resolveRequest(pull, "bob", net.ParseIP("10.1.1.1"), modules); err != nil {
+		t.Errorf("hosts in the module's allow list should be let in: %v", err)
+	}
+
+	absolute := &Request{Direction: Outgoing, Path: "/home/bob", Destination: "/etc"}
+	if _, _, err := resolveRequest(absolute, "bob", nil, modules); err == nil {
+		t.Error("requests must name a module when modules are configured")
+	}
+	if _, path, err := resolveRequest(absolute, "", nil, nil); err != nil || path != "/etc" {
+		t.Errorf("without modules the path should be used as is, not %v %v", path, err)
+	}
+}
+
+func TestOptionsPathsStayInside(t *testing.T) {
+	opts := Options{Path: "/src", Destination: "/dst"}
+
+	for relPath, expected := range map[string]string{
+		".":            "/dst",
+		"a/b":          "/dst/a/b",
+		"../../etc":    "/dst/etc",
+		"a/../../../x": "/dst/x",
+		"/etc/passwd":  "/dst/etc/passwd",
+	} {
+		if path := opts.DestinationPath(relPath); path != expected {
+			t.Errorf("DestinationPath(%q) should be %v not %v", relPath, expected, path)
+		}
+	}
+
+	if path := opts.SourcePath("../etc/shadow"); path != "/src/etc/shadow" {
+		t.Errorf("SourcePath should stay under /src not %v", path)
+	}
+}
+
+func TestChrootNeedsRunAs(t *testing.T) {
+	module := &Module{Name: "backups", Path: "/srv/backups", Chroot: true}
+	opts := &Options{Path: "/remote", Destination: "/srv/backups/a"}
+
+	if _, err := newWorkerJob(module, Outgoing, opts); err == nil {
+		t.Error("a chroot without RunAs should be refused, root can leave it")
+	}
+
+	// nor is running as root, uid: root and uid: 0 both end up here
+	module.RunAs = &Credentials{UID: 0, GID: 65534}
+	if _, err := newWorkerJob(module, Outgoing, opts); err == nil {
+		t.Error("a chroot running as root should be refused, root can leave it")
+	}
+
+	module.RunAs = &Credentials{UID: 65534, GID: 65534}
+	job, err := newWorkerJob(module, Outgoing, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Chroot != "/srv/backups" || job.Opts.Destination != "/a" {
+		t.Errorf("the job should chroot into the module, not %v with %v", job.Chroot, job.Opts.Destination)
+	}
+}
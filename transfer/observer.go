@@ -0,0 +1,143 @@
+package transfer
+
+import (
+	"sync"
+)
+
+// TransferObserver is told what a transfer is doing as it happens, set it
+// with Options.Observer.  Each side calls its own observer from the
+// transfer's goroutines, so it has to be safe to call concurrently and
+// shouldn't block.
+type TransferObserver interface {
+	// FileStarted is called when a regular file is queued, on the
+	// destination when its FileInfo arrives
+	FileStarted(fi FileInfo)
+	// FileSkipped is called for the files skipped with
+	// Options.ContinueOnError, on both sides whichever side failed
+	FileSkipped(fileErr FileError)
+	// FileCompleted is called when the last delta of the file at path
+	// is made on the source, or once the file is written on the
+	// destination.  literal bytes were sent and matched bytes were
+	// already at the destination.
+	FileCompleted(path string, literal int64, matched int64)
+	// DirectoryCreated is called by the destination when it makes the
+	// directory at path
+	DirectoryCreated(path string)
+	// Error is called with the errors that fail the transfer
+	Error(err error)
+	// TransferFinished is called once every goroutine of the transfer
+	// has stopped, with what the Sync function returns.  That can be
+	// after it returns, when a failed transfer is slow to stop.
+	TransferFinished(stats *TransferStats, err error)
+}
+
+// NopObserver does nothing, embed it to observe only some events
+type NopObserver struct{}
+
+func (NopObserver) FileStarted(fi FileInfo)                                 {}
+func (NopObserver) FileSkipped(fileErr FileError)                           {}
+func (NopObserver) FileCompleted(path string, literal int64, matched int64) {}
+func (NopObserver) DirectoryCreated(path string)                            {}
+func (NopObserver) Error(err error)                                         {}
+func (NopObserver) TransferFinished(stats *TransferStats, err error)        {}
+
+// observer returns the transfer's observer, see Observer
+func (opts Options) observer() TransferObserver {
+	if opts.Observer != nil {
+		return opts.Observer
+	}
+	return NopObserver{}
+}
+
+// fileTally adds up the bytes of the files a manager started, so its
+// observer can be told about them when they're completed
+type fileTally struct {
+	mutex sync.Mutex
+
+	observer TransferObserver
+	files    map[string]*fileBytes
+	// patching tallies complete files when they're patched rather than
+	// on their EOF delta, for the sides that write them
+	patching bool
+}
+
+type fileBytes struct {
+	literal int64
+	matched int64
+}
+
+func newFileTally(observer TransferObserver, patching bool) *fileTally {
+	return &fileTally{
+		observer: observer,
+		files:    make(map[string]*fileBytes),
+		patching: patching,
+	}
+}
+
+// started is called with every FileInfo the manager queues
+func (tally *fileTally) started(fi FileInfo) {
+	if !fi.Mode.IsRegular() {
+		return
+	}
+
+	tally.mutex.Lock()
+	tally.files[fi.RelPath] = &fileBytes{}
+	tally.mutex.Unlock()
+
+	tally.observer.FileStarted(fi)
+}
+
+// delta is called with every Delta the manager queues.  A file can get
+// more than one EOF delta, only the first completes it unless the tally
+// is patching.
+func (tally *fileTally) delta(delta Delta) {
+	tally.mutex.Lock()
+	tallied, ok := tally.files[delta.Path]
+	if !ok {
+		tally.mutex.Unlock()
+		return
+	}
+	if delta.Skip {
+		// the file's been reported, it's skipped rather than completed
+		delete(tally.files, delta.Path)
+		tally.mutex.Unlock()
+		return
+	}
+
+	tallied.literal += int64(len(delta.Content))
+	if delta.NoOp {
+		tallied.matched += int64(delta.Len)
+	}
+	if !delta.EOF || tally.patching {
+		tally.mutex.Unlock()
+		return
+	}
+	delete(tally.files, delta.Path)
+	tally.mutex.Unlock()
+
+	tally.observer.FileCompleted(delta.Path, tallied.literal, tallied.matched)
+}
+
+// patched is called once the file at path has been written, it completes
+// it if the tally is patching
+func (tally *fileTally) patched(path string) {
+	tally.mutex.Lock()
+	tallied, ok := tally.files[path]
+	if !ok || !tally.patching {
+		tally.mutex.Unlock()
+		return
+	}
+	delete(tally.files, path)
+	tally.mutex.Unlock()
+
+	tally.observer.FileCompleted(path, tallied.literal, tallied.matched)
+}
+
+// skipped is called with the FileErrors of both sides
+func (tally *fileTally) skipped(fileErr FileError) {
+	tally.mutex.Lock()
+	delete(tally.files, fileErr.Path)
+	tally.mutex.Unlock()
+
+	tally.observer.FileSkipped(fileErr)
+}
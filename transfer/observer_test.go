@@ -0,0 +1,387 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingObserver records the events it's told about as strings
+type recordingObserver struct {
+	mutex  sync.Mutex
+	events []string
+
+	errors   int
+	finished int
+	stats    *TransferStats
+	err      error
+}
+
+func (observer *recordingObserver) record(format string, args ...interface{}) {
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+	observer.events = append(observer.events, fmt.Sprintf(format, args...))
+}
+
+func (observer *recordingObserver) FileStarted(fi FileInfo) {
+	observer.record("started %v", fi.RelPath)
+}
+
+func (observer *recordingObserver) FileSkipped(fileErr FileError) {
+	observer.record("skipped %v", fileErr.Path)
+}
+
+func (observer *recordingObserver) FileCompleted(path string, literal int64, matched int64) {
+	observer.record("completed %v %v %v", path, literal, matched)
+}
+
+func (observer *recordingObserver) DirectoryCreated(path string) {
+	observer.record("created %v", path)
+}
+
+func (observer *recordingObserver) Error(err error) {
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+	observer.errors++
+}
+
+func (observer *recordingObserver) TransferFinished(stats *TransferStats, err error) {
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+	observer.finished++
+	observer.stats = stats
+	observer.err = err
+}
+
+// assertEvents checks the observer got the expected events, in any order
+func (observer *recordingObserver) assertEvents(t *testing.T, side string, expected ...string) {
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+
+	events := append([]string{}, observer.events...)
+	sort.Strings(events)
+	sort.Strings(expected)
+	if fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Errorf("%v should have seen %q not %q", side, expected, events)
+	}
+	if observer.finished != 1 {
+		t.Errorf("%v should have finished once, not %v times", side, observer.finished)
+	}
+}
+
+func TestObserverLocal(t *testing.T) {
+	source, destination := makeFileErrorDirs(t)
+	defer os.RemoveAll(source)
+	defer os.RemoveAll(destination)
+
+	makeFiles([]SyncTestCaseFile{
+		{RelPath: "sub/d", Pieces: []SyncTestCaseFilePiece{{'d', 10}}},
+	}, source)
+	makeFiles([]SyncTestCaseFile{
+		{RelPath: "a", Pieces: []SyncTestCaseFilePiece{{'a', 10}}},
+	}, destination)
+
+	observer := &recordingObserver{}
+	opts := &Options{
+		Path:            source,
+		Destination:     destination,
+		BlockSize:       10,
+		ContinueOnError: true,
+		Observer:        observer,
+	}
+
+	_, err := SyncLocal(context.Background(), opts)
+	assertPartial(t, "local", err)
+
+	// a's first block was already there, b and c are skipped
+	observer.assertEvents(t, "local",
+		"started a", "completed a 15 10",
+		"started b", "skipped b",
+		"skipped c",
+		"created sub",
+		"started sub/d", "completed sub/d 10 0")
+
+	if observer.err != err || observer.stats == nil || observer.errors != 0 {
+		t.Errorf("the observer should have finished with %v, not %v", err, observer.err)
+	}
+}
+
+func TestObserverError(t *testing.T) {
+	source, destination := makeFileErrorDirs(t)
+	defer os.RemoveAll(source)
+	defer os.RemoveAll(destination)
+
+	observer := &recordingObserver{}
+	opts := &Options{Path: source, Destination: destination, BlockSize: 10, Observer: observer}
+
+	_, err := SyncLocal(context.Background(), opts)
+	if err == nil {
+		t.Fatal("sync without ContinueOnError should fail")
+	}
+	if observer.errors != 1 || observer.finished != 1 || observer.err != err {
+		t.Errorf("the observer should have seen the error once and finished with it, "+
+			"not %v errors and %v", observer.errors, observer.err)
+	}
+}
+
+func TestObserverNet(t *testing.T) {
+	source, destination := makeFileErrorDirs(t)
+	defer os.RemoveAll(source)
+	defer os.RemoveAll(destination)
+
+	opts := Options{
+		Path:            source,
+		Destination:     destination,
+		BlockSize:       10,
+		Transport:       TCPTransport,
+		ContinueOnError: true,
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	sourceObserver := &recordingObserver{}
+	sourceErr := make(chan error)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			sourceErr <- err
+			return
+		}
+		sourceOpts := opts
+		sourceOpts.Observer = sourceObserver
+		_, err = SyncOutgoing(context.Background(), conn, &sourceOpts)
+		sourceErr <- err
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destObserver := &recordingObserver{}
+	destOpts := opts
+	destOpts.Observer = destObserver
+	_, err = SyncIncoming(context.Background(), conn, &destOpts)
+	assertPartial(t, "destination", err)
+	assertPartial(t, "source", <-sourceErr)
+
+	// both sides hear about the destination's failures
+	for side, observer := range map[string]*recordingObserver{
+		"source":      sourceObserver,
+		"destination": destObserver,
+	} {
+		observer.assertEvents(t, side,
+			"started a", "completed a 25 0",
+			"started b", "skipped b",
+			"skipped c")
+	}
+}
+
+// writtenObserver checks files are written by the time they're completed
+type writtenObserver struct {
+	NopObserver
+	mutex       sync.Mutex
+	destination string
+	completed   map[string]string
+}
+
+func (observer *writtenObserver) FileCompleted(path string, literal int64, matched int64) {
+	content, _ := ioutil.ReadFile(filepath.Join(observer.destination, path))
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+	observer.completed[path] = string(content)
+}
+
+func TestObserverCompletedOnceWritten(t *testing.T) {
+	source, destination := makeFileErrorDirs(t)
+	defer os.RemoveAll(source)
+	defer os.RemoveAll(destination)
+
+	// a is there already with other content, d is new
+	makeFiles([]SyncTestCaseFile{
+		{RelPath: "d", Pieces: []SyncTestCaseFilePiece{{'d', 15}}},
+	}, source)
+	makeFiles([]SyncTestCaseFile{
+		{RelPath: "a", Pieces: []SyncTestCaseFilePiece{{'x', 30}}},
+	}, destination)
+
+	observer := &writtenObserver{destination: destination, completed: make(map[string]string)}
+	opts := &Options{
+		Path:            source,
+		Destination:     destination,
+		BlockSize:       10,
+		ContinueOnError: true,
+		Observer:        observer,
+	}
+
+	_, err := SyncLocal(context.Background(), opts)
+	assertPartial(t, "local", err)
+
+	expected := map[string]string{
+		"a": "aaaaaaaaaaaaaaaaaaaaaaaaa",
+		"d": "ddddddddddddddd",
+	}
+	if fmt.Sprint(observer.completed) != fmt.Sprint(expected) {
+		t.Errorf("files should be written when they're completed, %v not %v", expected, observer.completed)
+	}
+}
+
+// lockingObserver asks the manager for its error when it's told about
+// one, which deadlocks if the manager still holds its mutex
+type lockingObserver struct {
+	NopObserver
+	manager Manager
+	errors  chan error
+}
+
+func (observer *lockingObserver) Error(err error) {
+	observer.errors <- observer.manager.Error()
+}
+
+func TestObserverErrorUnlocked(t *testing.T) {
+	failure := errors.New("failed")
+
+	// each manager tells the observer about its own failures, and the
+	// network managers about their peer's
+	for _, c := range []struct {
+		name   string
+		report func(observer *lockingObserver)
+	}{
+		{"local", func(observer *lockingObserver) {
+			manager := MakeLocalManager(&Options{Observer: observer})
+			observer.manager = manager
+			manager.ReportError(failure)
+		}},
+		{"source", func(observer *lockingObserver) {
+			manager := NewSourceManager(&Options{Observer: observer})
+			observer.manager = manager
+			manager.ReportError(failure)
+		}},
+		{"source's peer", func(observer *lockingObserver) {
+			manager := NewSourceManager(&Options{Observer: observer})
+			observer.manager = manager
+			manager.ReceiveStatusUpdate(DestinationTransferStatus{Failed: failure.Error()})
+		}},
+		{"destination", func(observer *lockingObserver) {
+			manager := NewDestinationManager(&Options{Observer: observer})
+			observer.manager = manager
+			manager.ReportError(failure)
+		}},
+		{"destination's peer", func(observer *lockingObserver) {
+			manager := NewDestinationManager(&Options{Observer: observer})
+			observer.manager = manager
+			manager.ReceiveStatusUpdate(SourceTransferStatus{Failed: failure.Error()})
+		}},
+	} {
+		observer := &lockingObserver{errors: make(chan error, 1)}
+		go c.report(observer)
+
+		select {
+		case err := <-observer.errors:
+			if err == nil || err.Error() != failure.Error() {
+				t.Errorf("%v: the observer should see the failure, not %v", c.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: the observer was called with the manager's mutex held", c.name)
+		}
+	}
+}
+
+// countingObserver counts the errors it's told about
+type countingObserver struct {
+	NopObserver
+	mutex  sync.Mutex
+	errors []error
+}
+
+func (observer *countingObserver) Error(err error) {
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+	observer.errors = append(observer.errors, err)
+}
+
+func TestManagerKeepsFirstError(t *testing.T) {
+	first := errors.New("disk full")
+	later := errors.New("connection reset")
+
+	for _, c := range []struct {
+		name string
+		make func(observer TransferObserver) Manager
+	}{
+		{"local", func(observer TransferObserver) Manager { return MakeLocalManager(&Options{Observer: observer}) }},
+		{"source", func(observer TransferObserver) Manager { return NewSourceManager(&Options{Observer: observer}) }},
+		{"destination", func(observer TransferObserver) Manager { return NewDestinationManager(&Options{Observer: observer}) }},
+	} {
+		observer := &countingObserver{}
+		manager := c.make(observer)
+		manager.ReportError(first)
+		manager.ReportError(later)
+		manager.ReportError(ErrPacketerClosed)
+
+		if manager.Error() != first {
+			t.Errorf("%v: the manager should keep the first error, not %v", c.name, manager.Error())
+		}
+		if len(observer.errors) != 1 || observer.errors[0] != first {
+			t.Errorf("%v: the observer should hear about the first error once, not %v", c.name, observer.errors)
+		}
+	}
+}
+
+// finishingObserver tells when the transfer finished
+type finishingObserver struct {
+	NopObserver
+	finished chan error
+}
+
+func (observer *finishingObserver) TransferFinished(stats *TransferStats, err error) {
+	observer.finished <- err
+}
+
+func TestObserverFinishedOnceStopped(t *testing.T) {
+	observer := &finishingObserver{finished: make(chan error, 1)}
+	manager := MakeLocalManager(&Options{Observer: observer})
+
+	// a goroutine that's slow to stop after the transfer fails
+	stuck := make(chan struct{})
+	group := &transferGroup{}
+	group.Go(func() { <-stuck })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	_, err := waitForTransfer(ctx, manager, group)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("the transfer should be aborted not %v", err)
+	}
+	if time.Since(start) > ABORT_TIMEOUT+time.Second {
+		t.Error("the transfer should give up waiting after ABORT_TIMEOUT")
+	}
+
+	select {
+	case <-observer.finished:
+		t.Fatal("the observer heard the transfer finished before it stopped")
+	default:
+	}
+
+	close(stuck)
+	select {
+	case finishedErr := <-observer.finished:
+		if finishedErr != err {
+			t.Errorf("the observer should get what was returned, not %v", finishedErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the observer should hear the transfer finished once it stopped")
+	}
+}
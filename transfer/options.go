@@ -4,7 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"log/slog"
+	"net"
 	"path"
+	"path/filepath"
+	"time"
 )
 
 // Direction - a Request is either for a pull or a push
@@ -19,6 +23,18 @@ const Incoming Direction = 1
 // Outgoing means the requester wants to write data
 const Outgoing Direction = 2
 
+func (direction Direction) String() string {
+	switch direction {
+	case Local:
+		return "local"
+	case Incoming:
+		return "pull"
+	case Outgoing:
+		return "push"
+	}
+	return fmt.Sprintf("Direction(%d)", uint8(direction))
+}
+
 // default block length
 const DefaultBlockLength int = 2048
 
@@ -34,11 +50,37 @@ type Request struct {
 
 	Direction   Direction
 
+	// Path is the source and Destination the destination.  The side
+	// on the daemon is relative to Module if it's set.
 	Path        string
 	Destination string
 
+	// Module is the daemon module the daemon's side is in, see Module
+	Module      string
+
 	FollowLinks bool
 	BlockSize   int
+
+	// ContinueOnError asks both sides to skip files they fail on, see
+	// Options.ContinueOnError
+	ContinueOnError bool
+
+	// FECGroupSize asks for one parity packet per FECGroupSize data
+	// packets, 0 disables forward error correction
+	FECGroupSize int
+
+	// PacketSize is the largest packet content length the requester
+	// supports, 0 means DEFAULT_PACKET_SIZE.  ProbePacketSize asks both
+	// sides to probe for the largest size that makes it across.
+	PacketSize      int
+	ProbePacketSize bool
+
+	// Transport is how packets should travel, see Transport
+	Transport Transport
+
+	// PublicKey is the requester's X25519 public key, see
+	// DeriveSessionKeys
+	PublicKey []byte
 }
 
 // Once a transfer is requested and responded to, the relevant
@@ -53,12 +95,79 @@ type Options struct {
 	FollowLinks        bool
 	BlockSize          int
 
+	// ContinueOnError skips the files that fail and transfers the rest,
+	// the Sync functions then return a PartialTransferError.  Otherwise
+	// the first failure fails the transfer.
+	ContinueOnError    bool
+
 	SourceHost         string
 	SourceUDPPort      int
 
 	DestinationHost    string
 	DestinationUDPPort int
 
+	// WindowPackets and WindowBytes limit the packets this side keeps
+	// unacknowledged, zero means DEFAULT_WINDOW_PACKETS/BYTES
+	WindowPackets      int
+	WindowBytes        int
+
+	// FECGroupSize is the negotiated number of data packets per parity
+	// packet, 0 when forward error correction is disabled
+	FECGroupSize       int
+
+	// SignatureWorkers, DeltaWorkers and PatchWorkers are how many files
+	// this side's pipeline stages work on at once, zero means one per
+	// CPU.  Each file is handled by one worker, in order.
+	SignatureWorkers   int
+	DeltaWorkers       int
+	PatchWorkers       int
+
+	// Root is the directory this side's files are confined to, a
+	// module's Path on the daemon.  Files are opened inside it without
+	// following symlinks out of it, and symlinks made by the transfer
+	// can't point outside the transfer.  Empty confines each side to the
+	// directory its Path or Destination is in.
+	Root               string
+
+	// MaxOpenFiles caps the files each of those stages keeps open, zero
+	// means DEFAULT_MAX_OPEN_FILES or less to fit RLIMIT_NOFILE
+	MaxOpenFiles       int
+
+	// PacketSize is the negotiated largest packet content length, see
+	// MaxPacketSize.  With ProbePacketSize packets start small and grow
+	// up to PacketSize as probes are acknowledged.
+	PacketSize         int
+	ProbePacketSize    bool
+
+	// Transport is UDPTransport, TCPTransport or AutoTransport.  Each
+	// side resolves AutoTransport when the transfer starts.
+	Transport          Transport
+
+	// UDPConn is the socket this side sends and receives packets on.
+	// If it's nil the Sync functions bind one using this side's host
+	// and port.  Either way the Sync functions close it when done.
+	UDPConn            net.PacketConn
+
+	// SourceKey and DestinationKey seal the UDP packets sent by the
+	// source and the destination.  Without keys packets are sent in
+	// the clear.
+	SourceKey          []byte
+	DestinationKey     []byte
+
+	// Stats are recorded into when set, so they can be watched while
+	// the transfer runs.  Otherwise the Sync functions make their own.
+	Stats              *TransferStats
+
+	// RequestID tags the transfer's log records when it's set
+	RequestID          uuid.UUID
+
+	// LogHandler gets the transfer's log records, nil uses
+	// slog.Default's handler
+	LogHandler         slog.Handler
+
+	// Observer is told about this side's files and errors as the
+	// transfer goes, see TransferObserver
+	Observer           TransferObserver
 }
 
 
@@ -68,6 +177,33 @@ type RequestResponse struct {
 	Reason    string
 	RequestID uuid.UUID
 	UDPPort   int
+
+	// FECGroupSize is the FECGroupSize both sides will use
+	FECGroupSize int
+
+	// PacketSize and ProbePacketSize are what both sides will use
+	PacketSize      int
+	ProbePacketSize bool
+
+	Transport Transport
+
+	// PublicKey is the daemon's X25519 public key, set when the
+	// requester sent one
+	PublicKey []byte
+
+	// Queued responses say the request is waiting for other transfers
+	// to finish, at QueuePosition.  They're followed by more responses
+	// until one isn't Queued.
+	Queued        bool
+	QueuePosition int
+
+	// RetryAfter is how long a requester turned away for being over
+	// the daemon's limits should wait before trying again
+	RetryAfter time.Duration
+
+	// MAC is set on the last response to an authenticated request, see
+	// ResponseMAC
+	MAC []byte
 }
 
 // Verify will return an error if there's anything
@@ -79,6 +215,20 @@ func (opts Options) Verify() error {
 		return errors.New(fmt.Sprintf(
 			"BlockSize must be larger than 0: %v", opts.BlockSize))
 	}
+	if opts.PacketSize < 0 || opts.PacketSize > MAX_PACKET_SIZE {
+		return errors.New(fmt.Sprintf(
+			"PacketSize must be between 0 and %v: %v", MAX_PACKET_SIZE, opts.PacketSize))
+	}
+	if opts.Transport > AutoTransport {
+		return errors.New(fmt.Sprintf("unknown transport: %v", opts.Transport))
+	}
+	if opts.FECGroupSize < 0 {
+		return errors.New(fmt.Sprintf(
+			"FECGroupSize can't be negative: %v", opts.FECGroupSize))
+	}
+	if (opts.SourceKey == nil) != (opts.DestinationKey == nil) {
+		return errors.New("SourceKey and DestinationKey must be set together")
+	}
 	if ! path.IsAbs(opts.Path){
 		return errors.New(fmt.Sprintf(
 			"Path attribute is not an absolute path: %v", opts.Path))
@@ -90,4 +240,37 @@ func (opts Options) Verify() error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// MaxPacketSize returns the largest packet content length either side
+// will send
+func (opts Options) MaxPacketSize() int {
+	if opts.PacketSize <= 0 {
+		return DEFAULT_PACKET_SIZE
+	}
+	if opts.PacketSize > MAX_PACKET_SIZE {
+		return MAX_PACKET_SIZE
+	}
+	return opts.PacketSize
+}
+
+// SourcePath returns the full path of relPath under Path.  relPath comes
+// from the peer, so it's cleaned as if it were rooted at Path first and
+// can't climb out of it.
+func (opts Options) SourcePath(relPath string) string {
+	return filepath.Join(opts.Path, filepath.Clean("/"+relPath))
+}
+
+// DestinationPath returns the full path of relPath under Destination, see
+// SourcePath
+func (opts Options) DestinationPath(relPath string) string {
+	return filepath.Join(opts.Destination, filepath.Clean("/"+relPath))
+}
+
+// transferStats returns the stats a transfer records into, see Stats
+func (opts Options) transferStats() *TransferStats {
+	if opts.Stats != nil {
+		return opts.Stats
+	}
+	return NewTransferStats()
+}
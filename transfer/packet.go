@@ -2,7 +2,11 @@ package transfer
 
 import (
 	"bytes"
+	"errors"
+	"log/slog"
+	"sort"
 	"sync"
+	"time"
 )
 
 type PacketContentType uint8
@@ -13,14 +17,80 @@ const FileInfoPacket PacketContentType = 0
 const SignaturePacket PacketContentType = 1
 const DeltaPacket PacketContentType = 2
 
+// ProbePackets are padded packets used to discover the largest packet
+// that makes it to the other side, they're never acknowledged or resent
+const ProbePacket PacketContentType = 3
+
 type Packet struct {
 	PacketID    uint64
 	IsEndPacket bool
 	ContentType PacketContentType
 	Content     []byte
+
+	// Parity packets protect the GroupSize packets starting at
+	// PacketID, see fec.go
+	IsParity  bool
+	GroupSize int
+}
+
+// LogValue leaves out the Content, it's file data
+func (packet Packet) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("id", packet.PacketID),
+		slog.Int("type", int(packet.ContentType)),
+		slog.Int("length", len(packet.Content)),
+		slog.Bool("end", packet.IsEndPacket),
+		slog.Bool("parity", packet.IsParity),
+	)
+}
+
+// DEFAULT_PACKET_SIZE is the content length of a packet unless a larger
+// size was negotiated, it stays well below the minimum IPv6 MTU.
+const DEFAULT_PACKET_SIZE = 500
+
+// PACKET_HEADER_ALLOWANCE is the room left in a datagram for encoding
+// everything in a Packet other than its Content
+const PACKET_HEADER_ALLOWANCE = 256
+
+// MAX_PACKET_SIZE is the largest content length that still fits in a
+// UDP datagram
+const MAX_PACKET_SIZE = 65000
+
+// PROBE_MTUS are the MTUs we probe for when probing is enabled, the
+// packet sizes probed leave room for IP/UDP headers and the allowance
+var PROBE_MTUS = []int{1280, 1500, 4352, 9000}
+
+// PROBE_REPEAT is how many times each probe is sent, in case one is
+// lost for reasons other than its size
+const PROBE_REPEAT = 3
+
+// MAX_SACK_RANGES limits the number of ranges a PacketerStatus will
+// selectively acknowledge.  Packets in ranges that don't fit will be
+// acknowledged by a later status update.
+const MAX_SACK_RANGES = 64
+
+// DEFAULT_WINDOW_PACKETS and DEFAULT_WINDOW_BYTES bound the number and the
+// size of unacknowledged packets a Packeter keeps in its sendCache
+const DEFAULT_WINDOW_PACKETS = 4096
+const DEFAULT_WINDOW_BYTES = 4 * 1024 * 1024
+
+var ErrPacketerClosed = errors.New("packeter is closed")
+
+// PacketRange is an inclusive range of packet ids
+type PacketRange struct {
+	First uint64
+	Last  uint64
 }
 
-const PACKET_CONTENT_LEN = 500
+// sentPacket is an entry in the sendCache.  It keeps track of when
+// the packet was actually sent so we know when to resend it.
+type sentPacket struct {
+	packet Packet
+	// sentAt is zero until the UDPSender has written the packet
+	sentAt time.Time
+	// resent packets are not used for round trip time samples
+	resent bool
+}
 
 // Packeter manages incoming and outgoing packets
 // It keeps a copy of all packets sent until it's confirmed
@@ -28,58 +98,165 @@ const PACKET_CONTENT_LEN = 500
 // It also gathers incoming packets until all content groups
 // are recieved so the can be decoded.
 type Packeter struct {
-	sendCache    map[uint64]Packet
+	sendCache    map[uint64]*sentPacket
 	receiveCache map[uint64]Packet
 
 	receiveCacheMutex sync.RWMutex
 
 	packetMutex sync.Mutex
 
-	senderDone   bool
-	receiverDone bool
+	// windowCond is signalled whenever packets are acknowledged, so
+	// SendPackets can wait for room in the send window
+	windowCond *sync.Cond
+
+	windowPackets   int
+	windowBytes     int
+	inFlightPackets int
+	inFlightBytes   int
+	closed          bool
+
+	// closing is closed by Close, which waits for the SendPackets calls
+	// in sending to give up before closing the PacketChannel
+	closing chan bool
+	sending sync.WaitGroup
+
+	rtt *rttEstimator
+
+	// packetSize is the content length used by MakePackets, it starts
+	// at the smaller of maxPacketSize and DEFAULT_PACKET_SIZE when probing
+	// and grows as probes are acknowledged
+	packetSize    int
+	maxPacketSize int
+	probe         bool
+
+	// fecEncoder and fecDecoder are nil unless forward error
+	// correction is enabled
+	fecEncoder *fecEncoder
+	fecDecoder *fecDecoder
+
+	// received gets a value when LastPacketReceived moves, so the
+	// decoder doesn't have to poll
+	received chan struct{}
 
 	PacketChannel chan Packet
 
+	// LastDeletedPacket and LastPacketSent are guarded by the
+	// packetMutex, LastPacketReceived and LastPacketDecoded by the
+	// receiveCacheMutex
 	LastDeletedPacket  uint64
 	LastPacketSent     uint64
 	LastPacketReceived uint64
 	LastPacketDecoded  uint64
+
+	// ResentPackets counts the packets this packeter resent
+	ResentPackets int64
+	// DuplicatePackets counts the packets this packeter received more
+	// than once, which means the other packeter resent them spuriously
+	DuplicatePackets int64
+	// ParityPackets counts the parity packets this packeter sent
+	ParityPackets int64
+	// RecoveredPackets counts the lost packets this packeter rebuilt
+	// from parity packets
+	RecoveredPackets int64
+	// LargestProbeReceived is the content length of the largest probe
+	// packet that arrived here
+	LargestProbeReceived int
+	// WindowStalls counts how often SendPackets had to wait for
+	// acknowledgements because the send window was full
+	WindowStalls int64
+	// ForgedPackets and ReplayedPackets count the datagrams dropped
+	// here because they failed authentication or didn't decode, or
+	// were seen before
+	ForgedPackets   int64
+	ReplayedPackets int64
 }
 
 // PacketerStatus is part of the status that is sent back and
 // forth by the TCPer. It's source/destination agnostic so the
 // Packeter can be used identically on both sides.
+//
+// LastPacketReceived acknowledges every packet up to and including it,
+// ReceivedRanges selectively acknowledge packets received after a gap.
+// The counters are cumulative for the whole transfer.
 type PacketerStatus struct {
 	LastPacketReceived uint64
-	ResendPackets      []uint64
+	ReceivedRanges     []PacketRange
 	LastPacketSent     uint64
+	ResentPackets      int64
+	DuplicatePackets   int64
+	RecoveredPackets   int64
+	ForgedPackets      int64
+	ReplayedPackets    int64
+	SmoothedRTT        time.Duration
+
+	LargestProbeReceived int
 }
 
-func NewPacketer() *Packeter {
-	return &Packeter{
-		sendCache:    make(map[uint64]Packet),
+// NewPacketer makes a Packeter that keeps at most opts.WindowPackets
+// packets or opts.WindowBytes bytes of content unacknowledged.  Zero uses
+// the defaults.  If opts.FECGroupSize is set parity packets are sent and
+// used to rebuild lost packets.  Packets carry at most opts.PacketSize
+// bytes of content, if opts.ProbePacketSize is set we start smaller and
+// grow to the largest size our probes show makes it across.
+func NewPacketer(opts *Options) *Packeter {
+	windowPackets := opts.WindowPackets
+	windowBytes := opts.WindowBytes
+	if windowPackets <= 0 {
+		windowPackets = DEFAULT_WINDOW_PACKETS
+	}
+	if windowBytes <= 0 {
+		windowBytes = DEFAULT_WINDOW_BYTES
+	}
+
+	packeter := &Packeter{
+		sendCache:    make(map[uint64]*sentPacket),
 		receiveCache: make(map[uint64]Packet),
 
 		receiveCacheMutex: sync.RWMutex{},
 
 		packetMutex: sync.Mutex{},
 
+		windowPackets: windowPackets,
+		windowBytes:   windowBytes,
+
+		rtt: newRTTEstimator(),
+
+		maxPacketSize: opts.MaxPacketSize(),
+		packetSize:    opts.MaxPacketSize(),
+		probe:         opts.ProbePacketSize,
+
 		PacketChannel: make(chan Packet, PACKET_CHANNEL_SIZE),
+		closing:       make(chan bool),
+		received:      make(chan struct{}, 1),
 
 		LastDeletedPacket:  0,
 		LastPacketSent:     0,
 		LastPacketReceived: 0,
 		LastPacketDecoded:  0,
 	}
+	packeter.windowCond = sync.NewCond(&packeter.packetMutex)
+
+	if packeter.probe && packeter.packetSize > DEFAULT_PACKET_SIZE {
+		packeter.packetSize = DEFAULT_PACKET_SIZE
+	}
+
+	if opts.FECGroupSize > 0 {
+		packeter.fecEncoder = &fecEncoder{groupSize: opts.FECGroupSize}
+		packeter.fecDecoder = newFECDecoder(opts.FECGroupSize)
+	}
+
+	return packeter
 }
 
-func MakePackets(buffer *bytes.Buffer, packetType PacketContentType) []Packet {
-	packets := make([]Packet, (buffer.Len()/PACKET_CONTENT_LEN)+1)
+// MakePackets splits the buffer into packets carrying at most
+// packetSize bytes of content, see Packeter.PacketSize
+func MakePackets(buffer *bytes.Buffer, packetType PacketContentType, packetSize int) []Packet {
+	packets := make([]Packet, (buffer.Len()/packetSize)+1)
 	i := 0
-	for buffer.Len() > PACKET_CONTENT_LEN {
+	for buffer.Len() > packetSize {
 		p := Packet{
 			ContentType: packetType,
-			Content:     buffer.Next(PACKET_CONTENT_LEN),
+			Content:     buffer.Next(packetSize),
 			IsEndPacket: false,
 		}
 		packets[i] = p
@@ -89,7 +266,7 @@ func MakePackets(buffer *bytes.Buffer, packetType PacketContentType) []Packet {
 	// make last packet
 	p := Packet{
 		ContentType: packetType,
-		Content:     buffer.Next(PACKET_CONTENT_LEN),
+		Content:     buffer.Next(packetSize),
 		IsEndPacket: true,
 	}
 	packets[i] = p
@@ -97,127 +274,491 @@ func MakePackets(buffer *bytes.Buffer, packetType PacketContentType) []Packet {
 	return packets
 }
 
+// PacketSize returns the content length packets should be made with
+func (packeter *Packeter) PacketSize() int {
+	packeter.packetMutex.Lock()
+	defer packeter.packetMutex.Unlock()
+
+	return packeter.packetSize
+}
+
+// SendProbes queues probe packets for every probe size larger than the
+// current packet size.  The other side reports the largest probe it
+// received in its status and we switch to that size.
+func (packeter *Packeter) SendProbes() {
+	if !packeter.probe {
+		return
+	}
+
+	current := packeter.PacketSize()
+
+	var sizes []int
+	for _, mtu := range PROBE_MTUS {
+		// leave room for IPv6 and UDP headers
+		size := mtu - 48 - PACKET_HEADER_ALLOWANCE - SEAL_OVERHEAD
+		if size > current && size < packeter.maxPacketSize {
+			sizes = append(sizes, size)
+		}
+	}
+	if packeter.maxPacketSize > current {
+		sizes = append(sizes, packeter.maxPacketSize)
+	}
+
+	// like SendPackets, give up once the packeter closes
+	packeter.packetMutex.Lock()
+	if packeter.closed {
+		packeter.packetMutex.Unlock()
+		return
+	}
+	packeter.sending.Add(1)
+	packeter.packetMutex.Unlock()
+	defer packeter.sending.Done()
+
+	for i := 0; i < PROBE_REPEAT; i++ {
+		for _, size := range sizes {
+			probe := Packet{
+				ContentType: ProbePacket,
+				Content:     make([]byte, size),
+				IsEndPacket: true,
+			}
+			select {
+			case packeter.PacketChannel <- probe:
+			case <-packeter.closing:
+				return
+			}
+		}
+	}
+}
+
 // SendPackets inserts the supplied packets into the sendCache,
 // adds them to the PacketChannel, increments LastPacketSent and
-// returns the number of the last packet sent
+// returns the number of the last packet sent.
+// If the packets don't fit in the send window SendPackets blocks until
+// enough packets have been acknowledged.  A group of packets larger than
+// the whole window is sent once nothing else is in flight.
 func (packeter *Packeter) SendPackets(packets []Packet) (uint64, error) {
+	size := 0
+	for _, packet := range packets {
+		size += len(packet.Content)
+	}
+
 	packeter.packetMutex.Lock()
-	// insert into sendCache and add to PacketChannel
+	stalled := false
+	for !packeter.closed && packeter.inFlightPackets > 0 &&
+		(packeter.inFlightPackets+len(packets) > packeter.windowPackets ||
+			packeter.inFlightBytes+size > packeter.windowBytes) {
+		if !stalled {
+			packeter.WindowStalls++
+			stalled = true
+		}
+		packeter.windowCond.Wait()
+	}
+
+	if packeter.closed {
+		packeter.packetMutex.Unlock()
+		return 0, ErrPacketerClosed
+	}
+
+	// insert into sendCache, parity packets go out right after
+	// the packet that completes their group
+	send := make([]Packet, 0, len(packets))
 	packet_id := packeter.LastPacketSent
-	for _, packet := range packets {
+	for i := range packets {
 		packet_id += 1
-		packet.PacketID = packet_id
-		packeter.sendCache[packet.PacketID] = packet
-		packeter.PacketChannel <- packet
-
+		packets[i].PacketID = packet_id
+		packeter.sendCache[packet_id] = &sentPacket{packet: packets[i]}
+		send = append(send, packets[i])
+
+		if packeter.fecEncoder != nil {
+			if parity, ok := packeter.fecEncoder.Add(packets[i]); ok {
+				send = append(send, parity)
+				packeter.ParityPackets++
+			}
+		}
 	}
+	packeter.inFlightPackets += len(packets)
+	packeter.inFlightBytes += size
 
 	// increment packeter.LastPacketSent
 	packeter.LastPacketSent = packet_id
+	packeter.sending.Add(1)
 	packeter.packetMutex.Unlock()
+	defer packeter.sending.Done()
+
+	// add to the PacketChannel outside of the lock, the UDPSender
+	// takes the lock to record when each packet was sent
+	for _, packet := range send {
+		select {
+		case packeter.PacketChannel <- packet:
+		case <-packeter.closing:
+			return 0, ErrPacketerClosed
+		}
+	}
 
-	return packeter.LastPacketSent, nil
+	return packet_id, nil
+}
+
+// PacketSent is called by the UDPSender after a packet was written,
+// the packet's resend timer starts now.
+func (packeter *Packeter) PacketSent(packetID uint64) {
+	packeter.packetMutex.Lock()
+	defer packeter.packetMutex.Unlock()
+
+	if sent, ok := packeter.sendCache[packetID]; ok {
+		sent.sentAt = time.Now()
+	}
+}
+
+// DrainPackets takes queued packets off the PacketChannel without
+// blocking, until about maxBytes of content was taken.  It replaces the
+// UDPSender when packets travel over the TCP connection.
+func (packeter *Packeter) DrainPackets(maxBytes int) []Packet {
+	var packets []Packet
+	size := 0
+
+	for size < maxBytes {
+		select {
+		case packet, ok := <-packeter.PacketChannel:
+			if !ok {
+				return packets
+			}
+			if !packet.IsParity && packet.ContentType != ProbePacket {
+				packeter.PacketSent(packet.PacketID)
+			}
+			packets = append(packets, packet)
+			size += len(packet.Content)
+		default:
+			return packets
+		}
+	}
+
+	return packets
+}
+
+// DroppedDatagram counts a datagram the UDPReceiver dropped because it
+// failed authentication or didn't decode, or because it was replayed
+func (packeter *Packeter) DroppedDatagram(replayed bool) {
+	packeter.receiveCacheMutex.Lock()
+	defer packeter.receiveCacheMutex.Unlock()
+
+	if replayed {
+		packeter.ReplayedPackets++
+	} else {
+		packeter.ForgedPackets++
+	}
 }
 
 // ReceivePacket inserts the packet into the receiveCache, which
 // the Decoder goroutine is constantly iterating over and decoding.
 // This function also optionally updates the LastPacketReceived.
+// Packets we've already received are counted and dropped.
 func (packeter *Packeter) ReceievePacket(packet Packet) {
-	// insert into receiveCache
 	packeter.receiveCacheMutex.Lock()
+	defer packeter.receiveCacheMutex.Unlock()
+
+	if packet.ContentType == ProbePacket {
+		if len(packet.Content) > packeter.LargestProbeReceived {
+			packeter.LargestProbeReceived = len(packet.Content)
+		}
+		return
+	}
+
+	if packet.IsParity {
+		if packeter.fecDecoder == nil {
+			return
+		}
+		if recovered, ok := packeter.fecDecoder.AddParity(packet); ok {
+			packeter.RecoveredPackets++
+			packeter.insertPacket(recovered)
+		}
+		return
+	}
+
+	if _, ok := packeter.receiveCache[packet.PacketID]; ok ||
+		packet.PacketID <= packeter.LastPacketReceived {
+		packeter.DuplicatePackets++
+		return
+	}
+
+	packeter.insertPacket(packet)
+
+	if packeter.fecDecoder != nil {
+		if recovered, ok := packeter.fecDecoder.AddData(packet); ok {
+			packeter.RecoveredPackets++
+			packeter.insertPacket(recovered)
+		}
+	}
+}
+
+// insertPacket must be called with the receiveCacheMutex held
+func (packeter *Packeter) insertPacket(packet Packet) {
+	if _, ok := packeter.receiveCache[packet.PacketID]; ok ||
+		packet.PacketID <= packeter.LastPacketReceived {
+		return
+	}
+
+	// insert into receiveCache
 	packeter.receiveCache[packet.PacketID] = packet
-	packeter.receiveCacheMutex.Unlock()
 
 	// increment packeter.LastPacketReceived
-	nextLastPackage := packeter.LastPacketReceived + 1
+	last := packeter.LastPacketReceived
+	for {
+		if _, ok := packeter.receiveCache[packeter.LastPacketReceived+1]; !ok {
+			break
+		}
+		packeter.LastPacketReceived++
+	}
+
+	if packeter.LastPacketReceived != last {
+		if packeter.fecDecoder != nil {
+			packeter.fecDecoder.Received(packeter.LastPacketReceived)
+		}
+		select {
+		case packeter.received <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Received returns a channel that gets a value when more packets can be
+// decoded, see NextGroup
+func (packeter *Packeter) Received() <-chan struct{} {
+	return packeter.received
+}
 
-	var ok bool
+// NextGroup returns the packets after LastPacketDecoded up to the next
+// end packet, if they've all been received.  Call GroupDecoded once
+// their content has been handled.
+func (packeter *Packeter) NextGroup() ([]Packet, bool) {
 	packeter.receiveCacheMutex.RLock()
-	_, ok = packeter.receiveCache[nextLastPackage]
-	packeter.receiveCacheMutex.RUnlock()
-	for ok {
-		packeter.LastPacketReceived = nextLastPackage
-		nextLastPackage++
-		packeter.receiveCacheMutex.RLock()
-		_, ok = packeter.receiveCache[nextLastPackage]
-		packeter.receiveCacheMutex.RUnlock()
+	defer packeter.receiveCacheMutex.RUnlock()
+
+	var packets []Packet
+	for i := packeter.LastPacketDecoded + 1; i <= packeter.LastPacketReceived; i++ {
+		packet := packeter.receiveCache[i]
+		packets = append(packets, packet)
+		if packet.IsEndPacket {
+			return packets, true
+		}
 	}
+	return nil, false
+}
+
+// GroupDecoded drops the packets up to last from the receiveCache and
+// moves LastPacketDecoded to it
+func (packeter *Packeter) GroupDecoded(last uint64) {
+	packeter.receiveCacheMutex.Lock()
+	defer packeter.receiveCacheMutex.Unlock()
+
+	for i := packeter.LastPacketDecoded + 1; i <= last; i++ {
+		delete(packeter.receiveCache, i)
+	}
+	packeter.LastPacketDecoded = last
+}
+
+// LastDecoded returns LastPacketDecoded
+func (packeter *Packeter) LastDecoded() uint64 {
+	packeter.receiveCacheMutex.RLock()
+	defer packeter.receiveCacheMutex.RUnlock()
+	return packeter.LastPacketDecoded
 }
 
 // ReceivePacketerStatusUpdate is called by a manger, it informs this
 // packeter of the status of it's counterpart packeter. With this new
 // information this packeter must:
-//   - delete unneeded entries from the sendCache
-//   - resend any packets that the other packeter thinks needs resending
-//   - determine what packets the other packeter needs to resend
-//   - respond with this packeter's status, including resend list
-// TODO: should we include some timing information with the status update
-//       so that we can better determine whether or not it's appropriate
-//       to request resent packets?
+//   - delete acknowledged entries from the sendCache, sampling the
+//     round trip time as it goes
+//   - resend any packets whose resend timeout has expired
+//   - respond with this packeter's status, including the ranges of
+//     packets it has received
 func (packeter *Packeter) ReceivePacketerStatusUpdate(status PacketerStatus) PacketerStatus {
 	// Delete any packets that were successfully sent
-	packeter.deleteSentPackets(status.LastPacketReceived)
-	// Resend any un-received packets
-	packeter.resendPackets(status.ResendPackets)
+	packeter.acknowledgePackets(status.LastPacketReceived, status.ReceivedRanges)
+	// Grow our packets if a larger probe made it across
+	packeter.acknowledgeProbe(status.LargestProbeReceived)
+	// Resend any packets that weren't acknowledged in time
+	packeter.resendExpiredPackets()
 
-	// Request any un-received packets
-	return PacketerStatus{
-		LastPacketReceived: packeter.LastPacketReceived,
-		LastPacketSent:     packeter.LastPacketSent,
-		ResendPackets:      packeter.determineResendPackets(status.LastPacketSent),
-	}
+	return packeter.status()
 }
 
-func (packeter *Packeter) deleteSentPackets(lastReceived uint64) {
+func (packeter *Packeter) acknowledgePackets(lastReceived uint64, ranges []PacketRange) {
+	now := time.Now()
+
+	packeter.packetMutex.Lock()
+	defer packeter.packetMutex.Unlock()
+
+	// never trust the other side to acknowledge packets we haven't sent
+	if lastReceived > packeter.LastPacketSent {
+		lastReceived = packeter.LastPacketSent
+	}
 
 	// iterate between LastDeletedPacket and lastReceived,
 	// deleting packets
-	for i := packeter.LastDeletedPacket; i <= lastReceived; i++ {
-		delete(packeter.sendCache, i)
+	for i := packeter.LastDeletedPacket + 1; i <= lastReceived; i++ {
+		packeter.acknowledgePacket(i, now)
 	}
 
 	// record LastDeletedPacket
-	packeter.LastDeletedPacket = lastReceived
+	if lastReceived > packeter.LastDeletedPacket {
+		packeter.LastDeletedPacket = lastReceived
+	}
 
+	// the ranges come from the peer too, only look at the ones we'd send
+	// and only at packets that can still be in the sendCache, so a
+	// forged status can't keep us looping with the mutex held
+	if len(ranges) > MAX_SACK_RANGES {
+		ranges = ranges[:MAX_SACK_RANGES]
+	}
+	for _, r := range ranges {
+		first := r.First
+		if first <= packeter.LastDeletedPacket {
+			first = packeter.LastDeletedPacket + 1
+		}
+		last := r.Last
+		if last > packeter.LastPacketSent {
+			last = packeter.LastPacketSent
+		}
+		for i := first; i <= last; i++ {
+			packeter.acknowledgePacket(i, now)
+		}
+	}
+
+	// wake up anyone waiting for room in the send window
+	packeter.windowCond.Broadcast()
 }
 
-func (packeter *Packeter) resendPackets(packetNumbers []uint64) {
-	// get packets from the sendCache and add to PacketChannel
-	for _, packetID := range packetNumbers {
-		packeter.PacketChannel <- packeter.sendCache[packetID]
+func (packeter *Packeter) acknowledgeProbe(size int) {
+	packeter.packetMutex.Lock()
+	defer packeter.packetMutex.Unlock()
+
+	if packeter.probe && size > packeter.packetSize && size <= packeter.maxPacketSize {
+		packeter.packetSize = size
 	}
 }
 
-func (packeter *Packeter) determineResendPackets(lastSent uint64) []uint64 {
-	var neededPackets []uint64
-	// simple solution is to ask for all packets between
-	// packeter.LastPacketReceived and lastSent that are also not in
-	// the receive cache
-	// TODO: should we wait for packets to arrive before asking for a resend
-	//       in case the status update arrives before the packets?
-	for i := packeter.LastPacketReceived + 1; i <= lastSent; i++ {
-		if _, ok := packeter.receiveCache[i]; !ok {
-			neededPackets = append(neededPackets, i)
-		}
+// acknowledgePacket must be called with the packetMutex held
+func (packeter *Packeter) acknowledgePacket(packetID uint64, now time.Time) {
+	sent, ok := packeter.sendCache[packetID]
+	if !ok {
+		return
 	}
 
-	return neededPackets
+	// Karn's algorithm: we can't tell which transmission of a resent
+	// packet is being acknowledged, so only sample packets sent once
+	if !sent.resent && !sent.sentAt.IsZero() {
+		packeter.rtt.Sample(now.Sub(sent.sentAt))
+	}
+
+	delete(packeter.sendCache, packetID)
+	packeter.inFlightPackets--
+	packeter.inFlightBytes -= len(sent.packet.Content)
 }
 
-func (packeter *Packeter) Close() {
-	// we just close the packet channel which will ensure that
-	// the sender stops eventually
-	close(packeter.PacketChannel)
+func (packeter *Packeter) resendExpiredPackets() {
+	now := time.Now()
+	var resend []Packet
+
+	packeter.packetMutex.Lock()
+	rto := packeter.rtt.RTO()
+	for _, sent := range packeter.sendCache {
+		// packets still waiting in the PacketChannel haven't been
+		// sent yet, so they can't have been lost
+		if sent.sentAt.IsZero() || now.Sub(sent.sentAt) < rto {
+			continue
+		}
+		sent.resent = true
+		sent.sentAt = time.Time{}
+		resend = append(resend, sent.packet)
+	}
+
+	if len(resend) == 0 || packeter.closed {
+		packeter.packetMutex.Unlock()
+		return
+	}
+	packeter.rtt.Backoff()
+	packeter.ResentPackets += int64(len(resend))
+	packeter.sending.Add(1)
+	packeter.packetMutex.Unlock()
+
+	sort.Slice(resend, func(i, j int) bool {
+		return resend[i].PacketID < resend[j].PacketID
+	})
+
+	// the tcp loop calls us, if it waited for room in a full
+	// PacketChannel the peer would time out waiting for its status
+	go func() {
+		defer packeter.sending.Done()
+		for _, packet := range resend {
+			select {
+			case packeter.PacketChannel <- packet:
+			case <-packeter.closing:
+				return
+			}
+		}
+	}()
 }
 
-func (packeter *Packeter) SenderDone() {
-	packeter.senderDone = true
+func (packeter *Packeter) status() PacketerStatus {
+	packeter.receiveCacheMutex.RLock()
+	status := PacketerStatus{
+		LastPacketReceived: packeter.LastPacketReceived,
+		ReceivedRanges:     packeter.receivedRanges(),
+		DuplicatePackets:   packeter.DuplicatePackets,
+		RecoveredPackets:   packeter.RecoveredPackets,
+		ForgedPackets:      packeter.ForgedPackets,
+		ReplayedPackets:    packeter.ReplayedPackets,
+
+		LargestProbeReceived: packeter.LargestProbeReceived,
+	}
+	packeter.receiveCacheMutex.RUnlock()
+
+	packeter.packetMutex.Lock()
+	status.LastPacketSent = packeter.LastPacketSent
+	status.ResentPackets = packeter.ResentPackets
+	status.SmoothedRTT = packeter.rtt.SRTT()
+	packeter.packetMutex.Unlock()
+
+	return status
 }
 
-func (packeter *Packeter) ReceiverDone() {
-	packeter.receiverDone = true
+// receivedRanges returns the ranges of packets received after
+// LastPacketReceived.  It must be called with the receiveCacheMutex held.
+func (packeter *Packeter) receivedRanges() []PacketRange {
+	var ids []uint64
+	for id := range packeter.receiveCache {
+		if id > packeter.LastPacketReceived {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var ranges []PacketRange
+	for _, id := range ids {
+		if n := len(ranges); n > 0 && ranges[n-1].Last+1 == id {
+			ranges[n-1].Last = id
+			continue
+		}
+		if len(ranges) == MAX_SACK_RANGES {
+			break
+		}
+		ranges = append(ranges, PacketRange{First: id, Last: id})
+	}
+
+	return ranges
 }
 
-func (packeter *Packeter) Done() bool {
-	return packeter.senderDone && packeter.receiverDone
+func (packeter *Packeter) Close() {
+	// release anyone waiting for room in the send window
+	packeter.packetMutex.Lock()
+	packeter.closed = true
+	close(packeter.closing)
+	packeter.windowCond.Broadcast()
+	packeter.packetMutex.Unlock()
+
+	// we just close the packet channel which will ensure that
+	// the sender stops eventually, once nobody is adding to it
+	packeter.sending.Wait()
+	close(packeter.PacketChannel)
 }
@@ -0,0 +1,267 @@
+package transfer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeTestPackets(n int) []Packet {
+	packets := make([]Packet, n)
+	for i := range packets {
+		packets[i] = Packet{ContentType: DeltaPacket, IsEndPacket: true}
+	}
+	return packets
+}
+
+func TestReceivedRanges(t *testing.T) {
+	packeter := NewPacketer(&Options{})
+
+	for _, id := range []uint64{1, 2, 4, 5, 7, 2} {
+		packeter.ReceievePacket(Packet{PacketID: id})
+	}
+
+	status := packeter.status()
+
+	if status.LastPacketReceived != 2 {
+		t.Errorf("LastPacketReceived should be 2 not %v", status.LastPacketReceived)
+	}
+
+	expected := []PacketRange{{First: 4, Last: 5}, {First: 7, Last: 7}}
+	if len(status.ReceivedRanges) != len(expected) {
+		t.Fatalf("ReceivedRanges should be %v not %v", expected, status.ReceivedRanges)
+	}
+	for i := range expected {
+		if status.ReceivedRanges[i] != expected[i] {
+			t.Errorf("ReceivedRanges should be %v not %v", expected, status.ReceivedRanges)
+		}
+	}
+
+	if status.DuplicatePackets != 1 {
+		t.Errorf("DuplicatePackets should be 1 not %v", status.DuplicatePackets)
+	}
+}
+
+func TestResendAfterTimeout(t *testing.T) {
+	packeter := NewPacketer(&Options{})
+
+	if _, err := packeter.SendPackets(makeTestPackets(5)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		packet := <-packeter.PacketChannel
+		packeter.PacketSent(packet.PacketID)
+	}
+
+	// packets 1, 2 and 4 arrived, nothing should be resent before the
+	// resend timeout expires
+	packeter.ReceivePacketerStatusUpdate(PacketerStatus{
+		LastPacketReceived: 2,
+		ReceivedRanges:     []PacketRange{{First: 4, Last: 4}},
+	})
+
+	if len(packeter.PacketChannel) != 0 {
+		t.Fatalf("%v packets were resent before the timeout", len(packeter.PacketChannel))
+	}
+	if len(packeter.sendCache) != 2 {
+		t.Fatalf("sendCache should hold 2 packets not %v", len(packeter.sendCache))
+	}
+
+	// pretend the remaining packets were sent a long time ago
+	for _, sent := range packeter.sendCache {
+		sent.sentAt = time.Now().Add(-MAX_RESEND_TIMEOUT)
+	}
+
+	status := packeter.ReceivePacketerStatusUpdate(PacketerStatus{
+		LastPacketReceived: 2,
+		ReceivedRanges:     []PacketRange{{First: 4, Last: 4}},
+	})
+
+	if status.ResentPackets != 2 {
+		t.Errorf("ResentPackets should be 2 not %v", status.ResentPackets)
+	}
+	for _, id := range []uint64{3, 5} {
+		packet := <-packeter.PacketChannel
+		if packet.PacketID != id {
+			t.Errorf("resent packet should be %v not %v", id, packet.PacketID)
+		}
+	}
+}
+
+func TestSendWindow(t *testing.T) {
+	packeter := NewPacketer(&Options{WindowPackets: 4})
+
+	if _, err := packeter.SendPackets(makeTestPackets(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan uint64)
+	go func() {
+		last, err := packeter.SendPackets(makeTestPackets(2))
+		if err != nil {
+			t.Error(err)
+		}
+		sent <- last
+	}()
+
+	select {
+	case <-sent:
+		t.Fatal("SendPackets should block while the send window is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// acknowledging the first packets makes room in the window
+	packeter.ReceivePacketerStatusUpdate(PacketerStatus{LastPacketReceived: 2})
+
+	select {
+	case last := <-sent:
+		if last != 5 {
+			t.Errorf("last packet sent should be 5 not %v", last)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SendPackets didn't unblock after acknowledgement")
+	}
+
+	if packeter.WindowStalls != 1 {
+		t.Errorf("WindowStalls should be 1 not %v", packeter.WindowStalls)
+	}
+}
+
+func TestFECRecovery(t *testing.T) {
+	opts := &Options{FECGroupSize: 4}
+	sender := NewPacketer(opts)
+	receiver := NewPacketer(opts)
+
+	packets := makeTestPackets(8)
+	for i := range packets {
+		packets[i].Content = []byte(strings.Repeat("x", i*10))
+		packets[i].IsEndPacket = i%3 == 0
+	}
+	if _, err := sender.SendPackets(packets); err != nil {
+		t.Fatal(err)
+	}
+
+	// 8 data packets and 2 parity packets, lose packets 2 and 7
+	for i := 0; i < 10; i++ {
+		packet := <-sender.PacketChannel
+		if !packet.IsParity && (packet.PacketID == 2 || packet.PacketID == 7) {
+			continue
+		}
+		receiver.ReceievePacket(packet)
+	}
+
+	if receiver.RecoveredPackets != 2 {
+		t.Errorf("RecoveredPackets should be 2 not %v", receiver.RecoveredPackets)
+	}
+	if receiver.LastPacketReceived != 8 {
+		t.Fatalf("LastPacketReceived should be 8 not %v", receiver.LastPacketReceived)
+	}
+
+	for _, id := range []uint64{2, 7} {
+		recovered := receiver.receiveCache[id]
+		original := packets[id-1]
+		if !bytes.Equal(recovered.Content, original.Content) ||
+			recovered.IsEndPacket != original.IsEndPacket ||
+			recovered.ContentType != original.ContentType {
+			t.Errorf("packet %v wasn't recovered correctly: %v", id, recovered)
+		}
+	}
+}
+
+func TestFECLosslessLeavesNoGroups(t *testing.T) {
+	opts := &Options{FECGroupSize: 4, WindowPackets: 1000}
+	sender := NewPacketer(opts)
+	receiver := NewPacketer(opts)
+
+	// every parity packet arrives after its group is complete
+	for i := 0; i < 100; i++ {
+		if _, err := sender.SendPackets(makeTestPackets(4)); err != nil {
+			t.Fatal(err)
+		}
+		for len(sender.PacketChannel) > 0 {
+			receiver.ReceievePacket(<-sender.PacketChannel)
+		}
+	}
+
+	if receiver.LastPacketReceived != 400 {
+		t.Fatalf("LastPacketReceived should be 400 not %v", receiver.LastPacketReceived)
+	}
+	if n := len(receiver.fecDecoder.groups); n != 0 {
+		t.Errorf("the decoder should have no groups left, not %v", n)
+	}
+}
+
+func TestProbePacketSize(t *testing.T) {
+	packeter := NewPacketer(&Options{PacketSize: 8000, ProbePacketSize: true})
+
+	if packeter.PacketSize() != DEFAULT_PACKET_SIZE {
+		t.Fatalf("PacketSize should start at %v not %v",
+			DEFAULT_PACKET_SIZE, packeter.PacketSize())
+	}
+
+	packeter.SendProbes()
+	receiver := NewPacketer(&Options{PacketSize: 8000, ProbePacketSize: true})
+	for len(packeter.PacketChannel) > 0 {
+		probe := <-packeter.PacketChannel
+		// pretend the path MTU is 1500
+		if len(probe.Content) <= 1500 {
+			receiver.ReceievePacket(probe)
+		}
+	}
+
+	packeter.ReceivePacketerStatusUpdate(receiver.status())
+
+	expected := 1500 - 48 - PACKET_HEADER_ALLOWANCE - SEAL_OVERHEAD
+	if packeter.PacketSize() != expected {
+		t.Errorf("PacketSize should be %v not %v", expected, packeter.PacketSize())
+	}
+}
+
+func TestForgedRangesAreClamped(t *testing.T) {
+	packeter := NewPacketer(&Options{})
+
+	// deep into a transfer, with nearly everything acknowledged
+	packeter.LastPacketSent = 1 << 40
+	packeter.LastDeletedPacket = 1<<40 - 10
+
+	ranges := []PacketRange{{First: 0, Last: 1 << 40}, {First: 1 << 40, Last: 1}}
+	for i := 0; i < 10*MAX_SACK_RANGES; i++ {
+		ranges = append(ranges, PacketRange{First: 0, Last: 1 << 40})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		packeter.ReceivePacketerStatusUpdate(PacketerStatus{
+			LastPacketReceived: 1<<40 - 10,
+			ReceivedRanges:     ranges,
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a forged status should only look at the packets that could be unacknowledged")
+	}
+}
+
+func TestProbesAfterClose(t *testing.T) {
+	packeter := NewPacketer(&Options{PacketSize: 8000, ProbePacketSize: true})
+	packeter.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		packeter.SendProbes()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendProbes should give up once the packeter is closed")
+	}
+	if _, ok := <-packeter.PacketChannel; ok {
+		t.Error("no probes should be queued once the packeter is closed")
+	}
+}
@@ -1,64 +1,269 @@
 package transfer
 
 import (
-	"fmt"
+	"context"
+	"io"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 )
 
-func ProcessPatches(opts *Options, manager Manager) {
+// ProcessPatches applies the deltas it gets, with Options.PatchWorkers
+// workers that each handle some of the files
+func ProcessPatches(ctx context.Context, opts *Options, manager Manager) {
 	defer manager.PatchDone()
 
-	fdmap := make(map[string]*os.File)
+	root, err := openRoot(opts, opts.Destination)
+	if err != nil {
+		manager.ReportError(err)
+		return
+	}
+	defer root.Close()
+
+	// files left open when the transfer stops early
+	files := newOpenFiles(maxOpenFiles(opts))
+	defer files.closeAll()
+
+	workers := stageWorkers(opts.PatchWorkers)
+	shards := make([]chan Delta, workers)
+	var wait sync.WaitGroup
+	for i := range shards {
+		shards[i] = make(chan Delta, DELTA_BUF_SIZE)
+		wait.Add(1)
+		go func(deltas chan Delta) {
+			defer wait.Done()
+			patchWorker(ctx, opts, manager, root, files, deltas)
+		}(shards[i])
+	}
+	// the workers return once their shards are closed and drained
+	defer func() {
+		for _, deltas := range shards {
+			close(deltas)
+		}
+		wait.Wait()
+	}()
+
+	for {
+		var delta Delta
+		select {
+		case d, ok := <-manager.DeltaChannel():
+			if !ok {
+				return
+			}
+			delta = d
+		case <-ctx.Done():
+			return
+		}
+
+		select {
+		case shards[shardFor(delta.Path, workers)] <- delta:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// patchWorker applies the deltas in deltas, which are all for files
+// sharded to it.  A file is patched in a copy next to it that replaces it
+// on its EOF delta, so a file that's skipped, or that the transfer stops
+// in the middle of, keeps its old content.
+func patchWorker(ctx context.Context, opts *Options, manager Manager, root *transferRoot, files *openFiles, deltas chan Delta) {
+	log := manager.Logger()
+
+	// skipped files failed and finished ones got their EOF delta, their
+	// remaining deltas are dropped
+	skipped := make(map[string]bool)
+	finished := make(map[string]bool)
+
+	// patching are the names of the copies of the files being patched
+	patching := make(map[string]string)
+
+	// discard closes and removes the copy of the file at path
+	discard := func(path string) {
+		files.close(path)
+		if temp, ok := patching[path]; ok {
+			root.Remove(temp)
+			delete(patching, path)
+		}
+	}
+	defer func() {
+		for path := range patching {
+			discard(path)
+		}
+	}()
+
+	// skip gives up on the file at path after err, returning false if
+	// the transfer failed instead
+	skip := func(delta Delta, path string, err error) bool {
+		if !manager.ReportFileError(delta.Path, PHASE_PATCH, err) {
+			return false
+		}
+		skipped[path] = true
+		discard(path)
+		return true
+	}
+
+	// the file the last delta was for, it may be closed to make room for
+	// others while we're onto the next delta
+	held := ""
+	defer func() { files.release(held) }()
+
+	for delta := range deltas {
+		files.release(held)
+		held = ""
+
+		if ctx.Err() != nil {
+			return
+		}
 
-	for delta := range manager.DeltaChannel() {
 		if delta.NoOp {
-			Debug(fmt.Sprintf("not touching %s at offset %d\n", delta.Path, delta.Offset))
+			log.Debug("not touching", "path", delta.Path, "offset", delta.Offset)
+			continue
+		}
+
+		path := opts.DestinationPath(delta.Path)
+
+		if skipped[path] || finished[path] {
 			continue
 		}
 
-		var f *os.File
-		f, ok := fdmap[delta.Path]
-		if (!ok) {
-			openf, err := os.OpenFile(delta.Path, os.O_RDWR|os.O_CREATE, 0755)
-			if err != nil {
-				manager.ReportError(err)
+		if delta.Skip {
+			// the source gave up on the file, it's been reported
+			skipped[path] = true
+			discard(path)
+			continue
+		}
+
+		name := root.name(delta.Path)
+		f, err := files.get(path, func() (*os.File, error) {
+			if temp, ok := patching[path]; ok {
+				return root.OpenFile(temp, os.O_RDWR, 0)
+			}
+			f, temp, err := copyForPatch(root, name, delta.Mode)
+			if err == nil {
+				patching[path] = temp
+			}
+			return f, err
+		})
+		if err != nil {
+			if !skip(delta, path, err) {
 				return
 			}
-			fdmap[delta.Path] = openf
-			f = openf
+			continue
 		}
+		held = path
 
 		if delta.EOF {
 			if err := f.Truncate(delta.Offset); err != nil {
-				manager.ReportError(err)
-				return
+				if !skip(delta, path, err) {
+					return
+				}
+				continue
 			}
 
 			if err := f.Sync(); err != nil {
-				manager.ReportError(err)
-				return
+				if !skip(delta, path, err) {
+					return
+				}
+				continue
 			}
 
-			if err := f.Close(); err != nil {
-				manager.ReportError(err)
-				return
+			if _, err := files.close(path); err != nil {
+				if !skip(delta, path, err) {
+					return
+				}
+				continue
 			}
 
+			if err := root.Rename(patching[path], name); err != nil {
+				if !skip(delta, path, err) {
+					return
+				}
+				continue
+			}
+			delete(patching, path)
+			finished[path] = true
+			manager.FilePatched(delta.Path)
+
 			continue
 		}
 
 		if _, err := f.Seek(delta.Offset, 0); err != nil {
-			manager.ReportError(err)
-			return
+			if !skip(delta, path, err) {
+				return
+			}
+			continue
 		}
 
 		if _, err := f.Write(delta.Content); err != nil {
-			manager.ReportError(err)
-			return
+			if !skip(delta, path, err) {
+				return
+			}
+			continue
 		}
 
-		Debug(fmt.Sprintf("( %d %s ) %s\n", delta.Offset, delta.Path, delta.Content))
+		log.Debug("patched", "path", delta.Path, "offset", delta.Offset, "length", len(delta.Content))
 
 	}
 
 }
+
+// DEFAULT_PATCH_MODE is the mode new files get when the source's isn't
+// known
+const DEFAULT_PATCH_MODE = 0644
+
+// createPatchFile makes a new file next to the file at name to patch it
+// in, see patchWorker.  Its name is random so it can't be a file that's
+// being transferred, or one an earlier transfer left behind.
+func createPatchFile(root *transferRoot, name string, perm os.FileMode) (*os.File, string, error) {
+	dir, base := filepath.Split(name)
+	for try := 0; ; try++ {
+		temp := filepath.Join(dir, "."+base+"."+strconv.FormatUint(uint64(rand.Uint32()), 36)+".gosync")
+		f, err := root.OpenFile(temp, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) && try < 100 {
+			continue
+		}
+		return f, temp, err
+	}
+}
+
+// copyForPatch makes a copy of the file at name to patch, returning it
+// and its name.  It's an empty file with the source's mode if there's
+// none yet.
+func copyForPatch(root *transferRoot, name string, mode os.FileMode) (*os.File, string, error) {
+	perm := mode.Perm()
+	if perm == 0 {
+		perm = DEFAULT_PATCH_MODE
+	}
+	f, temp, err := createPatchFile(root, name, perm)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = func() error {
+		original, err := root.Open(name)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer original.Close()
+
+		fileinfo, err := original.Stat()
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, original); err != nil {
+			return err
+		}
+		return f.Chmod(fileinfo.Mode().Perm())
+	}()
+	if err != nil {
+		f.Close()
+		root.Remove(temp)
+		return nil, "", err
+	}
+	return f, temp, nil
+}
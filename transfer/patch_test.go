@@ -0,0 +1,94 @@
+package transfer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPatchKeepsLookalikes(t *testing.T) {
+	destination, err := ioutil.TempDir("/tmp", "gosync.dest.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+
+	// .a.gosync is a file of its own, not a copy of a being patched
+	makeFiles([]SyncTestCaseFile{
+		{RelPath: "a", Pieces: []SyncTestCaseFilePiece{{'a', 10}}},
+		{RelPath: ".a.gosync", Pieces: []SyncTestCaseFilePiece{{'g', 10}}},
+	}, destination)
+
+	opts := &Options{Destination: destination, BlockSize: 5}
+	manager := MakeLocalManager(opts)
+	for _, delta := range []Delta{
+		{Path: "a", Content: []byte("xxxxx"), Len: 5},
+		{Path: ".a.gosync", Content: []byte("yyyyy"), Len: 5},
+		{Path: "a", Offset: 10, EOF: true},
+		{Path: ".a.gosync", Offset: 10, EOF: true},
+	} {
+		manager.QueueDelta(delta)
+	}
+	manager.DeltaDone()
+	ProcessPatches(context.Background(), opts, manager)
+
+	if err := manager.Error(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"a":         "xxxxxaaaaa",
+		".a.gosync": "yyyyyggggg",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(destination, name))
+		if err != nil || string(content) != expected {
+			t.Errorf("%v should be %q not %q, %v", name, expected, content, err)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("the copies being patched should be gone, not %v entries left", len(entries))
+	}
+}
+
+func TestPatchNewFileMode(t *testing.T) {
+	destination, err := ioutil.TempDir("/tmp", "gosync.dest.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+
+	opts := &Options{Destination: destination, BlockSize: 5}
+	manager := MakeLocalManager(opts)
+	for _, delta := range []Delta{
+		{Path: "private", Content: []byte("xxxxx"), Len: 5, Mode: 0600},
+		{Path: "private", Offset: 5, EOF: true, Mode: 0600},
+		{Path: "unknown", Offset: 0, EOF: true},
+	} {
+		manager.QueueDelta(delta)
+	}
+	manager.DeltaDone()
+	ProcessPatches(context.Background(), opts, manager)
+
+	if err := manager.Error(); err != nil {
+		t.Fatal(err)
+	}
+	// the umask may take some bits away, but never the owner's
+	for name, expected := range map[string]os.FileMode{
+		"private": 0600,
+		"unknown": DEFAULT_PATCH_MODE,
+	} {
+		info, err := os.Stat(filepath.Join(destination, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm&^expected != 0 || perm&0600 != 0600 {
+			t.Errorf("%v should have mode %v not %v", name, expected, perm)
+		}
+	}
+}
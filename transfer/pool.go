@@ -0,0 +1,24 @@
+package transfer
+
+import (
+	"hash/fnv"
+	"runtime"
+)
+
+// stageWorkers returns how many workers a pipeline stage runs, n or one
+// per CPU when n is 0
+func stageWorkers(n int) int {
+	if n <= 0 {
+		return runtime.NumCPU()
+	}
+	return n
+}
+
+// shardFor returns which of the workers handles the file at relPath.
+// Everything for a file goes to the same worker, so it's handled in the
+// order it was queued even though other files are handled alongside it.
+func shardFor(relPath string, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(relPath))
+	return int(h.Sum32() % uint32(workers))
+}
@@ -0,0 +1,75 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// transferRoot opens the files on one side of a transfer.  Every name is
+// resolved inside an os.Root one component at a time, so a symlink, even
+// one left behind by an earlier transfer, can't lead outside of it.
+type transferRoot struct {
+	*os.Root
+
+	// top is the transfer's Path or Destination relative to the root
+	top string
+}
+
+// openRoot opens the root that top, the side's Path or Destination, is
+// confined to, see Options.Root
+func openRoot(opts *Options, top string) (*transferRoot, error) {
+	dir := opts.Root
+	if dir == "" {
+		dir = filepath.Dir(top)
+	}
+
+	rel, err := filepath.Rel(dir, top)
+	if err != nil {
+		return nil, err
+	}
+	if climbs(rel) {
+		return nil, errors.New(fmt.Sprintf("%v is outside of the root %v", top, dir))
+	}
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &transferRoot{Root: root, top: rel}, nil
+}
+
+// name returns the name of relPath inside the root.  relPath comes from
+// the peer, it's cleaned as if it were rooted at top.
+func (root *transferRoot) name(relPath string) string {
+	return filepath.Join(root.top, filepath.Clean("/"+relPath))
+}
+
+// checkLink refuses a symlink at relPath to target if following it could
+// lead outside the transfer, or outside the root when the transfer is
+// the symlink itself
+func (root *transferRoot) checkLink(relPath string, target string) error {
+	if filepath.IsAbs(target) {
+		return errors.New(fmt.Sprintf("symlink target is absolute: %v", target))
+	}
+
+	// where the link is, relative to the top or to the root if it's
+	// the top
+	link := strings.TrimPrefix(filepath.Clean("/"+relPath), "/")
+	linkDir := filepath.Dir(link)
+	if link == "" {
+		linkDir = filepath.Dir(root.top)
+	}
+	if climbs(filepath.Join(linkDir, target)) {
+		return errors.New(fmt.Sprintf("symlink target leads outside of the transfer: %v", target))
+	}
+	return nil
+}
+
+// climbs returns whether the relative path rel leads above where it
+// starts
+func climbs(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
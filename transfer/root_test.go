@@ -0,0 +1,34 @@
+package transfer
+
+import (
+	"testing"
+)
+
+func TestCheckLink(t *testing.T) {
+	root := &transferRoot{top: "dest"}
+
+	cases := []struct {
+		relPath string
+		target  string
+		ok      bool
+	}{
+		{"link", "target", true},
+		{"sub/link", "../target", true},
+		{"sub/link", "../../target", false},
+		{"link", "../outside", false},
+		{"link", "/etc/passwd", false},
+		{"link", "sub/../../outside", false},
+		// the peer's relPath is cleaned like any other
+		{"../../link", "target", true},
+		// a link that's the whole transfer may point next to it
+		{".", "target", true},
+		{".", "../outside", false},
+	}
+
+	for _, c := range cases {
+		err := root.checkLink(c.relPath, c.target)
+		if (err == nil) != c.ok {
+			t.Errorf("%v -> %v should be allowed: %v, not %v", c.relPath, c.target, c.ok, err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package transfer
+
+import (
+	"time"
+)
+
+// INITIAL_RESEND_TIMEOUT is used until the first round trip time sample
+const INITIAL_RESEND_TIMEOUT = time.Second
+
+// MIN_RESEND_TIMEOUT keeps the resend timeout above the interval between
+// TCP status updates, acknowledgements can't arrive any faster than that.
+const MIN_RESEND_TIMEOUT = 200 * time.Millisecond
+
+const MAX_RESEND_TIMEOUT = 60 * time.Second
+
+// rttEstimator keeps a smoothed round trip time and computes the resend
+// timeout (RTO) the same way TCP does (RFC 6298).  The round trip time is
+// measured from the moment a packet was sent to the moment the status
+// update acknowledging it was received.
+type rttEstimator struct {
+	srtt    time.Duration
+	rttvar  time.Duration
+	rto     time.Duration
+	sampled bool
+}
+
+func newRTTEstimator() *rttEstimator {
+	return &rttEstimator{
+		rto: INITIAL_RESEND_TIMEOUT,
+	}
+}
+
+// Sample updates the estimator with a new round trip time measurement
+func (r *rttEstimator) Sample(rtt time.Duration) {
+	if !r.sampled {
+		r.srtt = rtt
+		r.rttvar = rtt / 2
+		r.sampled = true
+	} else {
+		delta := r.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		r.rttvar = (3*r.rttvar + delta) / 4
+		r.srtt = (7*r.srtt + rtt) / 8
+	}
+
+	r.rto = clampResendTimeout(r.srtt + 4*r.rttvar)
+}
+
+// Backoff doubles the resend timeout, it's called whenever packets had
+// to be resent because their timeout expired.
+func (r *rttEstimator) Backoff() {
+	r.rto = clampResendTimeout(2 * r.rto)
+}
+
+// RTO returns the current resend timeout
+func (r *rttEstimator) RTO() time.Duration {
+	return r.rto
+}
+
+// SRTT returns the smoothed round trip time, 0 if there are no samples yet
+func (r *rttEstimator) SRTT() time.Duration {
+	return r.srtt
+}
+
+func clampResendTimeout(rto time.Duration) time.Duration {
+	if rto < MIN_RESEND_TIMEOUT {
+		return MIN_RESEND_TIMEOUT
+	}
+	if rto > MAX_RESEND_TIMEOUT {
+		return MAX_RESEND_TIMEOUT
+	}
+	return rto
+}
@@ -0,0 +1,177 @@
+package transfer
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// Every UDP datagram is sealed with ChaCha20-Poly1305 under a key for the
+// direction it travels in.  The keys are derived from an X25519 exchange
+// in the Request/RequestResponse, so they're only as trustworthy as the
+// TCP connection that carried the public keys, use TLS.
+//
+// Packet IDs repeat when packets are resent, so the nonce is a datagram
+// sequence number sent in the clear ahead of the ciphertext instead.  The
+// packet ID is inside the authenticated plaintext.
+
+// SEAL_HEADER_LEN is the length of the datagram sequence number
+const SEAL_HEADER_LEN = 8
+
+// SEAL_OVERHEAD is how much longer a sealed datagram is than its packet
+const SEAL_OVERHEAD = SEAL_HEADER_LEN + chacha20poly1305.Overhead
+
+// REPLAY_WINDOW is how far behind the newest datagram an older one can
+// arrive before it's treated as a replay
+const REPLAY_WINDOW = 1024
+
+var errForgedDatagram = errors.New("datagram failed authentication")
+var errReplayedDatagram = errors.New("datagram was replayed")
+
+// NewSessionKey makes the X25519 key whose public half goes in the
+// Request or RequestResponse
+func NewSessionKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// DeriveSessionKeys derives the keys that seal packets sent by the source
+// and by the destination from our private key and the peer's public key.
+// Both sides derive the same pair.
+func DeriveSessionKeys(key *ecdh.PrivateKey, peerPublicKey []byte, requestID uuid.UUID) ([]byte, []byte, error) {
+	peerKey, err := ecdh.X25519().NewPublicKey(peerPublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret, err := key.ECDH(peerKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sourceKey := make([]byte, chacha20poly1305.KeySize)
+	destinationKey := make([]byte, chacha20poly1305.KeySize)
+
+	kdf := hkdf.New(sha256.New, secret, requestID[:], []byte("gosync packet keys"))
+	if _, err := io.ReadFull(kdf, sourceKey); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(kdf, destinationKey); err != nil {
+		return nil, nil, err
+	}
+
+	return sourceKey, destinationKey, nil
+}
+
+// PacketSealer seals the datagrams one side sends, it's only used by
+// the UDPSender goroutine
+type PacketSealer struct {
+	aead     cipher.AEAD
+	sequence uint64
+}
+
+func NewPacketSealer(key []byte) (*PacketSealer, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &PacketSealer{aead: aead}, nil
+}
+
+// Seal returns the datagram carrying plaintext
+func (sealer *PacketSealer) Seal(plaintext []byte) []byte {
+	sealer.sequence++
+
+	datagram := make([]byte, SEAL_HEADER_LEN, SEAL_HEADER_LEN+len(plaintext)+sealer.aead.Overhead())
+	binary.BigEndian.PutUint64(datagram, sealer.sequence)
+
+	return sealer.aead.Seal(datagram, sealNonce(sealer.sequence), plaintext, datagram[:SEAL_HEADER_LEN])
+}
+
+// PacketOpener opens the datagrams the other side sent, it's only used
+// by the UDPReceiver goroutine
+type PacketOpener struct {
+	aead cipher.AEAD
+
+	// highest is the newest sequence number opened, seen holds
+	// sequence+1 of the datagrams opened in the last REPLAY_WINDOW
+	highest uint64
+	seen    [REPLAY_WINDOW]uint64
+}
+
+func NewPacketOpener(key []byte) (*PacketOpener, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &PacketOpener{aead: aead}, nil
+}
+
+// Open returns the plaintext of datagram, or errForgedDatagram or
+// errReplayedDatagram if it should be dropped
+func (opener *PacketOpener) Open(datagram []byte) ([]byte, error) {
+	if len(datagram) < SEAL_HEADER_LEN+opener.aead.Overhead() {
+		return nil, errForgedDatagram
+	}
+
+	sequence := binary.BigEndian.Uint64(datagram)
+	if sequence == 0 {
+		return nil, errForgedDatagram
+	}
+
+	// cheap replay checks first, the sequence isn't authenticated yet
+	// so nothing is recorded until the datagram opens
+	if sequence+REPLAY_WINDOW <= opener.highest ||
+		opener.seen[sequence%REPLAY_WINDOW] == sequence+1 {
+		return nil, errReplayedDatagram
+	}
+
+	plaintext, err := opener.aead.Open(nil, sealNonce(sequence),
+		datagram[SEAL_HEADER_LEN:], datagram[:SEAL_HEADER_LEN])
+	if err != nil {
+		return nil, errForgedDatagram
+	}
+
+	opener.seen[sequence%REPLAY_WINDOW] = sequence + 1
+	if sequence > opener.highest {
+		opener.highest = sequence
+	}
+
+	return plaintext, nil
+}
+
+func sealNonce(sequence uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], sequence)
+	return nonce
+}
+
+// udpSealers returns this side's sealer and opener, both nil when opts
+// has no keys and packets travel in the clear
+func udpSealers(opts *Options, isSource bool) (*PacketSealer, *PacketOpener, error) {
+	if opts.SourceKey == nil && opts.DestinationKey == nil {
+		return nil, nil, nil
+	}
+
+	sendKey, receiveKey := opts.SourceKey, opts.DestinationKey
+	if !isSource {
+		sendKey, receiveKey = receiveKey, sendKey
+	}
+
+	sealer, err := NewPacketSealer(sendKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	opener, err := NewPacketOpener(receiveKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sealer, opener, nil
+}
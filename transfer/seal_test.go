@@ -0,0 +1,91 @@
+package transfer
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"testing"
+)
+
+// testSessionKeys runs both halves of the key exchange
+func testSessionKeys() ([]byte, []byte) {
+	requesterKey, err := NewSessionKey()
+	if err != nil {
+		panic(err)
+	}
+	daemonKey, err := NewSessionKey()
+	if err != nil {
+		panic(err)
+	}
+
+	requestID := uuid.New()
+	sourceKey, destinationKey, err := DeriveSessionKeys(
+		requesterKey, daemonKey.PublicKey().Bytes(), requestID)
+	if err != nil {
+		panic(err)
+	}
+
+	daemonSourceKey, daemonDestinationKey, err := DeriveSessionKeys(
+		daemonKey, requesterKey.PublicKey().Bytes(), requestID)
+	if err != nil {
+		panic(err)
+	}
+
+	if !bytes.Equal(sourceKey, daemonSourceKey) ||
+		!bytes.Equal(destinationKey, daemonDestinationKey) {
+		panic("both sides should derive the same keys")
+	}
+	if bytes.Equal(sourceKey, destinationKey) {
+		panic("each direction should have its own key")
+	}
+
+	return sourceKey, destinationKey
+}
+
+func TestSealOpen(t *testing.T) {
+	sourceKey, destinationKey := testSessionKeys()
+
+	sealer, _ := NewPacketSealer(sourceKey)
+	opener, _ := NewPacketOpener(sourceKey)
+	wrongOpener, _ := NewPacketOpener(destinationKey)
+
+	first := sealer.Seal([]byte("first"))
+	second := sealer.Seal([]byte("second"))
+
+	if _, err := wrongOpener.Open(first); err != errForgedDatagram {
+		t.Errorf("datagram opened with the other direction's key: %v", err)
+	}
+
+	// out of order is fine
+	if plaintext, err := opener.Open(second); err != nil || string(plaintext) != "second" {
+		t.Errorf("couldn't open second datagram: %q %v", plaintext, err)
+	}
+	if plaintext, err := opener.Open(first); err != nil || string(plaintext) != "first" {
+		t.Errorf("couldn't open first datagram: %q %v", plaintext, err)
+	}
+
+	if _, err := opener.Open(first); err != errReplayedDatagram {
+		t.Errorf("replayed datagram wasn't dropped: %v", err)
+	}
+
+	// a tampered datagram is dropped without using up the sequence
+	// number of the real one
+	third := sealer.Seal([]byte("third"))
+	tampered := append([]byte{}, third...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := opener.Open(tampered); err != errForgedDatagram {
+		t.Errorf("tampered datagram wasn't dropped: %v", err)
+	}
+	if _, err := opener.Open(third); err != nil {
+		t.Errorf("couldn't open third datagram after a forgery: %v", err)
+	}
+
+	// datagrams older than the replay window are dropped
+	for i := 0; i < REPLAY_WINDOW; i++ {
+		if _, err := opener.Open(sealer.Seal([]byte("filler"))); err != nil {
+			t.Fatalf("couldn't open filler datagram: %v", err)
+		}
+	}
+	if _, err := opener.Open(first); err != errReplayedDatagram {
+		t.Errorf("datagram older than the replay window wasn't dropped: %v", err)
+	}
+}
@@ -1,9 +1,11 @@
 package transfer
 
 import (
+	"context"
 	"hash"
 	"io"
 	"os"
+	"sync"
 )
 
 type Checksum struct {
@@ -14,38 +16,110 @@ type Checksum struct {
 	Offset         int64
 	EOF            bool
 	Done           bool
+	// Skip says the destination gave up on the file after sending
+	// some of its checksums
+	Skip           bool
 }
 
-func ProcessSignatures(opts *Options, manager Manager) {
+// ProcessSignatures makes the signatures of the destination's files, with
+// Options.SignatureWorkers workers that each handle some of the files.
+// Directories and symlinks are made here, in the order they're walked, so
+// a directory exists before anything in it is patched.
+func ProcessSignatures(ctx context.Context, opts *Options, manager Manager) {
 
 	defer manager.SignatureDone()
 
-	for fileinfo := range manager.FileInfoChannel() {
-		var err error
+	root, err := openRoot(opts, opts.Destination)
+	if err != nil {
+		manager.ReportError(err)
+		return
+	}
+	defer root.Close()
+
+	workers := stageWorkers(opts.SignatureWorkers)
+	shards := make([]chan FileInfo, workers)
+	var wait sync.WaitGroup
+	for i := range shards {
+		shards[i] = make(chan FileInfo, FILE_INFO_BUF_SIZE)
+		wait.Add(1)
+		go func(fileinfos chan FileInfo) {
+			defer wait.Done()
+			signatureWorker(ctx, opts, manager, root, fileinfos)
+		}(shards[i])
+	}
+	// the workers return once their shards are closed and drained
+	defer func() {
+		for _, fileinfos := range shards {
+			close(fileinfos)
+		}
+		wait.Wait()
+	}()
+
+	for {
+		var fileinfo FileInfo
+		select {
+		case fi, ok := <-manager.FileInfoChannel():
+			if !ok {
+				return
+			}
+			fileinfo = fi
+		case <-ctx.Done():
+			return
+		}
+
+		fileinfo.DestinationPath = opts.DestinationPath(fileinfo.RelPath)
+		name := root.name(fileinfo.RelPath)
 
 		if fileinfo.Mode.IsDir() {
 			// It's a directory, we just create the directory and continue
-			if err = os.Mkdir(fileinfo.DestinationPath, fileinfo.Mode); err != nil{
+			if err = root.Mkdir(name, fileinfo.Mode.Perm()); err != nil{
 				if ! os.IsExist(err) {
-					manager.ReportError(err)
-					return
+					if !manager.ReportFileError(fileinfo.RelPath, PHASE_SIGNATURE, err) {
+						return
+					}
 				}
+			} else {
+				manager.Observer().DirectoryCreated(fileinfo.RelPath)
 			}
 
 			//TODO: chown and chmod if possible
 
 			continue
 		} else if fileinfo.Mode & os.ModeSymlink == os.ModeSymlink {
-			// It's a symlink, just make it and continue
-			if err = os.Symlink(fileinfo.Target, fileinfo.DestinationPath); err != nil{
-				manager.ReportError(err)
-				return
+			// It's a symlink, just make it and continue, unless it
+			// could lead outside the transfer
+			if err = root.checkLink(fileinfo.RelPath, fileinfo.Target); err == nil {
+				err = root.Symlink(fileinfo.Target, name)
+			}
+			if err != nil{
+				if !manager.ReportFileError(fileinfo.RelPath, PHASE_SIGNATURE, err) {
+					return
+				}
 			}
 
 			continue
 		}
 
-		if _, err := os.Stat(fileinfo.DestinationPath); os.IsNotExist(err) {
+		select {
+		case shards[shardFor(fileinfo.RelPath, workers)] <- fileinfo:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// signatureWorker makes the signatures of the regular files in fileinfos,
+// which are all sharded to it
+func signatureWorker(ctx context.Context, opts *Options, manager Manager, root *transferRoot, fileinfos chan FileInfo) {
+
+	for fileinfo := range fileinfos {
+		if ctx.Err() != nil {
+			return
+		}
+
+		name := root.name(fileinfo.RelPath)
+
+		if _, err := root.Stat(name); os.IsNotExist(err) {
 			// destination does not exist, push an EOF checksum and continue
 			c := Checksum{
 				TransferFile: fileinfo,
@@ -60,15 +134,19 @@ func ProcessSignatures(opts *Options, manager Manager) {
 
 		} else if err != nil {
 			// error statting destination
-			manager.ReportError(err)
-			return
+			if !manager.ReportFileError(fileinfo.RelPath, PHASE_SIGNATURE, err) {
+				return
+			}
+			continue
 
 		}
 
-		file, err := os.Open(fileinfo.DestinationPath)
+		file, err := root.Open(name)
 		if err != nil {
-			manager.ReportError(err)
-			return
+			if !manager.ReportFileError(fileinfo.RelPath, PHASE_SIGNATURE, err) {
+				return
+			}
+			continue
 		}
 
 		var offset int64
@@ -81,6 +159,11 @@ func ProcessSignatures(opts *Options, manager Manager) {
 
 
 		for {
+			if ctx.Err() != nil {
+				file.Close()
+				return
+			}
+
 			n, err = file.Read(buf)
 
 			if err != nil {
@@ -89,8 +172,8 @@ func ProcessSignatures(opts *Options, manager Manager) {
 
 			h, sigerr := Signature(buf[:n])
 			if sigerr != nil {
-				manager.ReportError(sigerr)
-				return
+				err = sigerr
+				break
 			}
 
 			c = Checksum{
@@ -107,6 +190,8 @@ func ProcessSignatures(opts *Options, manager Manager) {
 
 		}
 
+		file.Close()
+
 		if err == io.EOF {
 			// make a final EOF signature
 			c = Checksum{
@@ -118,10 +203,14 @@ func ProcessSignatures(opts *Options, manager Manager) {
 			manager.QueueSignature(c)
 
 		} else if err != nil {
-			manager.ReportError(err)
-			return
+			if !manager.ReportFileError(fileinfo.RelPath, PHASE_SIGNATURE, err) {
+				return
+			}
+			// deltas may be on their way for the checksums we sent
+			if offset > 0 {
+				manager.QueueSignature(Checksum{TransferFile: fileinfo, Offset: offset, Skip: true})
+			}
 		}
 
 	}
-	return
 }
\ No newline at end of file
@@ -2,14 +2,36 @@ package transfer
 
 import (
 	"os"
+	"sync"
+	"time"
 )
 
 type NetStats struct {
 	TCPLoopIterations        int64
 	ResentSourcePackets      int64
 	ResentDestinationPackets int64
+	// Spurious resends are resent packets that had already arrived
+	SpuriousSourceResends      int64
+	SpuriousDestinationResends int64
+	// Recovered packets were rebuilt from parity packets instead
+	// of being resent
+	RecoveredSourcePackets      int64
+	RecoveredDestinationPackets int64
+	// Forged and replayed packets claimed to come from a side but
+	// were dropped by the other side
+	ForgedSourcePackets        int64
+	ForgedDestinationPackets   int64
+	ReplayedSourcePackets      int64
+	ReplayedDestinationPackets int64
+	SourceRTT                  time.Duration
+	DestinationRTT             time.Duration
 }
+
+// TransferStats are recorded while a transfer runs, use Snapshot to read
+// them before it's done
 type TransferStats struct {
+	mutex sync.Mutex
+
 	Files         int64
 	Symlinks      int64
 	Directories   int64
@@ -34,23 +56,68 @@ func NewTransferStats() *TransferStats {
 			TCPLoopIterations:        int64(0),
 			ResentSourcePackets:      int64(0),
 			ResentDestinationPackets: int64(0),
+
+			SpuriousSourceResends:      int64(0),
+			SpuriousDestinationResends: int64(0),
 		},
 	}
 }
 
+// Snapshot returns a copy of the stats recorded so far
+func (s *TransferStats) Snapshot() *TransferStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	netStats := *s.NetStats
+	return &TransferStats{
+		Files:         s.Files,
+		Symlinks:      s.Symlinks,
+		Directories:   s.Directories,
+		SourceSize:    s.SourceSize,
+		BytesSent:     s.BytesSent,
+		BytesSame:     s.BytesSame,
+		BytesCopyDest: s.BytesCopyDest,
+		SigCacheHits:  s.SigCacheHits,
+		NetStats:      &netStats,
+	}
+}
+
 func (s *TransferStats) RecordTCPLoopIteration() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.NetStats.TCPLoopIterations++
 }
 
-func (s *TransferStats) RecordResentSourcePackets(n int) {
-	s.NetStats.ResentSourcePackets += int64(n)
-}
+// RecordPacketerStatuses records the resend and dropped datagram counters
+// of the source and destination packeters.  The counters are cumulative so they replace the
+// previously recorded values.  Duplicate packets received by one side were
+// resent spuriously by the other side.
+func (s *TransferStats) RecordPacketerStatuses(source PacketerStatus, destination PacketerStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.NetStats.ResentSourcePackets = source.ResentPackets
+	s.NetStats.ResentDestinationPackets = destination.ResentPackets
+
+	s.NetStats.SpuriousSourceResends = destination.DuplicatePackets
+	s.NetStats.SpuriousDestinationResends = source.DuplicatePackets
+
+	s.NetStats.RecoveredSourcePackets = destination.RecoveredPackets
+	s.NetStats.RecoveredDestinationPackets = source.RecoveredPackets
 
-func (s *TransferStats) RecordResentDestinationPackets(n int) {
-	s.NetStats.ResentDestinationPackets += int64(n)
+	s.NetStats.ForgedSourcePackets = destination.ForgedPackets
+	s.NetStats.ForgedDestinationPackets = source.ForgedPackets
+	s.NetStats.ReplayedSourcePackets = destination.ReplayedPackets
+	s.NetStats.ReplayedDestinationPackets = source.ReplayedPackets
+
+	s.NetStats.SourceRTT = source.SmoothedRTT
+	s.NetStats.DestinationRTT = destination.SmoothedRTT
 }
 
 func (s *TransferStats) RecordFileInfo(fi FileInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	// count files, directories, symlinks
 	if fi.Mode.IsDir() {
 		s.Directories += 1
@@ -69,6 +136,9 @@ func (s *TransferStats) RecordSignature(sig Checksum) {
 }
 
 func (s *TransferStats) RecordDelta(delta Delta) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	s.BytesSent += int64(len(delta.Content))
 
 	if delta.Len != len(delta.Content) {
@@ -1,113 +1,235 @@
 package transfer
 
 import (
-	"encoding/gob"
-	"golang.org/x/crypto/blake2b"
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
-func SyncOutgoing(conn net.Conn, opts *Options) (*TransferStats, error) {
-	Debug("SyncOutgoing starting...")
+// SyncOutgoing sends opts.Path to the peer on conn.  Cancelling ctx
+// aborts the transfer, telling the peer it failed, and the error wraps
+// ctx's error.  Either way every goroutine started for the transfer has
+// stopped, or is about to, when it returns.
+func SyncOutgoing(ctx context.Context, conn net.Conn, opts *Options) (*TransferStats, error) {
+	// conn and opts.UDPConn are ours to close even if the transfer never
+	// starts.  The tcp loop closes conn when it's done, this is for when
+	// it doesn't start or we give up waiting for it.
+	defer conn.Close()
+
 	// Verify request
 	if err := opts.Verify(); err != nil {
+		if opts.UDPConn != nil {
+			opts.UDPConn.Close()
+		}
 		return nil, err
 	}
 
-	manager := NewSourceManager()
+	// settle how packets will travel before anything is sent
+	opts, err := prepareTransport(conn, opts, true)
+	if err != nil {
+		return nil, err
+	}
 
-	// packet decoder
-	go DecodePackets(manager)
+	if opts.UDPConn != nil {
+		defer opts.UDPConn.Close()
+	}
 
-	// tcp loop passes transfer status information between source and dest
-	go TCPSourceLoop(conn, opts, manager)
+	manager := NewSourceManager(opts)
+	pipeline := manager.Context()
+	group := &transferGroup{}
 
-	// start udp sender gorouting
-	go UDPSender(opts.DestinationHost, opts.DestinationUDPPort, opts, manager)
+	// packet decoder
+	group.Go(func() { DecodePackets(pipeline, manager) })
 
-	// start udp receiver goroutine
-	go UDPReceiver(opts.SourceHost, opts.SourceUDPPort, opts, manager)
+	// tcp loop passes transfer status information between source and dest
+	group.Go(func() { TCPSourceLoop(pipeline, conn, opts, manager) })
+
+	// with TCPTransport the tcp loop sends and receives the packets
+	if opts.Transport != TCPTransport {
+		peer, err := remoteUDPPeer(opts, true)
+		if err != nil {
+			manager.ReportError(err)
+		} else if sealer, opener, err := udpSealers(opts, true); err != nil {
+			manager.ReportError(err)
+		} else {
+			// start udp sender gorouting
+			group.Go(func() { UDPSender(pipeline, opts.UDPConn, peer, sealer, opts, manager) })
+			manager.Packeter().SendProbes()
+
+			// start udp receiver goroutine
+			group.Go(func() { UDPReceiver(pipeline, opts.UDPConn, peer, opener, opts, manager) })
+		}
+	}
 
 	// Outgoing transfer side only does Walk and deltas
-	go Walk(opts, manager)
-	go ProcessDeltas(opts, manager)
+	group.Go(func() { Walk(pipeline, opts, manager) })
+	group.Go(func() { ProcessDeltas(pipeline, opts, manager) })
 
-	defer Debug("SyncOutgoing done")
-
-	for {
-		if manager.Error() != nil {
-			return manager.Stats(), manager.Error()
-		} else if manager.Done() && manager.NetDone() {
-			return manager.Stats(), nil
-		}
-		time.Sleep(1)
-	}
+	return waitForTransfer(ctx, manager, group)
 
 }
 
-func SyncIncoming(conn net.Conn, opts *Options) (*TransferStats, error) {
-	Debug("SyncIncoming starting...")
+// SyncIncoming receives the peer's files on conn into opts.Destination,
+// ctx is used like in SyncOutgoing
+func SyncIncoming(ctx context.Context, conn net.Conn, opts *Options) (*TransferStats, error) {
+	// closed even if the transfer never starts, like in SyncOutgoing
+	defer conn.Close()
+
 	// Verify request
 	if err := opts.Verify(); err != nil {
+		if opts.UDPConn != nil {
+			opts.UDPConn.Close()
+		}
+		return nil, err
+	}
+	// settle how packets will travel before anything is sent
+	opts, err := prepareTransport(conn, opts, false)
+	if err != nil {
 		return nil, err
 	}
-	h, _ := blake2b.New256(make([]byte, 0))
-	gob.Register(h)
 
-	manager := NewDestinationManager()
+	if opts.UDPConn != nil {
+		defer opts.UDPConn.Close()
+	}
+
+	manager := NewDestinationManager(opts)
+	pipeline := manager.Context()
+	group := &transferGroup{}
 
 	// packet decoder
-	go DecodePackets(manager)
+	group.Go(func() { DecodePackets(pipeline, manager) })
 
 	// tcp loop passes transfer status information between source and dest
-	go TCPDestinationLoop(conn, opts, manager)
-
-	// start udp sender gorouting
-	go UDPSender(opts.SourceHost, opts.SourceUDPPort, opts, manager)
-
-	// start udp receiver goroutine
-	go UDPReceiver(opts.DestinationHost, opts.DestinationUDPPort, opts, manager)
+	group.Go(func() { TCPDestinationLoop(pipeline, conn, opts, manager) })
+
+	// with TCPTransport the tcp loop sends and receives the packets
+	if opts.Transport != TCPTransport {
+		peer, err := remoteUDPPeer(opts, false)
+		if err != nil {
+			manager.ReportError(err)
+		} else if sealer, opener, err := udpSealers(opts, false); err != nil {
+			manager.ReportError(err)
+		} else {
+			// start udp sender gorouting
+			group.Go(func() { UDPSender(pipeline, opts.UDPConn, peer, sealer, opts, manager) })
+			manager.Packeter().SendProbes()
+
+			// start udp receiver goroutine
+			group.Go(func() { UDPReceiver(pipeline, opts.UDPConn, peer, opener, opts, manager) })
+		}
+	}
 
 	// Incoming transfer side only does signatures and patches
-	go ProcessSignatures(opts, manager)
-	go ProcessPatches(opts, manager)
-
-	defer Debug("SyncIncoming done")
+	group.Go(func() { ProcessSignatures(pipeline, opts, manager) })
+	group.Go(func() { ProcessPatches(pipeline, opts, manager) })
 
-	for {
-		if manager.Error() != nil {
-			return manager.Stats(), manager.Error()
-		} else if manager.Done() && manager.NetDone() {
-			return manager.Stats(), nil
-		}
-		time.Sleep(1)
-	}
+	return waitForTransfer(ctx, manager, group)
 
 }
 
-// SyncLocal does all filesystem operations locally
-func SyncLocal(opts *Options) (*TransferStats, error) {
+// SyncLocal does all filesystem operations locally, cancelling ctx stops
+// them
+func SyncLocal(ctx context.Context, opts *Options) (*TransferStats, error) {
 
 	// Verify request
 	if err := opts.Verify(); err != nil {
 		return nil, err
 	}
 
-	manager := MakeLocalManager()
+	manager := MakeLocalManager(opts)
+	pipeline := manager.Context()
+	group := &transferGroup{}
 
 	// Super simple
-	go Walk(opts, manager)
-	go ProcessSignatures(opts, manager)
-	go ProcessDeltas(opts, manager)
-	go ProcessPatches(opts, manager)
-
-	for {
-		if manager.Error() != nil {
-			return manager.Stats(), manager.Error()
-		} else if manager.Done() {
-			return manager.Stats(), nil
+	group.Go(func() { Walk(pipeline, opts, manager) })
+	group.Go(func() { ProcessSignatures(pipeline, opts, manager) })
+	group.Go(func() { ProcessDeltas(pipeline, opts, manager) })
+	group.Go(func() { ProcessPatches(pipeline, opts, manager) })
+
+	return waitForTransfer(ctx, manager, group)
+
+}
+
+// ABORT_TIMEOUT is how long a failed transfer waits for the tcp loop to
+// tell the peer before giving up on it
+const ABORT_TIMEOUT = 5 * time.Second
+
+var errTransferAborted = errors.New("transfer aborted")
+
+// transferGroup runs the goroutines of a transfer, so waitForTransfer
+// can tell when all of them have stopped
+type transferGroup struct {
+	wait sync.WaitGroup
+}
+
+func (group *transferGroup) Go(f func()) {
+	group.wait.Add(1)
+	go func() {
+		defer group.wait.Done()
+		f()
+	}()
+}
+
+// Stopped returns a channel that's closed once every goroutine the group
+// started has returned
+func (group *transferGroup) Stopped() <-chan struct{} {
+	stopped := make(chan struct{})
+	go func() {
+		group.wait.Wait()
+		close(stopped)
+	}()
+	return stopped
+}
+
+// waitForTransfer waits until all of the transfer's goroutines have
+// stopped.  If the transfer fails, or ctx is done, it only waits up to
+// ABORT_TIMEOUT for the tcp loop to tell the peer, the observer hears
+// that the transfer finished once the goroutines have stopped.  The
+// pipeline isn't
+// tied to ctx so that the peer hears about the abort before everything
+// stops.
+func waitForTransfer(ctx context.Context, manager Manager, group *transferGroup) (*TransferStats, error) {
+	stopped := group.Stopped()
+
+	// finished tells the observer what the transfer returns
+	finished := func(err error) (*TransferStats, error) {
+		manager.Observer().TransferFinished(manager.Stats(), err)
+		return manager.Stats(), err
+	}
+
+	select {
+	case <-stopped:
+		if err := manager.Error(); err != nil {
+			return finished(err)
 		}
-		time.Sleep(1)
+		if fileErrs := manager.FileErrors(); len(fileErrs) > 0 {
+			return finished(&PartialTransferError{FileErrors: fileErrs})
+		}
+		manager.Logger().Debug("transfer done")
+		return finished(nil)
+	case <-ctx.Done():
+		manager.ReportError(fmt.Errorf("%w: %w", errTransferAborted, context.Cause(ctx)))
+	case <-manager.Context().Done():
 	}
 
+	manager.Logger().Debug("transfer failed", "error", manager.Error())
+
+	select {
+	case <-stopped:
+		return finished(manager.Error())
+	case <-time.After(ABORT_TIMEOUT):
+	}
+
+	// the goroutines have been told to stop, and the tcp loop stops once
+	// conn is closed on our way out
+
+	err := manager.Error()
+	go func() {
+		<-stopped
+		manager.Observer().TransferFinished(manager.Stats(), err)
+	}()
+	return manager.Stats(), err
 }
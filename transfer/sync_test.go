@@ -2,13 +2,17 @@ package transfer
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"path"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
 type SyncTestCaseFilePiece struct {
@@ -32,6 +36,16 @@ type SyncTestCase struct {
 	Files       int64
 	Directories int64
 	Symlinks    int64
+
+	PacketSize      int
+	ProbePacketSize bool
+	FECGroupSize    int
+	Transport       Transport
+	Encrypt         bool
+
+	// Workers sets the workers of each pipeline stage, 0 for the default
+	Workers      int
+	MaxOpenFiles int
 }
 
 var testcasebasic = SyncTestCase{
@@ -129,7 +143,7 @@ func TestAbsPathVerify(t *testing.T) {
 		BlockSize:   10,
 	}
 
-	_, err := SyncLocal(opts)
+	_, err := SyncLocal(context.Background(), opts)
 
 	if err == nil {
 		t.Error("Should have gotten an absolute path error")
@@ -138,7 +152,7 @@ func TestAbsPathVerify(t *testing.T) {
 	opts.Path = "/a"
 	opts.Destination = "b"
 
-	_, err = SyncLocal(opts)
+	_, err = SyncLocal(context.Background(), opts)
 
 	if err == nil {
 		t.Error("Should have gotten an absolute path error")
@@ -147,13 +161,105 @@ func TestAbsPathVerify(t *testing.T) {
 	opts.Path = "a"
 	opts.Destination = "b"
 
-	_, err = SyncLocal(opts)
+	_, err = SyncLocal(context.Background(), opts)
 
 	if err == nil {
 		t.Error("Should have gotten an absolute path error")
 	}
 }
 
+func TestSyncLocalCancel(t *testing.T) {
+	source, err := ioutil.TempDir("/tmp", "gosync.source.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(source)
+
+	destination, err := ioutil.TempDir("/tmp", "gosync.dest.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+
+	makeFiles(testcasebasic.SourceFiles, source)
+
+	goroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = SyncLocal(ctx, &Options{
+		Path:        source,
+		Destination: destination,
+		BlockSize:   testcasebasic.BlockSize,
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled sync should fail with %v not %v", context.Canceled, err)
+	}
+
+	// the pipeline goroutines stop soon after
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v goroutines still running after cancelling, %v before",
+				runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// makeManyFilesTestCase makes dirs directories of files, each file has
+// its first block at the destination already
+func makeManyFilesTestCase(dirs int, files int) SyncTestCase {
+	testcase := SyncTestCase{
+		BlockSize:   10,
+		Directories: int64(dirs) + 1,
+		Files:       int64(dirs * files),
+	}
+
+	for d := 0; d < dirs; d++ {
+		for f := 0; f < files; f++ {
+			relPath := fmt.Sprintf("d%v/f%v", d, f)
+			character := rune('a' + f%26)
+
+			testcase.SourceFiles = append(testcase.SourceFiles, SyncTestCaseFile{
+				RelPath: relPath,
+				Pieces:  []SyncTestCaseFilePiece{{character, 10 + f*7 + d}},
+			})
+			testcase.DestFiles = append(testcase.DestFiles, SyncTestCaseFile{
+				RelPath: relPath,
+				Pieces:  []SyncTestCaseFilePiece{{character, 10}},
+			})
+
+			testcase.BytesSame += 10
+			testcase.BytesSent += int64(f*7 + d)
+		}
+	}
+
+	return testcase
+}
+
+func TestManyFilesLocal(t *testing.T) {
+	testcase := makeManyFilesTestCase(4, 25)
+	testcase.Workers = 4
+	buildAndRunLocalSyncTest(t, testcase)
+
+	// and with a single worker per stage, like before there were more
+	testcase.Workers = 1
+	buildAndRunLocalSyncTest(t, testcase)
+
+	// files are closed and opened again when there are too many
+	testcase.Workers = 4
+	testcase.MaxOpenFiles = 1
+	buildAndRunLocalSyncTest(t, testcase)
+}
+
+func TestManyFilesNet(t *testing.T) {
+	testcase := makeManyFilesTestCase(4, 25)
+	testcase.Workers = 4
+	buildAndRunNetSyncTest(t, testcase)
+}
+
 func TestBasicLocal(t *testing.T) {
 	testcase := testcasebasic
 	buildAndRunLocalSyncTest(t, testcase)
@@ -178,6 +284,33 @@ func TestBasicNetLargeBlocksize(t *testing.T) {
 	buildAndRunNetSyncTest(t, testcase)
 }
 
+func TestBasicNetProbePacketSize(t *testing.T) {
+	testcase := testcasebasic
+	testcase.PacketSize = 8000
+	testcase.ProbePacketSize = true
+	testcase.FECGroupSize = 4
+	buildAndRunNetSyncTest(t, testcase)
+}
+
+func TestBasicNetTCPTransport(t *testing.T) {
+	testcase := testcasebasic
+	testcase.Transport = TCPTransport
+	buildAndRunNetSyncTest(t, testcase)
+}
+
+func TestChecksumNetEncrypted(t *testing.T) {
+	testcase := testcasechecksum
+	testcase.Encrypt = true
+	testcase.FECGroupSize = 4
+	buildAndRunNetSyncTest(t, testcase)
+}
+
+func TestChecksumNetAutoTransport(t *testing.T) {
+	testcase := testcasechecksum
+	testcase.Transport = AutoTransport
+	buildAndRunNetSyncTest(t, testcase)
+}
+
 func TestChecksumLocal(t *testing.T) {
 	testcase := testcasechecksum
 	buildAndRunLocalSyncTest(t, testcase)
@@ -269,6 +402,10 @@ func assertFiles(t *testing.T, stats *TransferStats, files []SyncTestCaseFile, d
 func makeFiles(files []SyncTestCaseFile, dir string) {
 	for _, f := range files {
 
+		if err := os.MkdirAll(path.Dir(path.Join(dir, f.RelPath)), 0770); err != nil {
+			panic(err)
+		}
+
 		if f.Mode & os.ModeSymlink != 0 {
 
 			if err := os.Symlink(f.Target, path.Join(dir, f.RelPath)); err != nil {
@@ -319,9 +456,14 @@ func buildAndRunLocalSyncTest(t *testing.T, testcase SyncTestCase) *TransferStat
 
 		FollowLinks: false,
 		BlockSize:   testcase.BlockSize,
+
+		SignatureWorkers: testcase.Workers,
+		DeltaWorkers:     testcase.Workers,
+		PatchWorkers:     testcase.Workers,
+		MaxOpenFiles:     testcase.MaxOpenFiles,
 	}
 
-	stats, err := SyncLocal(opts)
+	stats, err := SyncLocal(context.Background(), opts)
 
 	if err != nil {
 		panic(err)
@@ -369,20 +511,60 @@ func buildAndRunNetSyncTest(t *testing.T, testcase SyncTestCase) *TransferStats
 	makeFiles(testcase.SourceFiles, source)
 	makeFiles(testcase.DestFiles, destination)
 
+	// each side binds its own ephemeral udp port, like the client and
+	// daemon do
+	sourceUDPConn, err := ListenUDP("localhost", PortRange{})
+	if err != nil {
+		panic(err)
+	}
+	destUDPConn, err := ListenUDP("localhost", PortRange{})
+	if err != nil {
+		panic(err)
+	}
+
 	opts := &Options{
 		SourceHost:    "localhost",
-		SourceUDPPort: 30000,
+		SourceUDPPort: UDPPort(sourceUDPConn),
 
 		DestinationHost:    "localhost",
-		DestinationUDPPort: 30001,
+		DestinationUDPPort: UDPPort(destUDPConn),
 
 		Path:        source,
 		Destination: destination,
 
 		FollowLinks: false,
 		BlockSize:   testcase.BlockSize,
+
+		PacketSize:      testcase.PacketSize,
+		ProbePacketSize: testcase.ProbePacketSize,
+		FECGroupSize:    testcase.FECGroupSize,
+
+		Transport: testcase.Transport,
+
+		SignatureWorkers: testcase.Workers,
+		DeltaWorkers:     testcase.Workers,
+		PatchWorkers:     testcase.Workers,
+		MaxOpenFiles:     testcase.MaxOpenFiles,
 	}
 
+	if testcase.Encrypt {
+		opts.SourceKey, opts.DestinationKey = testSessionKeys()
+	}
+
+	sourceOpts := *opts
+	sourceOpts.UDPConn = sourceUDPConn
+
+	destOpts := *opts
+	destOpts.UDPConn = destUDPConn
+
+	// listen before starting the source side so the destination
+	// can't dial too early
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		panic(err)
+	}
+	defer ln.Close()
+
 	listenerDone := make(chan bool)
 
 	var outstats *TransferStats
@@ -390,12 +572,6 @@ func buildAndRunNetSyncTest(t *testing.T, testcase SyncTestCase) *TransferStats
 	go func() {
 		defer close(listenerDone)
 
-		ln, err := net.Listen("tcp", "localhost:4038")
-
-		if err != nil {
-			t.Error(err)
-			return
-		}
 		conn, err := ln.Accept()
 
 		if err != nil {
@@ -403,23 +579,7 @@ func buildAndRunNetSyncTest(t *testing.T, testcase SyncTestCase) *TransferStats
 			return
 		}
 
-		// clean up ln
-		defer func() {
-			lnFile, err := ln.(*net.TCPListener).File()
-			if err != nil {
-				t.Error(err)
-			}
-
-			if err := ln.Close(); err != nil {
-				t.Error(err)
-			}
-
-			if err := lnFile.Close(); err != nil {
-				t.Error(err)
-			}
-		}()
-
-		outstats, err = SyncOutgoing(conn, opts)
+		outstats, err = SyncOutgoing(context.Background(), conn, &sourceOpts)
 
 		if err != nil {
 			t.Error(err)
@@ -428,13 +588,13 @@ func buildAndRunNetSyncTest(t *testing.T, testcase SyncTestCase) *TransferStats
 
 	}()
 
-	conn, err := net.Dial("tcp", "localhost:4038")
+	conn, err := net.Dial("tcp", ln.Addr().String())
 	if err != nil {
 		t.Error(err)
 		return nil
 	}
 
-	stats, err := SyncIncoming(conn, opts)
+	stats, err := SyncIncoming(context.Background(), conn, &destOpts)
 
 	if err != nil {
 		t.Error(err)
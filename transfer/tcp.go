@@ -1,8 +1,8 @@
 package transfer
 
 import (
+	"context"
 	"encoding/gob"
-	"fmt"
 	"net"
 	"time"
 )
@@ -20,7 +20,10 @@ type RequestDone struct {
 // manager.done to True.  At this point it's the responsibility of the
 // TCPSourceLoop to send RequestDone and read another RequestDone before
 // terminating.
-func TCPSourceLoop(conn net.Conn, opts *Options, manager *SourceManager) {
+//
+// The loops keep going when ctx is done, it's the manager's Context, so
+// they can tell the peer the transfer failed.
+func TCPSourceLoop(ctx context.Context, conn net.Conn, opts *Options, manager *SourceManager) {
 
 	// no matter what happens, we close the connection at the end
 	defer conn.Close()
@@ -28,6 +31,8 @@ func TCPSourceLoop(conn net.Conn, opts *Options, manager *SourceManager) {
 	// this loop is complete
 	defer manager.TCPDone()
 
+	log := manager.Logger()
+
 	decoder := gob.NewDecoder(conn)
 	encoder := gob.NewEncoder(conn)
 
@@ -40,8 +45,12 @@ func TCPSourceLoop(conn net.Conn, opts *Options, manager *SourceManager) {
 
 		manager.stats.RecordTCPLoopIteration()
 
-		Debug(fmt.Sprintf("Sending sourceStatus %v", sourceStatus))
-		if err := conn.SetWriteDeadline(time.Now().Add(time.Duration(1) * time.Second)); err != nil {
+		// with TCPTransport the packets go along with the status
+		sourceStatus.Packets = sendPacketsOverTCP(opts, manager.packeter)
+		moved := len(sourceStatus.Packets)
+
+		log.Debug("sending source status", "status", sourceStatus)
+		if err := conn.SetWriteDeadline(time.Now().Add(statusTimeout(opts))); err != nil {
 			manager.ReportError(err)
 			break
 		}
@@ -50,13 +59,9 @@ func TCPSourceLoop(conn net.Conn, opts *Options, manager *SourceManager) {
 			manager.ReportError(err)
 			break
 		}
-		Debug("Sent sourceStatus.")
-
 		sentError = sourceStatus.Failed
 
-		Debug("Getting destStatus...")
-
-		if err := conn.SetReadDeadline(time.Now().Add(time.Duration(1) * time.Second)); err != nil {
+		if err := conn.SetReadDeadline(time.Now().Add(statusTimeout(opts))); err != nil {
 			manager.ReportError(err)
 			break
 		}
@@ -67,18 +72,34 @@ func TCPSourceLoop(conn net.Conn, opts *Options, manager *SourceManager) {
 			break
 		}
 
-		Debug(fmt.Sprintf("Got destStatus %v", destStatus))
+		log.Debug("got destination status", "status", destStatus)
+
+		receivePacketsOverTCP(destStatus.Packets, manager.packeter)
+		moved += len(destStatus.Packets)
 
 		sourceStatus = manager.ReceiveStatusUpdate(destStatus)
 
-		time.Sleep(time.Millisecond * 100)
+		// the destination gave up and hung up, don't report that as
+		// another error
+		if destStatus.Failed != "" {
+			break
+		}
+
+		// don't wait around while there are packets to move, or
+		// once there's a failure to send
+		if moved == 0 {
+			select {
+			case <-time.After(time.Millisecond * 100):
+			case <-ctx.Done():
+			}
+		}
 	}
 
 	if manager.Error() != nil {
 		return
 	}
 
-	Debug("TCPSourceLoop ending, sending RequestDone...")
+	log.Debug("source loop ending, sending RequestDone")
 
 	if err := conn.SetWriteDeadline(time.Time{}); err != nil {
 		manager.ReportError(err)
@@ -90,7 +111,7 @@ func TCPSourceLoop(conn net.Conn, opts *Options, manager *SourceManager) {
 		return
 	}
 
-	Debug("TCPSourceLoop ending, reading RequestDone...")
+	log.Debug("source loop ending, reading RequestDone")
 
 	if err := conn.SetReadDeadline(time.Time{}); err != nil {
 		manager.ReportError(err)
@@ -104,17 +125,19 @@ func TCPSourceLoop(conn net.Conn, opts *Options, manager *SourceManager) {
 		return
 	}
 
-	Debug("TCPSourceLoop done")
+	log.Debug("source loop done")
 
 }
 
-func TCPDestinationLoop(conn net.Conn, opts *Options, manager *DestinationManager) {
+func TCPDestinationLoop(ctx context.Context, conn net.Conn, opts *Options, manager *DestinationManager) {
 	// no matter what happens, we close the connection at the end
 	defer conn.Close()
 	// tell the manager to close down all remaining net communication, and that
 	// this loop is complete
 	defer manager.TCPDone()
 
+	log := manager.Logger()
+
 	decoder := gob.NewDecoder(conn)
 	encoder := gob.NewEncoder(conn)
 
@@ -129,8 +152,7 @@ func TCPDestinationLoop(conn net.Conn, opts *Options, manager *DestinationManage
 
 		manager.stats.RecordTCPLoopIteration()
 
-		Debug("Getting sourceStatus...")
-		if err := conn.SetReadDeadline(time.Now().Add(time.Duration(1) * time.Second)); err != nil {
+		if err := conn.SetReadDeadline(time.Now().Add(statusTimeout(opts))); err != nil {
 			manager.ReportError(err)
 			break
 		}
@@ -141,12 +163,19 @@ func TCPDestinationLoop(conn net.Conn, opts *Options, manager *DestinationManage
 			break
 		}
 
-		Debug(fmt.Sprintf("Got sourceStatus %v", sourceStatus))
+		log.Debug("got source status", "status", sourceStatus)
+
+		receivePacketsOverTCP(sourceStatus.Packets, manager.packeter)
+		moved := len(sourceStatus.Packets)
 
 		destStatus = manager.ReceiveStatusUpdate(sourceStatus)
 
-		Debug(fmt.Sprintf("Sending destStatus %v", destStatus))
-		if err := conn.SetWriteDeadline(time.Now().Add(time.Duration(1) * time.Second)); err != nil {
+		// with TCPTransport the packets go along with the status
+		destStatus.Packets = sendPacketsOverTCP(opts, manager.packeter)
+		moved += len(destStatus.Packets)
+
+		log.Debug("sending destination status", "status", destStatus)
+		if err := conn.SetWriteDeadline(time.Now().Add(statusTimeout(opts))); err != nil {
 			manager.ReportError(err)
 			break
 		}
@@ -158,17 +187,23 @@ func TCPDestinationLoop(conn net.Conn, opts *Options, manager *DestinationManage
 		}
 		sentPatchDone = destStatus.PatchDone
 
-		Debug(fmt.Sprintf("Sent destStatus %v.", destStatus))
-
 		sentError = destStatus.Failed
-		time.Sleep(time.Millisecond * 100)
+
+		// don't wait around while there are packets to move, or
+		// once there's a failure to send
+		if moved == 0 {
+			select {
+			case <-time.After(time.Millisecond * 100):
+			case <-ctx.Done():
+			}
+		}
 	}
 
 	if manager.Error() != nil {
 		return
 	}
 
-	Debug(fmt.Sprintf("TCPDestinationLoop ending %v %v, reading RequestDone...", sentPatchDone, sentError))
+	log.Debug("destination loop ending, reading RequestDone")
 	if err := conn.SetReadDeadline(time.Time{}); err != nil {
 		manager.ReportError(err)
 		return
@@ -181,7 +216,7 @@ func TCPDestinationLoop(conn net.Conn, opts *Options, manager *DestinationManage
 		return
 	}
 
-	Debug("TCPDestinationLoop ending, sending RequestDone...")
+	log.Debug("destination loop ending, sending RequestDone")
 	if err := conn.SetWriteDeadline(time.Time{}); err != nil {
 		manager.ReportError(err)
 		return
@@ -0,0 +1,291 @@
+package transfer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCerts are the files of a generated CA and the server and client
+// certificates it signed
+type testCerts struct {
+	CA         string
+	ServerCert string
+	ServerKey  string
+	ClientCert string
+	ClientKey  string
+}
+
+// makeTestCerts writes a CA, a certificate for localhost and a client
+// certificate into dir
+func makeTestCerts(t *testing.T, dir string) testCerts {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gosync test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs := testCerts{CA: filepath.Join(dir, "ca.pem")}
+	writePEM(t, certs.CA, "CERTIFICATE", caDER)
+
+	// leaf signs a certificate for name and writes it with its key
+	leaf := func(serial int64, name string, usage x509.ExtKeyUsage) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		certFile := filepath.Join(dir, name+".pem")
+		keyFile := filepath.Join(dir, name+".key")
+		writePEM(t, certFile, "CERTIFICATE", der)
+		writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+		return certFile, keyFile
+	}
+
+	certs.ServerCert, certs.ServerKey = leaf(2, "localhost", x509.ExtKeyUsageServerAuth)
+	certs.ClientCert, certs.ClientKey = leaf(3, "client", x509.ExtKeyUsageClientAuth)
+	return certs
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshake connects client to a server with serverConfig and returns
+// the errors of both sides' handshakes, and the client certificates the
+// server saw
+func handshake(t *testing.T, serverConfig *tls.Config, clientConfig *tls.Config) (error, error, []*x509.Certificate) {
+	ln, err := tls.Listen("tcp", "localhost:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the server hangs up once it's done, so the client's read returns
+	var peerCerts []*x509.Certificate
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		err = tlsConn.Handshake()
+		peerCerts = tlsConn.ConnectionState().PeerCertificates
+		serverErr <- err
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+	if err == nil {
+		// with TLS 1.3 the client only hears about a rejected
+		// certificate once it reads
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		conn.Close()
+	}
+
+	return <-serverErr, err, peerCerts
+}
+
+func TestTLSHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "gosync.tls.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certs := makeTestCerts(t, dir)
+
+	serverConfig, err := ServerTLSConfig(certs.ServerCert, certs.ServerKey, certs.CA, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := ClientTLSConfig(certs.CA, certs.ClientCert, certs.ClientKey, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverErr, _, peerCerts := handshake(t, serverConfig, clientConfig)
+	if serverErr != nil {
+		t.Fatal(serverErr)
+	}
+	if len(peerCerts) == 0 || peerCerts[0].Subject.CommonName != "client" {
+		t.Errorf("the server should have verified the client's certificate, not %v", peerCerts)
+	}
+}
+
+func TestTLSRequireClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "gosync.tls.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certs := makeTestCerts(t, dir)
+
+	serverConfig, err := ServerTLSConfig(certs.ServerCert, certs.ServerKey, certs.CA, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := ClientTLSConfig(certs.CA, "", "", "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverErr, clientErr, _ := handshake(t, serverConfig, clientConfig)
+	if serverErr == nil || clientErr == nil {
+		t.Errorf("a client without a certificate should be turned away, not %v, %v", serverErr, clientErr)
+	}
+
+	// without requireClientCert the certificate is optional
+	serverConfig, err = ServerTLSConfig(certs.ServerCert, certs.ServerKey, certs.CA, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverErr, clientErr, _ := handshake(t, serverConfig, clientConfig); serverErr != nil || clientErr != nil {
+		t.Errorf("the client certificate should be optional, not %v, %v", serverErr, clientErr)
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "gosync.tls.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certs := makeTestCerts(t, dir)
+
+	_, err = ServerTLSConfig(certs.ServerCert, certs.ServerKey, "", true)
+	if err == nil || !strings.Contains(err.Error(), "client CA") {
+		t.Errorf("requiring client certificates without a CA should fail, not %v", err)
+	}
+
+	_, err = ClientTLSConfig(certs.CA, certs.ClientCert, "", "localhost")
+	if err == nil || !strings.Contains(err.Error(), "both a cert and a key") {
+		t.Errorf("a client certificate without a key should fail, not %v", err)
+	}
+}
+
+func TestTLSNetSync(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "gosync.tls.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certs := makeTestCerts(t, dir)
+
+	serverConfig, err := ServerTLSConfig(certs.ServerCert, certs.ServerKey, certs.CA, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := ClientTLSConfig(certs.CA, certs.ClientCert, certs.ClientKey, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := ioutil.TempDir("/tmp", "gosync.source.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(source)
+	destination, err := ioutil.TempDir("/tmp", "gosync.dest.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+	makeFiles(testcasebasic.SourceFiles, source)
+
+	opts := Options{
+		Path:        source,
+		Destination: destination,
+		BlockSize:   testcasebasic.BlockSize,
+		Transport:   TCPTransport,
+	}
+
+	ln, err := tls.Listen("tcp", "localhost:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	sourceErr := make(chan error)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			sourceErr <- err
+			return
+		}
+		sourceOpts := opts
+		_, err = SyncOutgoing(context.Background(), conn, &sourceOpts)
+		sourceErr <- err
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destOpts := opts
+	stats, err := SyncIncoming(context.Background(), conn, &destOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sourceErr; err != nil {
+		t.Fatal(err)
+	}
+
+	assertFiles(t, stats, testcasebasic.SourceFiles, destination)
+}
@@ -0,0 +1,188 @@
+package transfer
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"time"
+)
+
+// DEFAULT_HISTORY_SIZE is how many finished transfers the daemon
+// remembers unless configured otherwise
+const DEFAULT_HISTORY_SIZE = 100
+
+// The states a TransferInfo can be in
+const (
+	TRANSFER_RUNNING   = "running"
+	TRANSFER_DONE      = "done"
+	TRANSFER_FAILED    = "failed"
+	TRANSFER_CANCELLED = "cancelled"
+	// partial transfers skipped the files in FileErrors
+	TRANSFER_PARTIAL = "partial"
+	// rejected requests never ran, they're only in the AuditLog
+	TRANSFER_REJECTED = "rejected"
+)
+
+// TransferInfo describes a transfer the daemon is running or ran
+type TransferInfo struct {
+	RequestID uuid.UUID
+	// Direction is "push" or "pull", as the requester sees it
+	Direction string
+	Peer      string
+	// Host is the hostname the requester gave
+	Host   string `json:",omitempty"`
+	User   string `json:",omitempty"`
+	Module string `json:",omitempty"`
+	// Source and Destination are the paths as requested, Path is the
+	// daemon's side of the transfer
+	Source      string `json:",omitempty"`
+	Destination string `json:",omitempty"`
+	Path        string
+
+	State    string
+	Started  time.Time
+	Finished *time.Time `json:",omitempty"`
+
+	// Progress is the fraction of the source's bytes that were sent or
+	// found to be the same so far.  Transfers in a worker only report
+	// their stats when they finish.
+	Progress float64
+	Stats    *TransferStats
+	Error    string `json:",omitempty"`
+	// FileErrors are the files a partial transfer skipped
+	FileErrors []FileError `json:",omitempty"`
+}
+
+// activeTransfer is a transfer the daemon is running
+type activeTransfer struct {
+	info  TransferInfo
+	stats *TransferStats
+
+	// ctx is passed to the Sync functions, cancelFunc aborts the
+	// transfer
+	ctx        context.Context
+	cancelFunc context.CancelFunc
+	cancelled  bool
+}
+
+func newActiveTransfer(info TransferInfo) *activeTransfer {
+	info.State = TRANSFER_RUNNING
+	info.Started = time.Now()
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	return &activeTransfer{
+		info:       info,
+		stats:      NewTransferStats(),
+		ctx:        ctx,
+		cancelFunc: cancelFunc,
+	}
+}
+
+// cancel aborts the transfer, it must be called with the server's
+// mutex held
+func (active *activeTransfer) cancel() {
+	active.cancelled = true
+	active.cancelFunc()
+}
+
+// snapshot returns the transfer's info with the stats so far, it must be
+// called with the server's mutex held
+func (active *activeTransfer) snapshot() TransferInfo {
+	info := active.info
+	info.Stats = active.stats.Snapshot()
+	info.Progress = progress(info.Stats)
+	return info
+}
+
+// finish returns the transfer's final info, it must be called with the
+// server's mutex held.  stats replace the recorded ones when they're
+// not nil, transfers in a worker record them there.
+func (active *activeTransfer) finish(stats *TransferStats, err error) TransferInfo {
+	if stats != nil {
+		active.stats = stats
+	}
+	info := active.snapshot()
+
+	finished := time.Now()
+	info.Finished = &finished
+
+	partial, isPartial := err.(*PartialTransferError)
+	if active.cancelled {
+		info.State = TRANSFER_CANCELLED
+	} else if isPartial {
+		info.State = TRANSFER_PARTIAL
+		info.FileErrors = partial.FileErrors
+	} else if err != nil {
+		info.State = TRANSFER_FAILED
+	} else {
+		info.State = TRANSFER_DONE
+	}
+	if err != nil {
+		info.Error = err.Error()
+	}
+
+	// releases the context
+	active.cancelFunc()
+	return info
+}
+
+func progress(stats *TransferStats) float64 {
+	if stats.SourceSize == 0 {
+		return 0
+	}
+	done := float64(stats.BytesSent+stats.BytesSame) / float64(stats.SourceSize)
+	if done > 1 {
+		return 1
+	}
+	return done
+}
+
+// transferHistory keeps the last few finished transfers
+type transferHistory struct {
+	size    int
+	entries []TransferInfo
+}
+
+func newTransferHistory(size int) *transferHistory {
+	history := &transferHistory{}
+	history.resize(size)
+	return history
+}
+
+// resize changes how many transfers are kept, 0 uses DEFAULT_HISTORY_SIZE
+func (history *transferHistory) resize(size int) {
+	if size <= 0 {
+		size = DEFAULT_HISTORY_SIZE
+	}
+	history.size = size
+	history.trim()
+}
+
+func (history *transferHistory) add(info TransferInfo) {
+	history.entries = append(history.entries, info)
+	history.trim()
+}
+
+func (history *transferHistory) trim() {
+	if over := len(history.entries) - history.size; over > 0 {
+		history.entries = append([]TransferInfo{}, history.entries[over:]...)
+	}
+}
+
+// list returns the transfers newest first
+func (history *transferHistory) list() []TransferInfo {
+	list := make([]TransferInfo, 0, len(history.entries))
+	for i := len(history.entries) - 1; i >= 0; i-- {
+		list = append(list, history.entries[i])
+	}
+	return list
+}
+
+// find returns the latest transfer with requestID
+func (history *transferHistory) find(requestID uuid.UUID) (TransferInfo, bool) {
+	for i := len(history.entries) - 1; i >= 0; i-- {
+		if history.entries[i].RequestID == requestID {
+			return history.entries[i], true
+		}
+	}
+	return TransferInfo{}, false
+}
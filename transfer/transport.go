@@ -0,0 +1,213 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Transport selects how packets travel between source and destination
+type Transport uint8
+
+// UDPTransport sends packets as UDP datagrams
+const UDPTransport Transport = 0
+
+// TCPTransport sends packets along with the status updates on the TCP
+// connection, for networks where UDP is blocked
+const TCPTransport Transport = 1
+
+// AutoTransport uses UDP if datagrams make it across in both directions
+// at the start of the transfer and TCP otherwise
+const AutoTransport Transport = 2
+
+// TRANSPORT_PROBE_TIME is how long both sides send and listen for UDP
+// hellos when the transport is AutoTransport
+const TRANSPORT_PROBE_TIME = time.Second
+
+const TRANSPORT_PROBE_INTERVAL = 100 * time.Millisecond
+
+// TCP_TRANSPORT_STATUS_BYTES limits the packet content sent along with
+// a single status update when using TCPTransport
+const TCP_TRANSPORT_STATUS_BYTES = 256 * 1024
+
+var transportHello = []byte("gosync transport hello")
+
+func (t Transport) String() string {
+	switch t {
+	case UDPTransport:
+		return "udp"
+	case TCPTransport:
+		return "tcp"
+	case AutoTransport:
+		return "auto"
+	}
+	return fmt.Sprintf("Transport(%d)", uint8(t))
+}
+
+// ParseTransport parses "udp", "tcp" or "auto"
+func ParseTransport(s string) (Transport, error) {
+	switch strings.ToLower(s) {
+	case "udp":
+		return UDPTransport, nil
+	case "tcp":
+		return TCPTransport, nil
+	case "auto":
+		return AutoTransport, nil
+	}
+	return UDPTransport, errors.New(fmt.Sprintf("unknown transport: %v", s))
+}
+
+// TransportProbeResult is exchanged over the TCP connection after
+// probing, each side tells the other whether it received any hellos.
+type TransportProbeResult struct {
+	UDPReceived bool
+}
+
+// negotiateTransport probes whether UDP datagrams make it across in both
+// directions.  Both sides send hellos from their opts.UDPConn to each
+// other while listening on it, then exchange the results on conn; the
+// source sends its result first.  UDPTransport is only used if both sides
+// received a hello.
+func negotiateTransport(conn net.Conn, opts *Options, isSource bool) (Transport, error) {
+	peer, err := remoteUDPPeer(opts, isSource)
+	if err != nil {
+		return UDPTransport, err
+	}
+
+	received := probeUDP(opts.UDPConn, peer.Addr())
+
+	encoder := gob.NewEncoder(conn)
+	decoder := gob.NewDecoder(conn)
+
+	ours := TransportProbeResult{UDPReceived: received}
+	theirs := TransportProbeResult{}
+
+	if err := conn.SetDeadline(time.Now().Add(TRANSPORT_PROBE_TIME * 5)); err != nil {
+		return UDPTransport, err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	if isSource {
+		if err := encoder.Encode(&ours); err != nil {
+			return UDPTransport, err
+		}
+		if err := decoder.Decode(&theirs); err != nil {
+			return UDPTransport, err
+		}
+	} else {
+		if err := decoder.Decode(&theirs); err != nil {
+			return UDPTransport, err
+		}
+		if err := encoder.Encode(&ours); err != nil {
+			return UDPTransport, err
+		}
+	}
+
+	if ours.UDPReceived && theirs.UDPReceived {
+		return UDPTransport, nil
+	}
+
+	opts.logger().Warn("udp probing failed, falling back to the tcp transport")
+	return TCPTransport, nil
+}
+
+// probeUDP sends hellos to raddr for TRANSPORT_PROBE_TIME and returns
+// whether any hellos were received.  It keeps sending after receiving
+// one since the other side may not have heard from us yet.
+func probeUDP(conn net.PacketConn, raddr net.Addr) bool {
+	received := false
+	buf := make([]byte, len(transportHello))
+	deadline := time.Now().Add(TRANSPORT_PROBE_TIME)
+
+	// leave the socket without a deadline for the UDPReceiver
+	defer conn.SetReadDeadline(time.Time{})
+
+	for time.Now().Before(deadline) {
+		// we don't care if sending fails, the other side will
+		// report it never got our hello
+		conn.WriteTo(transportHello, raddr)
+
+		if err := conn.SetReadDeadline(time.Now().Add(TRANSPORT_PROBE_INTERVAL)); err != nil {
+			return received
+		}
+
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			if bytes.Equal(buf[:n], transportHello) {
+				received = true
+			}
+		}
+	}
+
+	return received
+}
+
+// prepareTransport settles the transport for this side of the transfer
+// and returns the options to use for it.  The options are copied since
+// features that only make sense for UDP are turned off for TCP.  Unless
+// the transport is TCPTransport the returned options have a UDPConn,
+// the caller must close it when the transfer is done.
+func prepareTransport(conn net.Conn, opts *Options, isSource bool) (*Options, error) {
+	o := *opts
+
+	if o.Transport != TCPTransport {
+		udpConn, err := localUDPConn(&o, isSource)
+		if err != nil {
+			return nil, err
+		}
+		o.UDPConn = udpConn
+	}
+
+	if o.Transport == AutoTransport {
+		t, err := negotiateTransport(conn, &o, isSource)
+		if err != nil {
+			o.UDPConn.Close()
+			return nil, err
+		}
+		o.Transport = t
+	}
+
+	if o.Transport == TCPTransport {
+		// TCP doesn't lose packets and doesn't care about MTUs
+		o.FECGroupSize = 0
+		o.ProbePacketSize = false
+
+		if o.UDPConn != nil {
+			o.UDPConn.Close()
+			o.UDPConn = nil
+		}
+	}
+
+	return &o, nil
+}
+
+// sendPacketsOverTCP and receivePacketsOverTCP move packets with the
+// status updates when using TCPTransport.
+func sendPacketsOverTCP(opts *Options, packeter *Packeter) []Packet {
+	if opts.Transport != TCPTransport {
+		return nil
+	}
+	return packeter.DrainPackets(TCP_TRANSPORT_STATUS_BYTES)
+}
+
+func receivePacketsOverTCP(packets []Packet, packeter *Packeter) {
+	for _, packet := range packets {
+		packeter.ReceievePacket(packet)
+	}
+}
+
+// statusTimeout is how long the TCP loops wait to send or receive a
+// status, statuses carry packets with TCPTransport so they get longer.
+func statusTimeout(opts *Options) time.Duration {
+	if opts.Transport == TCPTransport {
+		return 10 * time.Second
+	}
+	return time.Second
+}
@@ -2,41 +2,158 @@ package transfer
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
-	"log"
+	"math/rand"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-func UDPSender(host string, port int, opts *Options, manager Manager) {
+// PortRange is an inclusive range of ports to bind, the zero value
+// means any ephemeral port
+type PortRange struct {
+	Min int
+	Max int
+}
 
-	gob.Register(&Packet{})
+// ParsePortRange parses "", "30000" or "30000-30100"
+func ParsePortRange(s string) (PortRange, error) {
+	if s == "" {
+		return PortRange{}, nil
+	}
 
-	// make udp conn
-	var raddr *net.UDPAddr
-	raddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%v:%d", host, port))
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.Atoi(parts[0])
 	if err != nil {
-		manager.ReportError(err)
-		return
+		return PortRange{}, errors.New(fmt.Sprintf("unparsable port range: %v", s))
+	}
+	max := min
+	if len(parts) == 2 {
+		if max, err = strconv.Atoi(parts[1]); err != nil {
+			return PortRange{}, errors.New(fmt.Sprintf("unparsable port range: %v", s))
+		}
+	}
+
+	if min < 0 || max > 65535 || min > max {
+		return PortRange{}, errors.New(fmt.Sprintf("invalid port range: %v", s))
+	}
+
+	return PortRange{Min: min, Max: max}, nil
+}
+
+// ListenUDP binds a UDP socket on host using the first free port in
+// ports, starting from a random port in the range so concurrent
+// transfers don't all fight over the first one.
+func ListenUDP(host string, ports PortRange) (net.PacketConn, error) {
+	if ports.Min == 0 && ports.Max == 0 {
+		return net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	}
+
+	n := ports.Max - ports.Min + 1
+	offset := rand.Intn(n)
+
+	var err error
+	for i := 0; i < n; i++ {
+		port := ports.Min + (offset+i)%n
+		var conn net.PacketConn
+		conn, err = net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf(
+		"no free udp port in %v-%v: %v", ports.Min, ports.Max, err))
+}
+
+// UDPPort returns the port conn is bound to
+func UDPPort(conn net.PacketConn) int {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.Port
 	}
-	conn, err := net.ListenPacket("udp", ":0")
+	return 0
+}
+
+// UDPPeer is the address packets are sent to.  It starts as the address
+// the other side reported and then follows the address its sealed
+// packets actually arrive from, so our packets make it back through NATs
+// that rewrite the other side's port.
+type UDPPeer struct {
+	mutex sync.Mutex
+	addr  net.Addr
+}
+
+func NewUDPPeer(host string, port int) (*UDPPeer, error) {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
-		manager.ReportError(err)
-		return
+		return nil, err
+	}
+	return &UDPPeer{addr: addr}, nil
+}
+
+func (peer *UDPPeer) Addr() net.Addr {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	return peer.addr
+}
+
+func (peer *UDPPeer) Update(addr net.Addr) {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	peer.addr = addr
+}
+
+// localUDPConn returns the socket this side sends and receives packets
+// on, binding the local host and port from opts if the caller didn't
+// supply one in opts.UDPConn
+func localUDPConn(opts *Options, isSource bool) (net.PacketConn, error) {
+	if opts.UDPConn != nil {
+		return opts.UDPConn, nil
+	}
+
+	if isSource {
+		return net.ListenPacket("udp", fmt.Sprintf("%v:%d", opts.SourceHost, opts.SourceUDPPort))
 	}
+	return net.ListenPacket("udp", fmt.Sprintf("%v:%d", opts.DestinationHost, opts.DestinationUDPPort))
+}
+
+// remoteUDPPeer returns the other side's address from opts
+func remoteUDPPeer(opts *Options, isSource bool) (*UDPPeer, error) {
+	if isSource {
+		return NewUDPPeer(opts.DestinationHost, opts.DestinationUDPPort)
+	}
+	return NewUDPPeer(opts.SourceHost, opts.SourceUDPPort)
+}
 
-	// close it at the end of this func
-	defer conn.Close()
-	// tell the packeter that we're done
-	defer manager.Packeter().SenderDone()
+// UDPSender sends packets from the PacketChannel to the peer.  It sends
+// from the same socket the UDPReceiver reads from so the other side can
+// reply to wherever our packets came from.  Datagrams are sealed with
+// sealer unless it's nil.
+func UDPSender(ctx context.Context, conn net.PacketConn, peer *UDPPeer, sealer *PacketSealer, opts *Options, manager Manager) {
+
+	gob.Register(&Packet{})
+
+	log := manager.Logger()
+
+	// probes are only meaningful if they can't be fragmented
+	if opts.ProbePacketSize {
+		if err := setDontFragment(conn); err != nil {
+			manager.ReportError(err)
+			return
+		}
+	}
 
 	var buf bytes.Buffer
 
 	for packet := range manager.Packeter().PacketChannel {
 		encoder := gob.NewEncoder(&buf)
 
-		if manager.Done() || manager.Error() != nil {
+		if manager.Done() || ctx.Err() != nil {
 			break
 		}
 
@@ -45,21 +162,36 @@ func UDPSender(host string, port int, opts *Options, manager Manager) {
 			return
 		}
 
-		var n int
-		if n, err = conn.WriteTo(buf.Bytes(), raddr); err != nil {
+		datagram := buf.Bytes()
+		if sealer != nil {
+			datagram = sealer.Seal(datagram)
+		}
+
+		n, err := conn.WriteTo(datagram, peer.Addr())
+		if err != nil {
+			if packet.ContentType == ProbePacket {
+				// the probe was too large to send
+				buf.Reset()
+				continue
+			}
 			manager.ReportError(err)
 			return
 		}
 
-		if n != buf.Len() {
+		if n != len(datagram) {
 			manager.ReportError(fmt.Errorf("didn't send full packet"))
 		}
 
+		// start the packet's resend timer, parity packets aren't resent
+		if !packet.IsParity {
+			manager.Packeter().PacketSent(packet.PacketID)
+		}
+
 		buf.Reset()
-		Debug(fmt.Sprintf("Sent Packet %v", packet))
+		log.Debug("sent packet", "packet", packet)
 	}
 
-	Debug("UDP Sender Done")
+	log.Debug("udp sender done")
 }
 
 // Helper func for debugging gob encoders/decoders.
@@ -91,32 +223,36 @@ func verifyEncodeDecode(packet Packet) {
 	}
 }
 
-func UDPReceiver(host string, port int, opts *Options, manager Manager) {
-	// listen to incoming udp packets
-	conn, err := net.ListenPacket("udp", fmt.Sprintf("%v:%d", host, port))
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer conn.Close()
-	// tell the packeter that receiving is done
-	defer manager.Packeter().ReceiverDone()
-
+// UDPReceiver hands the packets arriving on conn to the Packeter.  If
+// opener isn't nil datagrams that fail to open are dropped and counted,
+// and only authenticated datagrams move the peer address.  Datagrams
+// that don't decode are dropped and counted too.
+func UDPReceiver(ctx context.Context, conn net.PacketConn, peer *UDPPeer, opener *PacketOpener, opts *Options, manager Manager) {
 	gob.Register(&Packet{})
 
-	var reader bytes.Buffer
-
-	for !manager.Done() && manager.Error() == nil {
-		decoder := gob.NewDecoder(&reader)
+	log := manager.Logger()
 
-		t := time.Now().Add(time.Duration(100) * time.Millisecond)
-		if err := conn.SetReadDeadline(t); err != nil {
-			manager.ReportError(err)
+	// interrupt the read below once the transfer is finished or failed
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-manager.Finished():
+		case <-ctx.Done():
+		case <-stopped:
 			return
 		}
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	var reader bytes.Buffer
+
+	buf := make([]byte, opts.MaxPacketSize()+PACKET_HEADER_ALLOWANCE+SEAL_OVERHEAD)
+
+	for !manager.Done() && ctx.Err() == nil {
+		decoder := gob.NewDecoder(&reader)
 
-		var n int
-		buf := make([]byte, 4096)
-		n, _, err = conn.ReadFrom(buf)
+		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
 			neterr, ok := err.(net.Error)
 			if !ok {
@@ -125,7 +261,6 @@ func UDPReceiver(host string, port int, opts *Options, manager Manager) {
 			}
 
 			if neterr.Timeout() {
-				Debug("timeout reading")
 				continue
 			} else {
 				manager.ReportError(err)
@@ -133,7 +268,25 @@ func UDPReceiver(host string, port int, opts *Options, manager Manager) {
 			}
 		}
 
-		if n, err = reader.Write(buf[:n]); err != nil {
+		// late hellos from transport negotiation aren't packets
+		if bytes.Equal(buf[:n], transportHello) {
+			continue
+		}
+
+		datagram := buf[:n]
+		if opener != nil {
+			datagram, err = opener.Open(datagram)
+			if err != nil {
+				log.Debug("dropped datagram", "from", addr, "error", err)
+				manager.Packeter().DroppedDatagram(err == errReplayedDatagram)
+				continue
+			}
+		}
+
+		// every datagram is a gob stream of its own, leftovers of one
+		// that didn't decode are dropped with it
+		reader.Reset()
+		if _, err = reader.Write(datagram); err != nil {
 			manager.ReportError(err)
 			return
 		}
@@ -141,14 +294,21 @@ func UDPReceiver(host string, port int, opts *Options, manager Manager) {
 		packet := &Packet{}
 
 		if err := decoder.Decode(packet); err != nil {
-			manager.ReportError(err)
-			return
+			// anyone can send us junk, it doesn't fail the transfer
+			log.Debug("dropped datagram", "from", addr, "error", err)
+			manager.Packeter().DroppedDatagram(false)
+			continue
 		}
-		Debug(fmt.Sprintf("Got Packet %v", packet))
+		log.Debug("got packet", "packet", packet)
 
+		// only follow the peer's address when its datagrams are sealed,
+		// otherwise anyone could redirect our packets
+		if opener != nil {
+			peer.Update(addr)
+		}
 		manager.Packeter().ReceievePacket(*packet)
 	}
 
-	Debug("UDP Receiver Done")
+	log.Debug("udp receiver done")
 
 }
@@ -0,0 +1,38 @@
+package transfer
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment sets the don't fragment bit on everything sent on conn,
+// datagrams larger than the path MTU are then dropped instead of being
+// fragmented, which is what makes packet size probes meaningful.
+func setDontFragment(conn net.PacketConn) error {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+
+	rawConn, err := udpConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		// the socket may be IPv4 or IPv6 (or both), set what applies
+		err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP,
+			syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6,
+			syscall.IPV6_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		if err4 != nil && err6 != nil {
+			sockErr = err4
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package transfer
+
+import (
+	"net"
+)
+
+// setDontFragment is only implemented on linux, elsewhere probes may be
+// fragmented and so will always appear to succeed.
+func setDontFragment(conn net.PacketConn) error {
+	return nil
+}
@@ -0,0 +1,67 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"testing"
+	"time"
+)
+
+func TestUDPReceiverDropsJunk(t *testing.T) {
+	conn, err := ListenUDP("localhost", PortRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stranger, err := ListenUDP("localhost", PortRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+
+	peer, err := NewUDPPeer("localhost", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerAddr := peer.Addr().String()
+
+	opts := &Options{}
+	manager := NewDestinationManager(opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan struct{})
+	go func() {
+		defer close(received)
+		UDPReceiver(ctx, conn, peer, nil, opts, manager)
+	}()
+
+	var packet bytes.Buffer
+	if err := gob.NewEncoder(&packet).Encode(Packet{PacketID: 1, IsEndPacket: true}); err != nil {
+		t.Fatal(err)
+	}
+	// unsealed datagrams come from anywhere, junk doesn't fail the
+	// transfer and a stranger's packet doesn't move the peer
+	for _, datagram := range [][]byte{[]byte("junk"), packet.Bytes()} {
+		if _, err := stranger.WriteTo(datagram, conn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-manager.Packeter().Received():
+	case <-time.After(time.Second):
+		t.Fatal("the packet after the junk should have been received")
+	}
+	cancel()
+	<-received
+
+	if err := manager.Error(); err != nil {
+		t.Errorf("junk shouldn't fail the transfer: %v", err)
+	}
+	if status := manager.Packeter().status(); status.ForgedPackets != 1 {
+		t.Errorf("the junk should have been counted, ForgedPackets is %v", status.ForgedPackets)
+	}
+	if addr := peer.Addr().String(); addr != peerAddr {
+		t.Errorf("the peer should still be %v not %v", peerAddr, addr)
+	}
+}
@@ -1,9 +1,9 @@
 package transfer
 
 import (
+	"context"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 )
 
@@ -14,36 +14,74 @@ type FileInfo struct {
 
 	ModTime         time.Time
 	Target          string
+
+	// RelPath is the file's path relative to the source Path and the
+	// Destination.  Each side works out its own full path from it, so
+	// a peer can't name files outside the transfer.
+	RelPath         string
+
+	// SourcePath is filled in by the source and DestinationPath by the
+	// destination, see Options.SourcePath and Options.DestinationPath
 	SourcePath      string
 	DestinationPath string
 }
 
 
-func Walk(opts *Options, manager Manager) {
+func Walk(ctx context.Context, opts *Options, manager Manager) {
 	// close the channel when we're done
 	defer manager.FileInfoDone()
 
+	// the walk lstats its way down from Path, Path itself has to be
+	// inside the root
+	root, err := openRoot(opts, opts.Path)
+	if err != nil {
+		manager.ReportError(err)
+		return
+	}
+	_, err = root.Lstat(root.name("."))
+	root.Close()
+	if err != nil {
+		manager.ReportError(err)
+		return
+	}
+
 	// our walk func just sends os.FileInfo objects to our channel
 	walkFunc := func(path string, info os.FileInfo, err error) error {
+		// stop walking once the transfer has failed
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// get path relative to the source root
+		relPath, relErr := filepath.Rel(opts.Path, path)
+		if relErr != nil {
+			return relErr
+		}
+		relPath = filepath.ToSlash(relPath)
+
 		if err != nil {
-			return err
+			// the root failing fails the transfer, anything under it
+			// can be skipped.  If it wasn't skipped it's been reported.
+			if path == opts.Path || !manager.ReportFileError(relPath, PHASE_WALK, err) {
+				return err
+			}
+			return nil
 		}
-		// get source path
-		sourceParts := strings.Split(path, opts.Path)
-		destPath := filepath.Join(opts.Destination, sourceParts[1])
 
 		t := FileInfo{
 			Mode: info.Mode(),
 			Size: info.Size(),
+			RelPath: relPath,
 			SourcePath: path,
-			DestinationPath: destPath,
 			ModTime: info.ModTime(),
 		}
 
 		// Record symlink target
 		if info.Mode() & os.ModeSymlink == os.ModeSymlink {
 			if t.Target, err = os.Readlink(path); err != nil {
-				return err
+				if !manager.ReportFileError(relPath, PHASE_WALK, err) {
+					return err
+				}
+				return nil
 			}
 		}
 
@@ -52,7 +90,7 @@ func Walk(opts *Options, manager Manager) {
 	}
 
 	// if it was a walk to remember, and errored, return the error
-	if err:= filepath.Walk(opts.Path, walkFunc); err != nil {
+	if err:= filepath.Walk(opts.Path, walkFunc); err != nil && ctx.Err() == nil {
 		manager.ReportError(err)
 		return
 	}
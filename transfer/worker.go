@@ -0,0 +1,164 @@
+package transfer
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// Modules with a Chroot or RunAs are served by a worker process, so
+// the daemon itself keeps its privileges while the transfer only has the
+// module's.  The daemon starts DaemonConfig.WorkerCommand, which must
+// call RunWorker, with these files:
+//
+//   fd 3: the control connection, relayed by the daemon so it works
+//         with TLS too
+//   fd 4: where the worker writes its WorkerResult
+//   fd 5: the transfer's udp socket, unless packets travel over tcp
+//
+// and the WorkerJob gob encoded on stdin.
+
+// Credentials are the user and group a worker switches to
+type Credentials struct {
+	UID int
+	GID int
+}
+
+// WorkerJob is everything a worker needs to run one side of a transfer
+type WorkerJob struct {
+	Direction Direction
+
+	// Opts has the module's paths as the worker sees them after its
+	// chroot.  UDPConn is always nil, the socket is passed as fd 5, and
+	// Stats are only sent back in the WorkerResult.  The hosts must be
+	// addresses, names don't resolve inside a chroot.
+	Opts   Options
+	HasUDP bool
+
+	// Chroot is the directory the worker chroots into, "" for none
+	Chroot string
+	// RunAs are the credentials the worker switches to, nil keeps
+	// the daemon's
+	RunAs *Credentials
+
+	// the worker logs to stderr at LogLevel in LogFormat, see NewLogger
+	LogLevel  slog.Level
+	LogFormat string
+}
+
+// WorkerResult is what the worker reports back when the transfer ends
+type WorkerResult struct {
+	Stats *TransferStats
+	Error string
+	// FileErrors are set when the transfer was partial, see
+	// PartialTransferError
+	FileErrors []FileError
+}
+
+const workerConnFD = 3
+const workerResultFD = 4
+const workerUDPFD = 5
+
+// needsWorker returns whether transfers in module run in a worker
+func (module *Module) needsWorker() bool {
+	return module != nil && (module.Chroot || module.RunAs != nil)
+}
+
+// newWorkerJob makes the job for a transfer in module.  opts has the
+// daemon's view of the paths, which are moved under the chroot.
+func newWorkerJob(module *Module, direction Direction, opts *Options) (*WorkerJob, error) {
+	// root can get back out of a chroot
+	if module.Chroot && (module.RunAs == nil || module.RunAs.UID == 0) {
+		return nil, errors.New(fmt.Sprintf("module %v chroots without running as a user other than root", module.Name))
+	}
+
+	job := &WorkerJob{
+		Direction: direction,
+		Opts:      *opts,
+		HasUDP:    opts.UDPConn != nil,
+		RunAs:     module.RunAs,
+	}
+	job.Opts.UDPConn = nil
+	job.Opts.Stats = nil
+	job.Opts.LogHandler = nil
+
+	if module.Chroot {
+		job.Chroot = module.Path
+		job.Opts.Root = "/"
+
+		localPath := &job.Opts.Destination
+		if direction == Incoming {
+			localPath = &job.Opts.Path
+		}
+
+		rel, err := filepath.Rel(module.Path, *localPath)
+		if err != nil {
+			return nil, err
+		}
+		*localPath = filepath.Join("/", rel)
+	}
+
+	return job, nil
+}
+
+// RunWorker runs the transfer job read from stdin, see WorkerJob.  It
+// returns an error if the worker couldn't be set up, errors in the
+// transfer itself are reported in the WorkerResult.
+func RunWorker(stdin io.Reader) error {
+	job := &WorkerJob{}
+	if err := gob.NewDecoder(stdin).Decode(job); err != nil {
+		return err
+	}
+
+	logger, err := NewLogger(os.Stderr, job.LogLevel, job.LogFormat)
+	if err != nil {
+		return err
+	}
+	job.Opts.LogHandler = logger.With("worker", os.Getpid()).Handler()
+
+	conn, err := net.FileConn(os.NewFile(workerConnFD, "conn"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resultFile := os.NewFile(workerResultFD, "result")
+	if resultFile == nil {
+		return errors.New("worker has no result file")
+	}
+	defer resultFile.Close()
+
+	if job.HasUDP {
+		if job.Opts.UDPConn, err = net.FilePacketConn(os.NewFile(workerUDPFD, "udp")); err != nil {
+			return err
+		}
+	}
+
+	if err := dropPrivileges(job.Chroot, job.RunAs); err != nil {
+		return err
+	}
+
+	ctx, stop := abortOnSignal()
+	defer stop()
+
+	var stats *TransferStats
+	if job.Direction == Incoming {
+		stats, err = SyncOutgoing(ctx, conn, &job.Opts)
+	} else {
+		stats, err = SyncIncoming(ctx, conn, &job.Opts)
+	}
+
+	result := &WorkerResult{Stats: stats}
+	if partial, ok := err.(*PartialTransferError); ok {
+		result.FileErrors = partial.FileErrors
+	} else if err != nil {
+		result.Error = err.Error()
+	}
+
+	return gob.NewEncoder(resultFile).Encode(result)
+}
@@ -0,0 +1,170 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// WORKER_ABORT_SIGNAL tells a worker to abort its transfer.  It isn't
+// SIGTERM so workers aren't aborted along with a daemon that's draining.
+const WORKER_ABORT_SIGNAL = syscall.SIGUSR1
+
+// runInWorker runs the daemon's side of a transfer in a worker process,
+// relaying conn to it.  Cancelling ctx aborts the worker's transfer.
+func runInWorker(ctx context.Context, conn net.Conn, job *WorkerJob, udpConn net.PacketConn, config *DaemonConfig) (*TransferStats, error) {
+	if len(config.WorkerCommand) == 0 {
+		return nil, errors.New("module needs a worker but no worker command is configured")
+	}
+
+	if config.LogLevel != nil {
+		job.LogLevel = config.LogLevel.Level()
+	}
+	job.LogFormat = config.LogFormat
+
+	var stdin bytes.Buffer
+	if err := gob.NewEncoder(&stdin).Encode(job); err != nil {
+		return nil, err
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	relayFile := os.NewFile(uintptr(fds[0]), "relay")
+	workerConnFile := os.NewFile(uintptr(fds[1]), "worker conn")
+	defer workerConnFile.Close()
+
+	relay, err := net.FileConn(relayFile)
+	relayFile.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer relay.Close()
+
+	resultReader, resultWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer resultReader.Close()
+	defer resultWriter.Close()
+
+	cmd := exec.Command(config.WorkerCommand[0], config.WorkerCommand[1:]...)
+	cmd.Stdin = &stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if config.LogOutput != nil {
+		cmd.Stderr = config.LogOutput
+	}
+	cmd.ExtraFiles = []*os.File{workerConnFile, resultWriter}
+	// keep workers out of the daemon's process group, so a ^C meant
+	// for the daemon lets it drain rather than killing them
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if udpConn != nil {
+		udp, ok := udpConn.(*net.UDPConn)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("can't pass %T to a worker", udpConn))
+		}
+		udpFile, err := udp.File()
+		if err != nil {
+			return nil, err
+		}
+		defer udpFile.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, udpFile)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// the worker has its own copies now, and the result pipe only
+	// reaches EOF once the worker's copy is closed
+	workerConnFile.Close()
+	resultWriter.Close()
+	if udpConn != nil {
+		udpConn.Close()
+	}
+
+	exited := make(chan bool)
+	defer close(exited)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Signal(WORKER_ABORT_SIGNAL)
+		case <-exited:
+		}
+	}()
+
+	relayed := make(chan bool)
+	go io.Copy(relay, conn)
+	go func() {
+		defer close(relayed)
+		io.Copy(conn, relay)
+	}()
+
+	result := &WorkerResult{}
+	decodeErr := gob.NewDecoder(resultReader).Decode(result)
+
+	waitErr := cmd.Wait()
+
+	// the worker's end is closed now, so once everything it wrote has
+	// been relayed we can hang up on the peer
+	<-relayed
+	conn.Close()
+
+	if decodeErr != nil {
+		if waitErr != nil {
+			return nil, errors.New(fmt.Sprintf("worker failed: %v", waitErr))
+		}
+		return nil, errors.New(fmt.Sprintf("worker sent no result: %v", decodeErr))
+	}
+
+	if result.Error != "" {
+		return result.Stats, errors.New(result.Error)
+	} else if len(result.FileErrors) > 0 {
+		return result.Stats, &PartialTransferError{FileErrors: result.FileErrors}
+	}
+	return result.Stats, nil
+}
+
+// abortOnSignal returns a context that's cancelled when the worker gets
+// WORKER_ABORT_SIGNAL
+func abortOnSignal() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), WORKER_ABORT_SIGNAL)
+}
+
+// dropPrivileges chroots into chroot and switches to creds, either can
+// be left empty.  Setgid and Setuid apply to every thread of the process.
+func dropPrivileges(chroot string, creds *Credentials) error {
+	if chroot != "" {
+		if err := syscall.Chroot(chroot); err != nil {
+			return err
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+
+	if creds != nil {
+		if err := syscall.Setgroups([]int{}); err != nil {
+			return err
+		}
+		if err := syscall.Setgid(creds.GID); err != nil {
+			return err
+		}
+		if err := syscall.Setuid(creds.UID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+// the test binary doubles as the worker command
+func TestMain(m *testing.M) {
+	if os.Getenv("GOSYNC_TEST_WORKER") == "1" {
+		if err := RunWorker(os.Stdin); err != nil {
+			fmt.Fprintln(os.Stderr, "Worker error:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestWorkerPatches(t *testing.T) {
+	t.Setenv("GOSYNC_TEST_WORKER", "1")
+
+	testcase := testcasechecksum
+
+	source, err := ioutil.TempDir("/tmp", "gosync.source.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(source)
+
+	destination, err := ioutil.TempDir("/tmp", "gosync.dest.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(destination)
+
+	makeFiles(testcase.SourceFiles, source)
+	makeFiles(testcase.DestFiles, destination)
+
+	// chrooting and switching user need root, without it the worker
+	// still runs the transfer out of process
+	module := &Module{Name: "test", Path: destination}
+	if os.Getuid() == 0 {
+		module.Chroot = true
+		module.RunAs = &Credentials{UID: 65534, GID: 65534}
+		if err := os.Chown(destination, 65534, 65534); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range testcase.DestFiles {
+			os.Chown(destination+"/"+f.RelPath, 65534, 65534)
+		}
+	}
+
+	// names don't resolve inside the chroot, the daemon always uses
+	// addresses
+	sourceUDPConn, err := ListenUDP("127.0.0.1", PortRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	destUDPConn, err := ListenUDP("127.0.0.1", PortRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &Options{
+		SourceHost:    "127.0.0.1",
+		SourceUDPPort: UDPPort(sourceUDPConn),
+
+		DestinationHost:    "127.0.0.1",
+		DestinationUDPPort: UDPPort(destUDPConn),
+
+		Path:        source,
+		Destination: destination,
+		BlockSize:   testcase.BlockSize,
+	}
+	opts.SourceKey, opts.DestinationKey = testSessionKeys()
+
+	sourceOpts := *opts
+	sourceOpts.UDPConn = sourceUDPConn
+
+	destOpts := *opts
+	destOpts.UDPConn = destUDPConn
+
+	job, err := newWorkerJob(module, Outgoing, &destOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if module.Chroot && job.Opts.Destination != "/" {
+		t.Errorf("Destination should be / inside the chroot not %v", job.Opts.Destination)
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	workerDone := make(chan *TransferStats)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			close(workerDone)
+			return
+		}
+
+		config := &DaemonConfig{WorkerCommand: []string{os.Args[0]}}
+		stats, err := runInWorker(context.Background(), conn, job, destUDPConn, config)
+		if err != nil {
+			t.Error(err)
+		}
+		workerDone <- stats
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outstats, err := SyncOutgoing(context.Background(), conn, &sourceOpts)
+	if err != nil {
+		t.Error(err)
+	}
+
+	stats := <-workerDone
+	if stats == nil {
+		t.Fatal("worker didn't report stats")
+	}
+	if stats.BytesSent != outstats.BytesSent {
+		t.Errorf("worker BytesSent should be %v not %v", outstats.BytesSent, stats.BytesSent)
+	}
+
+	assertFiles(t, outstats, testcase.SourceFiles, destination)
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package transfer
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+func runInWorker(ctx context.Context, conn net.Conn, job *WorkerJob, udpConn net.PacketConn, config *DaemonConfig) (*TransferStats, error) {
+	return nil, errors.New("workers are only supported on linux")
+}
+
+func dropPrivileges(chroot string, creds *Credentials) error {
+	if chroot == "" && creds == nil {
+		return nil
+	}
+	return errors.New("dropping privileges is only supported on linux")
+}
+
+func abortOnSignal() (context.Context, context.CancelFunc) {
+	return context.WithCancel(context.Background())
+}